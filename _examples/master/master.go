@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/myzhan/boomer"
+)
+
+var bindHost string
+var bindPort int
+var users int
+var spawnRate float64
+var expectWorkers int
+
+func main() {
+	flag.StringVar(&bindHost, "bind-host", "0.0.0.0", "Host to bind")
+	flag.IntVar(&bindPort, "bind-port", 5557, "Port to bind")
+	flag.IntVar(&users, "users", 10, "Number of users to spawn across all the workers")
+	flag.Float64Var(&spawnRate, "spawn-rate", 1, "Users to spawn per second")
+	flag.IntVar(&expectWorkers, "expect-workers", 1, "Start spawning after this number of workers are connected")
+	flag.Parse()
+
+	master := boomer.NewMaster(bindHost, bindPort)
+	master.AddOutput(boomer.NewConsoleOutput())
+	if err := master.Run(); err != nil {
+		log.Fatalln(err)
+	}
+
+	for master.WorkerCount() < expectWorkers {
+		time.Sleep(time.Second)
+	}
+	master.Spawn(users, spawnRate)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
+	master.Quit()
+}
@@ -0,0 +1,142 @@
+package boomer
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+const (
+	minArrivalRateWait = 1 * time.Millisecond
+	maxArrivalRateWait = 100 * time.Millisecond
+)
+
+// ArrivalRate starts iterations at a fixed or ramping rate, no matter how long they take, which is
+// known as the open model. Iterations are run in a pool of goroutines which grows up to MaxUsers.
+// If all of them are busy, iterations are dropped instead of being delayed, and reported as dropped_iterations,
+// so slow responses don't lower the arrival rate and hide the tail latencies.
+type ArrivalRate struct {
+	// Iterations per second at the start.
+	StartRate float64
+	// Iterations per second after RampDuration.
+	TargetRate float64
+	// If RampDuration <= 0, the rate is always StartRate.
+	RampDuration time.Duration
+	// If MaxUsers <= 0, the amount of users asked by master or NewStandaloneBoomer is used.
+	MaxUsers int
+}
+
+// NewConstantArrivalRate returns an ArrivalRate which starts rate iterations per second.
+func NewConstantArrivalRate(rate float64, maxUsers int) *ArrivalRate {
+	return &ArrivalRate{
+		StartRate: rate,
+		MaxUsers:  maxUsers,
+	}
+}
+
+// NewRampingArrivalRate returns an ArrivalRate which ramps from startRate to targetRate linearly
+// in rampDuration, then keeps targetRate.
+func NewRampingArrivalRate(startRate, targetRate float64, rampDuration time.Duration, maxUsers int) *ArrivalRate {
+	return &ArrivalRate{
+		StartRate:    startRate,
+		TargetRate:   targetRate,
+		RampDuration: rampDuration,
+		MaxUsers:     maxUsers,
+	}
+}
+
+// rateAt returns iterations per second at elapsed.
+func (a *ArrivalRate) rateAt(elapsed time.Duration) float64 {
+	if a.RampDuration <= 0 {
+		return a.StartRate
+	}
+	if elapsed >= a.RampDuration {
+		return a.TargetRate
+	}
+	return a.StartRate + (a.TargetRate-a.StartRate)*elapsed.Seconds()/a.RampDuration.Seconds()
+}
+
+// iterationsAt returns how many iterations should be started in elapsed, it's the integral of rateAt.
+func (a *ArrivalRate) iterationsAt(elapsed time.Duration) int64 {
+	t := elapsed.Seconds()
+	if a.RampDuration <= 0 {
+		return int64(math.Floor(a.StartRate * t))
+	}
+	ramp := a.RampDuration.Seconds()
+	if t >= ramp {
+		return int64(math.Floor((a.StartRate+a.TargetRate)/2*ramp + a.TargetRate*(t-ramp)))
+	}
+	return int64(math.Floor(a.StartRate*t + (a.TargetRate-a.StartRate)*t*t/(2*ramp)))
+}
+
+// nextWait returns how long to wait before checking for due iterations again.
+func (a *ArrivalRate) nextWait(elapsed time.Duration) time.Duration {
+	rate := a.rateAt(elapsed)
+	if rate <= 0 {
+		return maxArrivalRateWait
+	}
+	wait := time.Duration(float64(time.Second) / rate)
+	if wait < minArrivalRateWait {
+		return minArrivalRateWait
+	}
+	if wait > maxArrivalRateWait {
+		return maxArrivalRateWait
+	}
+	return wait
+}
+
+// runArrivalRate starts iterations at r.arrivalRate until quit or r.shutdownChan is closed.
+// Wait times and the rate limiter are not used, because the arrival rate is already controlled.
+func (r *runner) runArrivalRate(spawnCount int, quit chan bool, spawnCompleteFunc func()) {
+	maxUsers := r.arrivalRate.MaxUsers
+	if maxUsers <= 0 {
+		maxUsers = spawnCount
+	}
+	if maxUsers <= 0 {
+		log.Println("No users to run iterations at the arrival rate.")
+		return
+	}
+	pool, err := ants.NewPool(maxUsers, ants.WithNonblocking(true))
+	if err != nil {
+		log.Printf("Failed to create pool for the arrival rate: %v\n", err)
+		return
+	}
+	defer pool.Release()
+	ctx := r.newSpawnContext(quit)
+	log.Printf("Running iterations at the arrival rate with up to %d users\n", maxUsers)
+
+	// goroutines of the pool are created on demand, so spawning is considered complete.
+	if spawnCompleteFunc != nil {
+		spawnCompleteFunc()
+	}
+
+	startTime := time.Now()
+	started := int64(0)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-r.shutdownChan:
+			return
+		case <-timer.C:
+		}
+
+		elapsed := time.Since(startTime)
+		for due := r.arrivalRate.iterationsAt(elapsed); started < due; started++ {
+			user := r.userAt(int(started))
+			err := pool.Submit(func() {
+				r.runTask(ctx, r.getTaskOf(user))
+			})
+			if err != nil {
+				r.stats.logDroppedIteration()
+			}
+		}
+		atomic.StoreInt32(&r.numClients, int32(pool.Running()))
+		timer.Reset(r.arrivalRate.nextWait(elapsed))
+	}
+}
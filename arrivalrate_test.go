@@ -0,0 +1,76 @@
+package boomer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArrivalRateIterations(t *testing.T) {
+	constant := NewConstantArrivalRate(10, 5)
+	assert.Equal(t, int64(0), constant.iterationsAt(0))
+	assert.Equal(t, int64(25), constant.iterationsAt(2500*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, constant.nextWait(0))
+
+	// ramps from 0 to 10 in 2 seconds, 10 iterations in the ramp, then 10 per second
+	ramping := NewRampingArrivalRate(0, 10, 2*time.Second, 5)
+	assert.Equal(t, int64(2), ramping.iterationsAt(time.Second))
+	assert.Equal(t, int64(10), ramping.iterationsAt(2*time.Second))
+	assert.Equal(t, int64(20), ramping.iterationsAt(3*time.Second))
+	assert.Equal(t, float64(5), ramping.rateAt(time.Second))
+	assert.Equal(t, maxArrivalRateWait, ramping.nextWait(0))
+	assert.Equal(t, minArrivalRateWait, NewConstantArrivalRate(100000, 5).nextWait(0))
+}
+
+func TestRunArrivalRate(t *testing.T) {
+	count := int64(0)
+	taskA := &Task{
+		Fn: func() {
+			atomic.AddInt64(&count, 1)
+		},
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 10, 0)
+	runner.arrivalRate = NewConstantArrivalRate(100, 0)
+	runner.stopChan = make(chan bool)
+	defer runner.shutdown()
+
+	completed := int32(0)
+	go runner.runArrivalRate(10, runner.stopChan, func() {
+		atomic.StoreInt32(&completed, 1)
+	})
+	time.Sleep(505 * time.Millisecond)
+	runner.stop()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&completed))
+	actual := atomic.LoadInt64(&count)
+	assert.True(t, actual >= 45 && actual <= 51, actual)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&runner.stats.droppedIterations))
+}
+
+func TestRunArrivalRateWithDroppedIterations(t *testing.T) {
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(time.Second)
+		},
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 10, 0)
+	runner.arrivalRate = NewConstantArrivalRate(100, 2)
+	runner.stopChan = make(chan bool)
+	defer runner.shutdown()
+
+	go runner.runArrivalRate(10, runner.stopChan, nil)
+	time.Sleep(305 * time.Millisecond)
+	runner.stop()
+	time.Sleep(10 * time.Millisecond)
+
+	// only 2 iterations are running, and the others are dropped instead of being delayed.
+	assert.True(t, atomic.LoadInt32(&runner.numClients) <= 2)
+	dropped := atomic.LoadInt64(&runner.stats.droppedIterations)
+	assert.True(t, dropped >= 25, dropped)
+
+	data := runner.stats.collectReportData()
+	assert.Equal(t, dropped, data["dropped_iterations"])
+	assert.Equal(t, int64(0), atomic.LoadInt64(&runner.stats.droppedIterations))
+}
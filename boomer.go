@@ -1,6 +1,7 @@
 package boomer
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -8,10 +9,15 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/myzhan/boomer/samples"
 )
 
 var defaultBoomer = &Boomer{}
 
+// exitFunc is replaced by unit tests.
+var exitFunc = os.Exit
+
 // Mode is the running mode of boomer, both standalone and distributed are supported.
 type Mode int
 
@@ -35,6 +41,18 @@ type Boomer struct {
 	spawnCount       int
 	spawnRate        float64
 	isOldSpawnWorker bool
+	loadShape        LoadShape
+	userClasses      map[string][]*Task
+	userWaitTimes    map[string]WaitTime
+	arrivalRate      *ArrivalRate
+	runTime          time.Duration
+	iterationLimit   int64
+	thresholds       *ThresholdOutput
+	// failed thresholds make the process exit with code 1, unless it's disabled
+	keepOnFailure bool
+	tracer        IterationTracer
+	sampleWriter  *samples.Writer
+	sampleNodeID  string
 
 	cpuProfileFile     string
 	cpuProfileDuration time.Duration
@@ -44,6 +62,15 @@ type Boomer struct {
 
 	outputs []Output
 
+	latencyHistogramEnabled bool
+
+	errorNormalizers []ErrorNormalizer
+	maxErrorKeys     int
+	errorExamples    int
+
+	masterHeartbeatTimeout time.Duration
+	drainTimeout           time.Duration
+
 	OutputInterval int
 }
 
@@ -76,6 +103,141 @@ func (b *Boomer) SetIsOldSpawnWorker(value bool) {
 	b.isOldSpawnWorker = value
 }
 
+// SetMasterHeartbeatTimeout sets how long to wait for heartbeats from master before reconnecting,
+// boomer will register to master again after reconnecting. The default is 60 seconds like locust,
+// and a timeout <= 0 disables it. It only works in distributed mode.
+func (b *Boomer) SetMasterHeartbeatTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = -1
+	}
+	b.masterHeartbeatTimeout = timeout
+}
+
+// SetDrainTimeout sets how long to wait for in-flight iterations to finish when boomer is stopped,
+// iterations still running after that are abandoned and reported as abandoned_iterations.
+// The default is 10 seconds, and a timeout <= 0 doesn't wait.
+func (b *Boomer) SetDrainTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = -1
+	}
+	b.drainTimeout = timeout
+}
+
+// EnableIterationTracing starts a span around every iteration of tasks by tracer, like OpenTelemetryOutput
+// or NewOtelIterationTracer. The context passed to Task.FnCtx carries the span by the OpenTelemetry API,
+// so spans of tasks are its children, and propagators like propagation.TraceContext inject it into
+// outgoing requests, so slow iterations can be linked to the server side traces.
+// Spans of iterations with failures recorded by RecordFailureContext or RecordError are marked as failed.
+// It must be called before the test is started.
+func (b *Boomer) EnableIterationTracing(tracer IterationTracer) {
+	b.tracer = tracer
+}
+
+// EnableSampleLog writes every request recorded by RecordSuccess, RecordFailure and the like to a file
+// of samples in format, which can be read by the samples package for offline analysis.
+// Only a random rate of requests are written, like 0.1 for 10%, and all of them if rate >= 1.
+// The file is written asynchronously, and closed when the test is stopped.
+// It must be called before the test is started.
+func (b *Boomer) EnableSampleLog(path string, format samples.Format, rate float64) error {
+	writer, err := samples.NewWriter(path, format, rate)
+	if err != nil {
+		return err
+	}
+	b.sampleWriter = writer
+	b.sampleNodeID = getNodeID()
+	return nil
+}
+
+// RegisterUserClass registers tasks as a user class, like a User class in locustfile.
+// When the master asks for users of this class, boomer spawns exactly that count of goroutines
+// running these tasks. Tasks passed to Run are used for classes which aren't registered.
+// It only works in distributed mode and must be called before the test is started.
+func (b *Boomer) RegisterUserClass(name string, tasks ...*Task) {
+	if b.userClasses == nil {
+		b.userClasses = make(map[string][]*Task)
+	}
+	b.userClasses[name] = tasks
+}
+
+// SetUserClassWaitTime sets the wait time of a user class registered by RegisterUserClass,
+// it's used by tasks of this class without Task.WaitTime.
+func (b *Boomer) SetUserClassWaitTime(name string, waitTime WaitTime) {
+	if b.userWaitTimes == nil {
+		b.userWaitTimes = make(map[string]WaitTime)
+	}
+	b.userWaitTimes[name] = waitTime
+}
+
+// SetArrivalRate starts iterations at the arrival rate, instead of running tasks in a loop by every user.
+// The amount of users becomes the max size of the pool, which runs iterations.
+// It must be called before the test is started.
+func (b *Boomer) SetArrivalRate(arrivalRate *ArrivalRate) {
+	b.arrivalRate = arrivalRate
+}
+
+// SetRunTime stops the test after d and quits in standalone mode, like --run-time in locust.
+// In-flight iterations are drained, and the final report is passed to outputs before Run returns.
+// If it's not called, the --run-time flag is used.
+func (b *Boomer) SetRunTime(d time.Duration) {
+	b.runTime = d
+}
+
+// SetIterationLimit stops the test after n iterations are started and quits in standalone mode,
+// it can be used with SetRunTime, and the test stops when either of them is reached.
+// If it's not called, the --iterations flag is used.
+func (b *Boomer) SetIterationLimit(n int64) {
+	b.iterationLimit = n
+}
+
+// AddThreshold adds a pass/fail rule like "p95 < 300ms", "fail_ratio < 1%" or "rps > 500" against
+// the stats of requests of name since the start of the test, all the requests are checked if name is empty.
+// Thresholds are checked on every report and when the test is stopped. If abortOnFail is true, the test
+// is stopped as soon as the rule is breached. When the test ends, a summary is printed, and the process
+// exits with code 1 if any threshold fails. See ParseThreshold, SetExitOnThresholdsFailure and Failed.
+func (b *Boomer) AddThreshold(name, expr string, abortOnFail bool) error {
+	return b.AddMethodThreshold("", name, expr, abortOnFail)
+}
+
+// SetExitOnThresholdsFailure sets whether the process exits with code 1 if any threshold fails, when Run returns
+// in standalone mode, or when boomer.Run returns after quitting in distributed mode. Outputs are stopped before
+// exiting. It's enabled by default, so CI fails with the thresholds.
+// Disable it to call Failed for the verdict instead. If it's not called, the --exit-on-thresholds-failure flag is used.
+func (b *Boomer) SetExitOnThresholdsFailure(exit bool) {
+	b.keepOnFailure = !exit
+}
+
+// Failed returns true if any threshold added by AddThreshold fails, or the test is aborted by one.
+// It does the final check of the thresholds, so it should be called after the test ends.
+func (b *Boomer) Failed() bool {
+	if b.thresholds == nil {
+		return false
+	}
+	b.thresholds.finish()
+	return !b.thresholds.Passed()
+}
+
+// AddMethodThreshold is like AddThreshold, but only requests of method are checked,
+// while AddThreshold aggregates requests of name with all the methods.
+func (b *Boomer) AddMethodThreshold(method, name, expr string, abortOnFail bool) error {
+	threshold, err := ParseThreshold(name, expr)
+	if err != nil {
+		return err
+	}
+	threshold.Method = method
+	threshold.AbortOnFail = abortOnFail
+	if b.thresholds == nil {
+		b.thresholds = NewThresholdOutput()
+	}
+	b.thresholds.AddThreshold(threshold)
+	return nil
+}
+
+// SetLoadShape makes boomer follow the load shape instead of spawning spawnCount users once,
+// it only works in standalone mode and must be called before the test is started.
+func (b *Boomer) SetLoadShape(shape LoadShape) {
+	b.loadShape = shape
+}
+
 // SetMode only accepts boomer.DistributedMode and boomer.StandaloneMode.
 func (b *Boomer) SetMode(mode Mode) {
 	switch mode {
@@ -101,6 +263,38 @@ func (b *Boomer) AddOutput(o Output) {
 	b.outputs = append(b.outputs, o)
 }
 
+// EnableLatencyHistogram keeps a high resolution latency histogram in microseconds, next to the
+// locust style response times. Outputs will get accurate p50, p90, p99 and p99.9 from it,
+// the stats reported to master are not changed.
+// It must be called before the test is started.
+func (b *Boomer) EnableLatencyHistogram() {
+	b.latencyHistogramEnabled = true
+}
+
+// AddErrorNormalizer adds a normalizer of the messages of failures, failures of the same normalized message
+// are counted as one error. Normalizers are applied in the order they're added, like:
+//
+//	b.AddErrorNormalizer(boomer.IDErrorNormalizer)
+//	b.AddErrorNormalizer(boomer.RegexpErrorNormalizer(regexp.MustCompile(`user \w+`), "user <name>"))
+//
+// It must be called before the test is started.
+func (b *Boomer) AddErrorNormalizer(normalizer ErrorNormalizer) {
+	b.errorNormalizers = append(b.errorNormalizers, normalizer)
+}
+
+// SetMaxErrorKeys limits the number of distinct errors since the start of the test. After the limit is
+// reached, failures of new errors are counted as the error "other" of their request type and name.
+// There's no limit if n isn't positive. It must be called before the test is started.
+func (b *Boomer) SetMaxErrorKeys(n int) {
+	b.maxErrorKeys = n
+}
+
+// SetErrorExamples keeps the first n distinct messages of failures of every error, before they're normalized.
+// They're reported as "examples" of the error. It must be called before the test is started.
+func (b *Boomer) SetErrorExamples(n int) {
+	b.errorExamples = n
+}
+
 // EnableCPUProfile will start cpu profiling after run.
 func (b *Boomer) EnableCPUProfile(cpuProfileFile string, duration time.Duration) {
 	b.cpuProfileFile = cpuProfileFile
@@ -131,18 +325,67 @@ func (b *Boomer) Run(tasks ...*Task) {
 	switch b.mode {
 	case DistributedMode:
 		b.slaveRunner = newSlaveRunner(b.masterHost, b.masterPort, tasks, b.rateLimiter)
+		b.slaveRunner.SetIsOldSpawnWorker(b.isOldSpawnWorker)
+		b.slaveRunner.setUserClasses(b.userClasses, b.userWaitTimes)
+		b.slaveRunner.arrivalRate = b.arrivalRate
+		b.configureStats(b.slaveRunner.stats)
+		b.slaveRunner.tracer = b.tracer
+		if b.sampleWriter != nil {
+			b.sampleNodeID = b.slaveRunner.nodeID
+			b.slaveRunner.addOutput(&sampleLogOutput{writer: b.sampleWriter})
+		}
+		if b.masterHeartbeatTimeout != 0 {
+			b.slaveRunner.masterHeartbeatTimeout = b.masterHeartbeatTimeout
+		}
+		if b.drainTimeout != 0 {
+			b.slaveRunner.drainTimeout = b.drainTimeout
+		}
+		if b.runTime > 0 || b.iterationLimit > 0 {
+			log.Println("Run time and iteration limits only work in standalone mode, the test is stopped by master.")
+		}
 		for _, o := range b.outputs {
 			b.slaveRunner.addOutput(o)
 		}
+		if b.thresholds != nil {
+			b.thresholds.abort = b.Quit
+			b.slaveRunner.addOutput(b.thresholds)
+		}
 		b.slaveRunner.run()
 	case StandaloneMode:
 		b.localRunner = newLocalRunner(tasks, b.rateLimiter, b.spawnCount, b.spawnRate)
 		b.localRunner.SetSlaveReportInterval(b.OutputInterval)
 		b.localRunner.SetIsOldSpawnWorker(b.isOldSpawnWorker)
+		b.localRunner.loadShape = b.loadShape
+		b.localRunner.arrivalRate = b.arrivalRate
+		b.localRunner.runTime = b.runTime
+		if b.localRunner.runTime == 0 {
+			b.localRunner.runTime = runTime
+		}
+		if b.iterationLimit > 0 {
+			b.localRunner.setIterationLimit(b.iterationLimit)
+		} else {
+			b.localRunner.setIterationLimit(iterationLimit)
+		}
+		if len(b.userClasses) > 0 {
+			log.Println("User classes are only spawned in distributed mode, ignored!")
+		}
+		b.configureStats(b.localRunner.stats)
+		b.localRunner.tracer = b.tracer
+		if b.sampleWriter != nil {
+			b.localRunner.addOutput(&sampleLogOutput{writer: b.sampleWriter})
+		}
+		if b.drainTimeout != 0 {
+			b.localRunner.drainTimeout = b.drainTimeout
+		}
 		for _, o := range b.outputs {
 			b.localRunner.addOutput(o)
 		}
+		if b.thresholds != nil {
+			b.thresholds.abort = b.localRunner.stopAndQuit
+			b.localRunner.addOutput(b.thresholds)
+		}
 		b.localRunner.run()
+		b.exitOnThresholdsFailure()
 	default:
 		log.Println("Invalid mode, expected boomer.DistributedMode or boomer.StandaloneMode")
 	}
@@ -150,48 +393,88 @@ func (b *Boomer) Run(tasks ...*Task) {
 
 // RecordSuccess reports a success.
 func (b *Boomer) RecordSuccess(requestType, name string, responseTime int64, responseLength int64) {
-	if b.localRunner == nil && b.slaveRunner == nil {
+	b.recordSuccess(nil, requestType, name, responseTime, 0, responseLength)
+}
+
+// RecordFailure reports a failure.
+func (b *Boomer) RecordFailure(requestType, name string, responseTime int64, exception string) {
+	b.recordFailure(nil, requestType, name, responseTime, 0, exception)
+}
+
+// RecordSuccessDuration is like RecordSuccess, but keeps the precision of responseTime
+// in the latency histogram, see EnableLatencyHistogram.
+func (b *Boomer) RecordSuccessDuration(requestType, name string, responseTime time.Duration, responseLength int64) {
+	b.recordSuccess(nil, requestType, name, int64(responseTime/time.Millisecond), int64(responseTime/time.Microsecond), responseLength)
+}
+
+// RecordFailureDuration is like RecordFailure, but keeps the precision of responseTime
+// in the latency histogram, see EnableLatencyHistogram.
+func (b *Boomer) RecordFailureDuration(requestType, name string, responseTime time.Duration, exception string) {
+	b.recordFailure(nil, requestType, name, int64(responseTime/time.Millisecond), int64(responseTime/time.Microsecond), exception)
+}
+
+// RecordSuccessContext is like RecordSuccessDuration, ctx is passed to Task.FnCtx,
+// so the ID of the user is written to the sample log, see EnableSampleLog.
+func (b *Boomer) RecordSuccessContext(ctx context.Context, requestType, name string, responseTime time.Duration, responseLength int64) {
+	b.recordSuccess(ctx, requestType, name, int64(responseTime/time.Millisecond), int64(responseTime/time.Microsecond), responseLength)
+}
+
+// RecordFailureContext is like RecordFailureDuration, ctx is passed to Task.FnCtx,
+// so the ID of the user is written to the sample log, see EnableSampleLog.
+func (b *Boomer) RecordFailureContext(ctx context.Context, requestType, name string, responseTime time.Duration, exception string) {
+	b.recordFailure(ctx, requestType, name, int64(responseTime/time.Millisecond), int64(responseTime/time.Microsecond), exception)
+}
+
+// RecordError is like RecordFailureContext, but records err, so ErrorTypeNormalizer can count failures
+// by the type of err. ctx can be nil, but err must not be nil.
+func (b *Boomer) RecordError(ctx context.Context, requestType, name string, responseTime time.Duration, err error) {
+	b.recordError(ctx, requestType, name, int64(responseTime/time.Millisecond), int64(responseTime/time.Microsecond), err)
+}
+
+func (b *Boomer) recordSuccess(ctx context.Context, requestType, name string, responseTime, responseTimeMicros, responseLength int64) {
+	stats := b.stats()
+	if stats == nil {
 		return
 	}
-	switch b.mode {
-	case DistributedMode:
-		b.slaveRunner.stats.requestSuccessChan <- &requestSuccess{
-			requestType:    requestType,
-			name:           name,
-			responseTime:   responseTime,
-			responseLength: responseLength,
-		}
-	case StandaloneMode:
-		b.localRunner.stats.requestSuccessChan <- &requestSuccess{
-			requestType:    requestType,
-			name:           name,
-			responseTime:   responseTime,
-			responseLength: responseLength,
-		}
+	stats.recordSuccess(requestType, name, responseTime, responseTimeMicros, responseLength)
+	if b.sampleWriter != nil {
+		b.sampleWriter.Write(newSample(ctx, requestType, name, microsOrDefault(responseTimeMicros, responseTime), responseLength, "", b.sampleNodeID))
 	}
 }
 
-// RecordFailure reports a failure.
-func (b *Boomer) RecordFailure(requestType, name string, responseTime int64, exception string) {
-	if b.localRunner == nil && b.slaveRunner == nil {
+func (b *Boomer) recordFailure(ctx context.Context, requestType, name string, responseTime, responseTimeMicros int64, exception string) {
+	b.recordError(ctx, requestType, name, responseTime, responseTimeMicros, recordedError(exception))
+}
+
+func (b *Boomer) recordError(ctx context.Context, requestType, name string, responseTime, responseTimeMicros int64, err error) {
+	stats := b.stats()
+	if stats == nil {
 		return
 	}
-	switch b.mode {
-	case DistributedMode:
-		b.slaveRunner.stats.requestFailureChan <- &requestFailure{
-			requestType:  requestType,
-			name:         name,
-			responseTime: responseTime,
-			error:        exception,
-		}
-	case StandaloneMode:
-		b.localRunner.stats.requestFailureChan <- &requestFailure{
-			requestType:  requestType,
-			name:         name,
-			responseTime: responseTime,
-			error:        exception,
-		}
+	stats.recordError(requestType, name, responseTime, responseTimeMicros, err)
+	markIterationFailed(ctx, err.Error())
+	if b.sampleWriter != nil {
+		b.sampleWriter.Write(newSample(ctx, requestType, name, microsOrDefault(responseTimeMicros, responseTime), 0, err.Error(), b.sampleNodeID))
+	}
+}
+
+// configureStats passes the options of stats to the stats of a runner.
+func (b *Boomer) configureStats(stats *requestStats) {
+	stats.histogramEnabled = b.latencyHistogramEnabled
+	stats.errorNormalizers = b.errorNormalizers
+	stats.maxErrorKeys = b.maxErrorKeys
+	stats.errorExamples = b.errorExamples
+}
+
+// stats returns the stats of the running runner, or nil if boomer isn't running.
+func (b *Boomer) stats() *requestStats {
+	switch {
+	case b.mode == DistributedMode && b.slaveRunner != nil:
+		return b.slaveRunner.stats
+	case b.mode == StandaloneMode && b.localRunner != nil:
+		return b.localRunner.stats
 	}
+	return nil
 }
 
 func (b *Boomer) SendCustomMessage(messageType string, data interface{}) {
@@ -212,10 +495,18 @@ func (b *Boomer) Stop() {
 	}
 }
 
-// Quit will send a quit message to the master.
+// Quit will send a quit message to the master. It returns after OnStop of all the outputs returns.
+// It doesn't exit the process if any threshold fails, boomer.Run does, check Failed after it in distributed mode.
 func (b *Boomer) Quit() {
 	Events.Publish(EVENT_QUIT)
+	b.shutdownAndWait()
+}
+
+// shutdownAndWait shuts down the runner after EVENT_QUIT is published, and waits for all the outputs to be stopped,
+// so the process doesn't exit before the final report is written.
+func (b *Boomer) shutdownAndWait() {
 	var ticker = time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
 
 	switch b.mode {
 	case DistributedMode:
@@ -228,8 +519,18 @@ func (b *Boomer) Quit() {
 			break
 		}
 		b.slaveRunner.shutdown()
+		<-b.slaveRunner.outputsStoppedChan
 	case StandaloneMode:
 		b.localRunner.shutdown()
+		<-b.localRunner.outputsStoppedChan
+	}
+}
+
+// exitOnThresholdsFailure exits the process with code 1 if any threshold fails, unless it's disabled by SetExitOnThresholdsFailure.
+func (b *Boomer) exitOnThresholdsFailure() {
+	if !b.keepOnFailure && b.Failed() {
+		log.Println("Some thresholds are failed, exit with code 1.")
+		exitFunc(1)
 	}
 }
 
@@ -243,7 +544,7 @@ func runTasksForTest(tasks ...*Task) {
 			for _, name := range taskNames {
 				if name == task.Name {
 					log.Println("Running " + task.Name)
-					task.Fn()
+					task.run(context.Background())
 				}
 			}
 		}
@@ -273,6 +574,8 @@ func Run(tasks ...*Task) {
 	defaultBoomer.masterPort = masterPort
 	defaultBoomer.EnableMemoryProfile(memoryProfileFile, memoryProfileDuration)
 	defaultBoomer.EnableCPUProfile(cpuProfileFile, cpuProfileDuration)
+	defaultBoomer.SetDrainTimeout(drainTimeout)
+	defaultBoomer.SetExitOnThresholdsFailure(exitOnThresholdsFailure)
 
 	defaultBoomer.Run(tasks...)
 
@@ -293,8 +596,11 @@ func Run(tasks ...*Task) {
 		quitByMe = true
 		defaultBoomer.Quit()
 	case <-quitChan:
+		// quit by master or a breached threshold, outputs are stopped before exiting
+		defaultBoomer.shutdownAndWait()
 	}
 
+	defaultBoomer.exitOnThresholdsFailure()
 	log.Println("shutdown")
 }
 
@@ -309,3 +615,33 @@ func RecordSuccess(requestType, name string, responseTime int64, responseLength
 func RecordFailure(requestType, name string, responseTime int64, exception string) {
 	defaultBoomer.RecordFailure(requestType, name, responseTime, exception)
 }
+
+// RecordSuccessDuration reports a success with the precise response time.
+// It's a convenience function to use the defaultBoomer.
+func RecordSuccessDuration(requestType, name string, responseTime time.Duration, responseLength int64) {
+	defaultBoomer.RecordSuccessDuration(requestType, name, responseTime, responseLength)
+}
+
+// RecordFailureDuration reports a failure with the precise response time.
+// It's a convenience function to use the defaultBoomer.
+func RecordFailureDuration(requestType, name string, responseTime time.Duration, exception string) {
+	defaultBoomer.RecordFailureDuration(requestType, name, responseTime, exception)
+}
+
+// RecordSuccessContext reports a success with the ID of the user in ctx.
+// It's a convenience function to use the defaultBoomer.
+func RecordSuccessContext(ctx context.Context, requestType, name string, responseTime time.Duration, responseLength int64) {
+	defaultBoomer.RecordSuccessContext(ctx, requestType, name, responseTime, responseLength)
+}
+
+// RecordFailureContext reports a failure with the ID of the user in ctx.
+// It's a convenience function to use the defaultBoomer.
+func RecordFailureContext(ctx context.Context, requestType, name string, responseTime time.Duration, exception string) {
+	defaultBoomer.RecordFailureContext(ctx, requestType, name, responseTime, exception)
+}
+
+// RecordError reports a failure of err.
+// It's a convenience function to use the defaultBoomer.
+func RecordError(ctx context.Context, requestType, name string, responseTime time.Duration, err error) {
+	defaultBoomer.RecordError(ctx, requestType, name, responseTime, err)
+}
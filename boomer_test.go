@@ -1,16 +1,21 @@
 package boomer
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/myzhan/boomer/samples"
 )
 
 func TestNewBoomer(t *testing.T) {
@@ -112,6 +117,7 @@ func TestEnableMemoryProfile(t *testing.T) {
 
 func TestStandaloneRun(t *testing.T) {
 	b := NewStandaloneBoomer(10, 10)
+	b.SetIsOldSpawnWorker(true)
 	b.EnableCPUProfile("cpu.pprof", 2*time.Second)
 	b.EnableMemoryProfile("mem.pprof", 2*time.Second)
 
@@ -160,6 +166,7 @@ func TestDistributedRun(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 
 	b := NewBoomer(masterHost, masterPort)
+	b.SetIsOldSpawnWorker(true)
 
 	count := int64(0)
 	taskA := &Task{
@@ -170,6 +177,7 @@ func TestDistributedRun(t *testing.T) {
 		},
 	}
 	b.Run(taskA)
+	time.Sleep(20 * time.Millisecond)
 
 	server.toClient <- newGenericMessage("spawn", map[string]interface{}{
 		"user_classes_count": map[interface{}]interface{}{
@@ -187,6 +195,72 @@ func TestDistributedRun(t *testing.T) {
 	}
 }
 
+func TestStandaloneRunWithFnCtx(t *testing.T) {
+	b := NewStandaloneBoomer(10, 10)
+
+	// every user runs one iteration until it's stopped, so the default spawner runs 10 of them too.
+	count := int64(0)
+	taskA := &Task{
+		Name: "increaseCount",
+		FnCtx: func(ctx context.Context) {
+			atomic.AddInt64(&count, 1)
+			<-ctx.Done()
+		},
+	}
+	go b.Run(taskA)
+
+	time.Sleep(2 * time.Second)
+
+	b.Quit()
+
+	if atomic.LoadInt64(&count) != 10 {
+		t.Error("count is", atomic.LoadInt64(&count), "expected: 10")
+	}
+}
+
+func TestDistributedRunWithFnCtx(t *testing.T) {
+	masterHost := "0.0.0.0"
+	rand.Seed(Now())
+	masterPort := rand.Intn(1000) + 10240
+
+	server := newTestServer(masterHost, masterPort)
+	defer server.close()
+
+	log.Println(fmt.Sprintf("Starting to serve on %s:%d", masterHost, masterPort))
+	server.start()
+
+	time.Sleep(20 * time.Millisecond)
+
+	b := NewBoomer(masterHost, masterPort)
+
+	// every user runs one iteration until it's stopped, so the default spawner runs 10 of them too.
+	count := int64(0)
+	taskA := &Task{
+		Name: "increaseCount",
+		FnCtx: func(ctx context.Context) {
+			atomic.AddInt64(&count, 1)
+			<-ctx.Done()
+		},
+	}
+	b.Run(taskA)
+	time.Sleep(20 * time.Millisecond)
+
+	server.toClient <- newGenericMessage("spawn", map[string]interface{}{
+		"user_classes_count": map[interface{}]interface{}{
+			"Dummy":  int64(5),
+			"Dummy2": int64(5),
+		},
+	}, b.slaveRunner.nodeID)
+
+	time.Sleep(time.Second)
+
+	b.Quit()
+
+	if atomic.LoadInt64(&count) != 10 {
+		t.Error("count is", atomic.LoadInt64(&count), "expected: 10")
+	}
+}
+
 func TestRunTasksForTest(t *testing.T) {
 	count := 0
 	taskA := &Task{
@@ -293,6 +367,7 @@ func TestRun(t *testing.T) {
 		},
 	}
 
+	defaultBoomer.SetIsOldSpawnWorker(true)
 	go Run(taskA)
 	time.Sleep(20 * time.Millisecond)
 
@@ -319,12 +394,14 @@ func TestRecordSuccess(t *testing.T) {
 	defaultBoomer.slaveRunner = newSlaveRunner(masterHost, masterPort, nil, nil)
 	RecordSuccess("http", "foo", int64(1), int64(10))
 
-	requestSuccessMsg := <-defaultBoomer.slaveRunner.stats.requestSuccessChan
-	if requestSuccessMsg.requestType != "http" {
-		t.Error("Expected: http, got:", requestSuccessMsg.requestType)
+	stats := defaultBoomer.slaveRunner.stats
+	stats.mergeShards()
+	entry := stats.get("foo", "http")
+	if entry.NumRequests != int64(1) {
+		t.Error("Expected: 1, got:", entry.NumRequests)
 	}
-	if requestSuccessMsg.responseTime != int64(1) {
-		t.Error("Expected: 1, got:", requestSuccessMsg.responseTime)
+	if entry.TotalResponseTime != int64(1) {
+		t.Error("Expected: 1, got:", entry.TotalResponseTime)
 	}
 	defaultBoomer = nil
 }
@@ -336,15 +413,60 @@ func TestRecordFailure(t *testing.T) {
 	defaultBoomer.slaveRunner = newSlaveRunner(masterHost, masterPort, nil, nil)
 	RecordFailure("udp", "bar", int64(2), "udp error")
 
-	requestFailureMsg := <-defaultBoomer.slaveRunner.stats.requestFailureChan
-	if requestFailureMsg.requestType != "udp" {
-		t.Error("Expected: udp, got:", requestFailureMsg.requestType)
+	stats := defaultBoomer.slaveRunner.stats
+	stats.mergeShards()
+	entry := stats.get("bar", "udp")
+	if entry.NumFailures != int64(1) {
+		t.Error("Expected: 1, got:", entry.NumFailures)
 	}
-	if requestFailureMsg.responseTime != int64(2) {
-		t.Error("Expected: 2, got:", requestFailureMsg.responseTime)
+	if entry.TotalResponseTime != int64(2) {
+		t.Error("Expected: 2, got:", entry.TotalResponseTime)
 	}
-	if requestFailureMsg.error != "udp error" {
-		t.Error("Expected: udp error, got:", requestFailureMsg.error)
+	if err := stats.getError("udp", "bar", "udp error"); err.occurrences != int64(1) {
+		t.Error("Expected: 1, got:", err.occurrences)
 	}
 	defaultBoomer = nil
 }
+
+func TestEnableSampleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boomer-samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.bin")
+
+	b := NewStandaloneBoomer(2, 100)
+	b.SetIterationLimit(20)
+	if err := b.EnableSampleLog(path, samples.FormatBinary, 1); err != nil {
+		t.Fatal(err)
+	}
+	b.AddOutput(NewCompactConsoleOutput())
+	task := &Task{
+		Name: "sample",
+		FnCtx: func(ctx context.Context) {
+			b.RecordSuccessContext(ctx, "http", "foo", 1500*time.Microsecond, 10)
+			b.RecordFailure("http", "bar", 2, "error")
+		},
+	}
+	b.Run(task)
+
+	a, err := samples.Aggregate(path, func(s *samples.Sample) bool {
+		if s.Name == "foo" && s.UserID != 1 && s.UserID != 2 {
+			t.Error("UserID is wrong, expected: 1 or 2, got:", s.UserID)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Total.NumRequests != 40 || a.Total.NumFailures != 20 {
+		t.Error("Requests or failures are wrong, got:", a.Total.NumRequests, a.Total.NumFailures)
+	}
+	if a.Entries["foohttp"].MaxResponseTime != 1 {
+		t.Error("MaxResponseTime of foo is wrong, expected: 1, got:", a.Entries["foohttp"].MaxResponseTime)
+	}
+	if a.Entries["barhttp"].MaxResponseTime != 2 {
+		t.Error("MaxResponseTime of bar is wrong, expected: 2, got:", a.Entries["barhttp"].MaxResponseTime)
+	}
+}
@@ -2,6 +2,7 @@ package boomer
 
 type client interface {
 	connect() (err error)
+	reconnect() (err error)
 	close()
 	recvChannel() chan message
 	sendChannel() chan message
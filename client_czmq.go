@@ -56,6 +56,12 @@ func (c *czmqSocketClient) connect() (err error) {
 	return nil
 }
 
+// reconnect is a noop, because libzmq reconnects the dealer socket automatically.
+// Runner will register itself to master again after reconnecting.
+func (c *czmqSocketClient) reconnect() (err error) {
+	return nil
+}
+
 func (c *czmqSocketClient) close() {
 	close(c.shutdownChan)
 	if c.dealerSocket != nil {
@@ -16,6 +16,8 @@ type gomqSocketClient struct {
 	identity   string
 
 	dealerSocket gomq.Dealer
+	// closed when dealerSocket is closed by reconnect, so recv and send of the old connection will exit.
+	connectionClosedChan chan bool
 
 	fromMaster             chan message
 	toMaster               chan message
@@ -46,12 +48,26 @@ func (c *gomqSocketClient) connect() (err error) {
 	}
 
 	log.Printf("Boomer is connected to master(%s) press Ctrl+c to quit.\n", addr)
-	go c.recv()
-	go c.send()
+	c.connectionClosedChan = make(chan bool)
+	go c.recv(c.dealerSocket, c.connectionClosedChan)
+	go c.send(c.dealerSocket, c.connectionClosedChan)
 
 	return nil
 }
 
+// reconnect closes the current connection and connects to master again.
+// Messages in fromMaster and toMaster are kept.
+func (c *gomqSocketClient) reconnect() (err error) {
+	if c.connectionClosedChan != nil {
+		close(c.connectionClosedChan)
+		c.connectionClosedChan = nil
+	}
+	if c.dealerSocket != nil {
+		c.dealerSocket.Close()
+	}
+	return c.connect()
+}
+
 func (c *gomqSocketClient) close() {
 	close(c.shutdownChan)
 	if c.dealerSocket != nil {
@@ -63,12 +79,14 @@ func (c *gomqSocketClient) recvChannel() chan message {
 	return c.fromMaster
 }
 
-func (c *gomqSocketClient) recv() {
+func (c *gomqSocketClient) recv(dealerSocket gomq.Dealer, connectionClosedChan chan bool) {
 	for {
 		select {
 		case <-c.shutdownChan:
 			return
-		case msg := <-c.dealerSocket.RecvChannel():
+		case <-connectionClosedChan:
+			return
+		case msg := <-dealerSocket.RecvChannel():
 			if msg.MessageType == zmtp.CommandMessage {
 				continue
 			}
@@ -110,13 +128,15 @@ func (c *gomqSocketClient) sendChannel() chan message {
 	return c.toMaster
 }
 
-func (c *gomqSocketClient) send() {
+func (c *gomqSocketClient) send(dealerSocket gomq.Dealer, connectionClosedChan chan bool) {
 	for {
 		select {
 		case <-c.shutdownChan:
 			return
+		case <-connectionClosedChan:
+			return
 		case msg := <-c.toMaster:
-			c.sendMessage(msg)
+			c.sendMessage(dealerSocket, msg)
 
 			// If we send a genericMessage and the message type is quit, we need to disconnect.
 			m, ok := msg.(*genericMessage)
@@ -129,13 +149,13 @@ func (c *gomqSocketClient) send() {
 	}
 }
 
-func (c *gomqSocketClient) sendMessage(msg message) {
+func (c *gomqSocketClient) sendMessage(dealerSocket gomq.Dealer, msg message) {
 	serializedMessage, err := msg.serialize()
 	if err != nil {
 		log.Printf("Msgpack encode fail: %v\n", err)
 		return
 	}
-	err = c.dealerSocket.Send(serializedMessage)
+	err = dealerSocket.Send(serializedMessage)
 	if err != nil {
 		log.Printf("Error sending: %v\n", err)
 	}
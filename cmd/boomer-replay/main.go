@@ -0,0 +1,105 @@
+// Command boomer-replay re-renders the result files of JsonFileOutput, and compares two runs.
+//
+//	boomer-replay render -realtime realtime.json -total total.json -console -csv result -html report.html
+//	boomer-replay compare -latency 0.1 base_total.json head_total.json
+//
+// compare exits with code 1 if any request regressed beyond the tolerance.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/myzhan/boomer"
+	"github.com/myzhan/boomer/replay"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "render":
+		render(os.Args[2:])
+	case "compare":
+		compare(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: boomer-replay render|compare [flags]")
+	os.Exit(2)
+}
+
+func render(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	realTimePath := flags.String("realtime", "", "File of OutputOptions.RealTimeResultPath.")
+	totalPath := flags.String("total", "", "File of OutputOptions.TotalResultPath, it's only used if -realtime is empty.")
+	percentTime := flags.Int("percent", 90, "OutputOptions.PercentTime of the test.")
+	console := flags.Bool("console", false, "Print the results to the console.")
+	csvPrefix := flags.String("csv", "", "Write locust compatible csv files with the prefix.")
+	htmlPath := flags.String("html", "", "Write an HTML report to the path.")
+	markdownPath := flags.String("markdown", "", "Write a Markdown summary to the path.")
+	flags.Parse(args)
+
+	if *realTimePath == "" && *totalPath == "" {
+		log.Fatalln("Either -realtime or -total is required.")
+	}
+	run, err := replay.Load(*realTimePath, *totalPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	run.PercentTime = *percentTime
+
+	var outputs []boomer.Output
+	if *console {
+		outputs = append(outputs, boomer.NewConsoleOutputWithOptions(&boomer.OutputOptions{PercentTime: *percentTime}))
+	}
+	if *csvPrefix != "" {
+		outputs = append(outputs, boomer.NewCsvOutput(*csvPrefix))
+	}
+	if *htmlPath != "" || *markdownPath != "" {
+		outputs = append(outputs, boomer.NewReportOutput(*htmlPath, *markdownPath))
+	}
+	if len(outputs) == 0 {
+		log.Fatalln("No output, use -console, -csv, -html or -markdown.")
+	}
+	if err := replay.Replay(run, outputs...); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func compare(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	tolerance := replay.Tolerance{}
+	flags.Float64Var(&tolerance.Latency, "latency", 0.1, "Tolerated increase of response times, 0.1 for 10%.")
+	flags.Float64Var(&tolerance.RPS, "rps", 0.1, "Tolerated decrease of requests per second, 0.1 for 10%.")
+	flags.Float64Var(&tolerance.FailRatio, "fail-ratio", 0.01, "Tolerated increase of the fail ratio, 0.01 for 1 percentage point.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: boomer-replay compare [flags] base_total.json head_total.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	base, err := replay.LoadTotal(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	head, err := replay.LoadTotal(flags.Arg(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	comparison := replay.Compare(base, head, tolerance)
+	comparison.Print(os.Stdout)
+	if comparison.Regressed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,243 @@
+package boomer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvPercentiles are the percentiles in locust's csv files.
+var csvPercentiles = []float64{50, 66, 75, 80, 90, 95, 98, 99, 99.9, 99.99, 100}
+
+var csvPercentileHeaders = []string{"50%", "66%", "75%", "80%", "90%", "95%", "98%", "99%", "99.9%", "99.99%", "100%"}
+
+var csvStatsHeaders = append([]string{
+	"Type", "Name", "Request Count", "Failure Count", "Median Response Time", "Average Response Time",
+	"Min Response Time", "Max Response Time", "Average Content Size", "Requests/s", "Failures/s",
+}, csvPercentileHeaders...)
+
+var csvStatsHistoryHeaders = append(append([]string{
+	"Timestamp", "User Count", "Type", "Name", "Requests/s", "Failures/s",
+}, csvPercentileHeaders...),
+	"Total Request Count", "Total Failure Count", "Total Median Response Time", "Total Average Response Time",
+	"Total Min Response Time", "Total Max Response Time", "Total Average Content Size",
+)
+
+var csvFailuresHeaders = []string{"Method", "Name", "Error", "Occurrences"}
+
+// CsvOutput writes the same csv files as locust --csv=prefix, so existing tools of locust's csv files can
+// be used with boomer.
+//
+// prefix_stats.csv and prefix_failures.csv have the stats since the start of the test, from stats_cumulative
+// of the report, and are rewritten on every report. prefix_stats_history.csv has a row of all the requests on every report,
+// the percentiles and RPS in it are of the report interval.
+type CsvOutput struct {
+	prefix string
+	// If FullHistory is true, prefix_stats_history.csv has a row of every request too, like locust --csv-full-history.
+	FullHistory bool
+
+	lock          sync.Mutex
+	historyFile   *os.File
+	historyWriter *csv.Writer
+	// stats since the start, from stats_cumulative of the data
+	stats *statsAggregator
+}
+
+// NewCsvOutput returns a CsvOutput, which writes prefix_stats.csv, prefix_stats_history.csv and prefix_failures.csv.
+func NewCsvOutput(prefix string) *CsvOutput {
+	return &CsvOutput{
+		prefix: prefix,
+		stats:  newStatsAggregator(),
+	}
+}
+
+// OnStart creates the files and writes the header of prefix_stats_history.csv.
+func (o *CsvOutput) OnStart() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	file, err := os.Create(o.prefix + "_stats_history.csv")
+	if err != nil {
+		log.Printf("Failed to create the csv file of stats history, %v\n", err)
+		return
+	}
+	o.historyFile = file
+	o.historyWriter = csv.NewWriter(file)
+	o.writeHistoryRow(csvStatsHistoryHeaders)
+	o.writeStats()
+}
+
+// OnEvent aggregates data, rewrites prefix_stats.csv and prefix_failures.csv, and appends to prefix_stats_history.csv.
+func (o *CsvOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+	output.Stats = sortOutput(output.Stats)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	allStats := o.stats.cumulative(output, defaultPercentTime)
+	o.writeStats()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	userCount := strconv.FormatInt(int64(output.UserCount), 10)
+	if o.FullHistory {
+		totals := make(map[string]*statsEntry, len(allStats.Stats))
+		for _, stat := range allStats.Stats {
+			totals[stat.Name+stat.Method] = &stat.statsEntry
+		}
+		for _, stat := range output.Stats {
+			total, ok := totals[stat.Name+stat.Method]
+			if !ok {
+				total = newAggregatedEntry(stat.Name, stat.Method)
+			}
+			o.writeHistoryRow(csvHistoryRow(timestamp, userCount, stat, total))
+		}
+	}
+	if output.TotalStats != nil {
+		current := *output.TotalStats
+		current.Method, current.Name = "", "Aggregated"
+		o.writeHistoryRow(csvHistoryRow(timestamp, userCount, &current, &allStats.TotalStats.statsEntry))
+	}
+	if o.historyWriter != nil {
+		o.historyWriter.Flush()
+	}
+}
+
+// OnStop writes prefix_stats.csv and prefix_failures.csv for the last time, and closes prefix_stats_history.csv.
+func (o *CsvOutput) OnStop() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.writeStats()
+	if o.historyFile != nil {
+		o.historyWriter.Flush()
+		o.historyFile.Close()
+		o.historyFile = nil
+		o.historyWriter = nil
+	}
+}
+
+func (o *CsvOutput) writeHistoryRow(row []string) {
+	if o.historyWriter == nil {
+		return
+	}
+	if err := o.historyWriter.Write(row); err != nil {
+		log.Printf("Failed to write the csv file of stats history, %v\n", err)
+	}
+}
+
+// writeStats rewrites prefix_stats.csv and prefix_failures.csv.
+func (o *CsvOutput) writeStats() {
+	rows := [][]string{csvStatsHeaders}
+	var errors []*statsError
+	if allStats := o.stats.last; allStats != nil {
+		for _, stat := range allStats.Stats {
+			rows = append(rows, csvStatsRow(&stat.statsEntry))
+		}
+		total := allStats.TotalStats.statsEntry
+		total.Method, total.Name = "", "Aggregated"
+		rows = append(rows, csvStatsRow(&total))
+		errors = sortErrors(allStats.Errors)
+	} else {
+		rows = append(rows, csvStatsRow(newAggregatedEntry("Aggregated", "")))
+	}
+	writeCsvFile(o.prefix+"_stats.csv", rows)
+
+	rows = [][]string{csvFailuresHeaders}
+	for _, e := range errors {
+		rows = append(rows, []string{e.method, e.name, e.error, strconv.FormatInt(e.occurrences, 10)})
+	}
+	writeCsvFile(o.prefix+"_failures.csv", rows)
+}
+
+func writeCsvFile(path string, rows [][]string) {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to create the csv file %s, %v\n", path, err)
+		return
+	}
+	defer file.Close()
+	if err := csv.NewWriter(file).WriteAll(rows); err != nil {
+		log.Printf("Failed to write the csv file %s, %v\n", path, err)
+	}
+}
+
+// csvStatsRow returns a row of prefix_stats.csv of entry, which is aggregated since the start.
+func csvStatsRow(entry *statsEntry) []string {
+	// like locust, RPS is calculated between the first and the last request
+	duration := float64(entry.LastRequestTimestamp - entry.StartTime)
+	if duration < 1 {
+		duration = 1
+	}
+	row := []string{
+		entry.Method,
+		entry.Name,
+		strconv.FormatInt(entry.NumRequests, 10),
+		strconv.FormatInt(entry.NumFailures, 10),
+		csvMedian(entry),
+		formatCsvFloat(getAvgResponseTime(entry.NumRequests, entry.TotalResponseTime)),
+		csvMinResponseTime(entry),
+		strconv.FormatInt(entry.MaxResponseTime, 10),
+		strconv.FormatInt(getAvgContentLength(entry.NumRequests, entry.TotalContentLength), 10),
+		formatCsvFloat(float64(entry.NumRequests) / duration),
+		formatCsvFloat(float64(entry.NumFailures) / duration),
+	}
+	return append(row, csvPercentileColumns(entry)...)
+}
+
+// csvHistoryRow returns a row of prefix_stats_history.csv, current is the stats of the report interval,
+// and total is aggregated since the start.
+func csvHistoryRow(timestamp, userCount string, current *statsEntryOutput, total *statsEntry) []string {
+	row := []string{
+		timestamp,
+		userCount,
+		current.Method,
+		current.Name,
+		strconv.FormatInt(current.CurrentRps, 10),
+		strconv.FormatInt(current.CurrentFailPerSec, 10),
+	}
+	row = append(row, csvPercentileColumns(&current.statsEntry)...)
+	return append(row,
+		strconv.FormatInt(total.NumRequests, 10),
+		strconv.FormatInt(total.NumFailures, 10),
+		csvMedian(total),
+		formatCsvFloat(getAvgResponseTime(total.NumRequests, total.TotalResponseTime)),
+		csvMinResponseTime(total),
+		strconv.FormatInt(total.MaxResponseTime, 10),
+		strconv.FormatInt(getAvgContentLength(total.NumRequests, total.TotalContentLength), 10),
+	)
+}
+
+// csvPercentileColumns returns N/A for every percentile if there are no requests, like locust.
+func csvPercentileColumns(entry *statsEntry) []string {
+	columns := make([]string, 0, len(csvPercentiles))
+	for _, percentile := range csvPercentiles {
+		if entry.NumRequests == 0 {
+			columns = append(columns, "N/A")
+			continue
+		}
+		columns = append(columns, strconv.FormatInt(int64(percentileOf(entry, percentile)+0.5), 10))
+	}
+	return columns
+}
+
+func csvMedian(entry *statsEntry) string {
+	return strconv.FormatInt(getMedianResponseTime(entry.NumRequests, entry.ResponseTimes), 10)
+}
+
+// csvMinResponseTime returns 0 if there are no requests, the min response time of an empty entry is meaningless.
+func csvMinResponseTime(entry *statsEntry) string {
+	if entry.NumRequests == 0 {
+		return "0"
+	}
+	return strconv.FormatInt(entry.MinResponseTime, 10)
+}
+
+func formatCsvFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
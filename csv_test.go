@@ -0,0 +1,68 @@
+package boomer
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readCsvFile(t *testing.T, path string) [][]string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestCsvOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boomer-csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "test")
+
+	o := NewCsvOutput(prefix)
+	o.FullHistory = true
+	o.OnStart()
+	stats := newRequestStats()
+	o.OnEvent(collectTestReportData(stats))
+	o.OnEvent(collectTestReportData(stats))
+	o.OnStop()
+
+	rows := readCsvFile(t, prefix+"_stats.csv")
+	assert.Equal(t, csvStatsHeaders, rows[0])
+	assert.Len(t, rows, 4)
+	assert.Equal(t, []string{"http", "home", "2", "2", "30", "30", "30", "30", "500"}, rows[1][:9])
+	assert.Equal(t, []string{"http", "login", "4", "0", "10", "105", "10", "200", "100"}, rows[2][:9])
+	assert.Equal(t, []string{"", "Aggregated", "6", "2"}, rows[3][:4])
+	assert.Equal(t, "200", rows[3][len(rows[3])-1])
+
+	history := readCsvFile(t, prefix+"_stats_history.csv")
+	assert.Equal(t, csvStatsHistoryHeaders, history[0])
+	// home, login and aggregated of two reports
+	assert.Len(t, history, 7)
+	assert.Equal(t, []string{"5", "", "Aggregated"}, history[3][1:4])
+	assert.Equal(t, "3", history[3][len(csvPercentileHeaders)+6])
+	assert.Equal(t, "6", history[6][len(csvPercentileHeaders)+6])
+
+	failures := readCsvFile(t, prefix+"_failures.csv")
+	assert.Equal(t, [][]string{csvFailuresHeaders, {"http", "home", "timeout|500", "2"}}, failures)
+}
+
+func TestCsvPercentileColumnsWithoutRequests(t *testing.T) {
+	entry := newAggregatedEntry("empty", "http")
+	columns := csvPercentileColumns(entry)
+	assert.Len(t, columns, len(csvPercentileHeaders))
+	assert.Equal(t, "N/A", columns[0])
+	assert.Equal(t, "0", csvMinResponseTime(entry))
+}
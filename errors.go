@@ -0,0 +1,104 @@
+package boomer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// otherErrors is the error of failures, which are counted together after the number of distinct errors
+// reaches the limit, see Boomer.SetMaxErrorKeys.
+const otherErrors = "other"
+
+// ErrorNormalizer rewrites the message of a failure, so failures of the same cause are counted as one error,
+// even if their messages have request IDs, timestamps or addresses. err is the recorded error, and message is
+// its message rewritten by the previous normalizers. Failures recorded by RecordFailure are errors of
+// the exception string.
+type ErrorNormalizer func(err error, message string) string
+
+// recordedError is the error of a failure recorded with an exception string, instead of RecordError.
+type recordedError string
+
+func (e recordedError) Error() string {
+	return string(e)
+}
+
+// RegexpErrorNormalizer returns an ErrorNormalizer, which replaces matches of pattern in the message
+// with replacement, like regexp.Regexp.ReplaceAllString.
+func RegexpErrorNormalizer(pattern *regexp.Regexp, replacement string) ErrorNormalizer {
+	return func(err error, message string) string {
+		return pattern.ReplaceAllString(message, replacement)
+	}
+}
+
+var (
+	uuidPattern   = regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`)
+	timePattern   = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+	ipPattern     = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}(:\d+)?\b`)
+	hexPattern    = regexp.MustCompile(`\b(0x)?[0-9a-fA-F]{6,}\b`)
+	numberPattern = regexp.MustCompile(`\d{4,}`)
+)
+
+// IDErrorNormalizer replaces UUIDs, timestamps, IP addresses, hex strings of digits and letters and numbers of
+// more than 3 digits in the message, so "request 3f2a9c1d failed" becomes "request <hex> failed".
+// Short numbers like HTTP status codes, and words like "deadbeef" are kept.
+func IDErrorNormalizer(err error, message string) string {
+	message = uuidPattern.ReplaceAllString(message, "<uuid>")
+	message = timePattern.ReplaceAllString(message, "<time>")
+	message = ipPattern.ReplaceAllString(message, "<ip>")
+	message = hexPattern.ReplaceAllStringFunc(message, func(s string) string {
+		if strings.IndexAny(s, "0123456789") < 0 || strings.IndexAny(s, "abcdefABCDEF") < 0 {
+			return s
+		}
+		return "<hex>"
+	})
+	return numberPattern.ReplaceAllString(message, "<n>")
+}
+
+// ErrorTypeNormalizer replaces the message with the type of the innermost wrapped error, like *net.DNSError.
+// The message of the innermost error is used instead, if it's a syscall.Errno, or a plain error like io.EOF.
+// Failures recorded by RecordFailure are kept, because they don't have a type.
+func ErrorTypeNormalizer(err error, message string) string {
+	if _, ok := err.(recordedError); ok || err == nil {
+		return message
+	}
+	for next := errors.Unwrap(err); next != nil; next = errors.Unwrap(err) {
+		err = next
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return fmt.Sprintf("%T: %s", errno, errno.Error())
+	}
+	typeName := fmt.Sprintf("%T", err)
+	if typeName == "*errors.errorString" {
+		return err.Error()
+	}
+	return typeName
+}
+
+var httpStatusPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\s*([1-5])\d\d\b`),
+	regexp.MustCompile(`(?i)\b(?:status(?:\s*code)?|http(?:/[\d.]+)?)\s*[:=]?\s*([1-5])\d\d\b`),
+}
+
+// HTTPStatusClassNormalizer replaces the message with the class of the HTTP status code in it, like "HTTP 5xx".
+// The status code is recognized at the start of the message, or after "status", "status code" or "HTTP",
+// like "503 Service Unavailable" and "unexpected status code: 503". Other messages are kept.
+func HTTPStatusClassNormalizer(err error, message string) string {
+	for _, p := range httpStatusPatterns {
+		if match := p.FindStringSubmatch(message); match != nil {
+			return fmt.Sprintf("HTTP %sxx", match[1])
+		}
+	}
+	return message
+}
+
+// normalizeError returns the message of err rewritten by normalizers in order.
+func normalizeError(normalizers []ErrorNormalizer, err error) string {
+	message := err.Error()
+	for _, normalize := range normalizers {
+		message = normalize(err, message)
+	}
+	return message
+}
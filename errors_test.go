@@ -0,0 +1,110 @@
+package boomer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDErrorNormalizer(t *testing.T) {
+	cases := map[string]string{
+		"request 3f2a9c1d failed":                             "request <hex> failed",
+		"user 123e4567-e89b-12d3-a456-426614174000 not found": "user <uuid> not found",
+		"dial tcp 10.0.0.1:8080: connection refused":          "dial tcp <ip>: connection refused",
+		"expired at 2024-01-02T03:04:05.123Z, order 1234567":  "expired at <time>, order <n>",
+		"500 internal server error":                           "500 internal server error",
+		"deadbeef is a word, so is facade":                    "deadbeef is a word, so is facade",
+		"trace 0xdeadbeef":                                    "trace <hex>",
+	}
+	for message, expected := range cases {
+		assert.Equal(t, expected, IDErrorNormalizer(recordedError(message), message))
+	}
+}
+
+func TestErrorTypeNormalizer(t *testing.T) {
+	dnsErr := fmt.Errorf("get user 42: %w", &net.DNSError{Err: "no such host", Name: "example"})
+	assert.Equal(t, "*net.DNSError", ErrorTypeNormalizer(dnsErr, dnsErr.Error()))
+
+	eof := fmt.Errorf("read body of 42: %w", io.EOF)
+	assert.Equal(t, "EOF", ErrorTypeNormalizer(eof, eof.Error()))
+
+	addrErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{Err: "missing port in address"}}
+	assert.Equal(t, "*net.AddrError", ErrorTypeNormalizer(addrErr, addrErr.Error()))
+
+	errno := fmt.Errorf("dial 10.0.0.1: %w", syscall.ECONNREFUSED)
+	assert.Equal(t, "syscall.Errno: connection refused", ErrorTypeNormalizer(errno, errno.Error()))
+
+	// failures recorded with strings don't have types
+	assert.Equal(t, "timeout 42", ErrorTypeNormalizer(recordedError("timeout 42"), "timeout 42"))
+}
+
+func TestHTTPStatusClassNormalizer(t *testing.T) {
+	cases := map[string]string{
+		"503 Service Unavailable":                   "HTTP 5xx",
+		"unexpected status code: 404 for /users/42": "HTTP 4xx",
+		"HTTP/1.1 502 Bad Gateway":                  "HTTP 5xx",
+		"status=429":                                "HTTP 4xx",
+		"timeout after 500ms":                       "timeout after 500ms",
+		"connection reset by peer":                  "connection reset by peer",
+	}
+	for message, expected := range cases {
+		assert.Equal(t, expected, HTTPStatusClassNormalizer(recordedError(message), message))
+	}
+}
+
+func TestNormalizeError(t *testing.T) {
+	normalizers := []ErrorNormalizer{
+		RegexpErrorNormalizer(regexp.MustCompile(`user \w+`), "user <name>"),
+		IDErrorNormalizer,
+	}
+	assert.Equal(t, "user <name> failed, request <n>", normalizeError(normalizers, recordedError("user bob failed, request 123456")))
+	assert.Equal(t, "user bob", normalizeError(nil, recordedError("user bob")))
+}
+
+func TestRecordErrorNormalized(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.errorNormalizers = []ErrorNormalizer{IDErrorNormalizer}
+	newStats.errorExamples = 2
+	for _, id := range []string{"10001", "10002", "10003", "10001"} {
+		newStats.recordFailure("http", "order", 1, 0, "order "+id+" not found")
+	}
+	errors := newStats.collectReportData()["errors"].(map[string]map[string]interface{})
+	assert.Len(t, errors, 1)
+	for _, e := range errors {
+		assert.Equal(t, "order <n> not found", e["error"])
+		assert.Equal(t, int64(4), e["occurrences"])
+		assert.Equal(t, []string{"order 10001 not found", "order 10002 not found"}, e["examples"])
+	}
+}
+
+func TestMaxErrorKeys(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.maxErrorKeys = 2
+	newStats.errorExamples = 1
+	newStats.recordFailure("http", "order", 1, 0, "error 1")
+	newStats.recordFailure("http", "order", 1, 0, "error 2")
+	newStats.recordFailure("http", "order", 1, 0, "error 3")
+	newStats.collectReportData()
+
+	// the limit is of the whole test, not a report
+	newStats.recordFailure("http", "order", 1, 0, "error 1")
+	newStats.recordFailure("http", "order", 1, 0, "error 4")
+	newStats.recordFailure("http", "home", 1, 0, "error 5")
+	errors := newStats.collectReportData()["errors"].(map[string]map[string]interface{})
+	assert.Len(t, errors, 3)
+	assert.Equal(t, int64(1), errors[MD5("http", "order", "error 1")]["occurrences"])
+	other := errors[MD5("http", "order", otherErrors)]
+	assert.Equal(t, int64(1), other["occurrences"])
+	assert.Equal(t, []string{"error 4"}, other["examples"])
+	assert.Equal(t, otherErrors, errors[MD5("http", "home", otherErrors)]["error"])
+
+	newStats.clearAll()
+	newStats.recordFailure("http", "order", 1, 0, "error 4")
+	errors = newStats.collectReportData()["errors"].(map[string]map[string]interface{})
+	assert.Contains(t, errors, MD5("http", "order", "error 4"))
+}
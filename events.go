@@ -4,9 +4,13 @@ import "github.com/asaskevich/EventBus"
 
 const (
 	EVENT_CONNECTED = "boomer:connected"
-	EVENT_SPAWN     = "boomer:spawn"
-	EVENT_STOP      = "boomer:stop"
-	EVENT_QUIT      = "boomer:quit"
+	// EVENT_SPAWN is published with (users int, spawnRate float64) once when spawning starts.
+	EVENT_SPAWN = "boomer:spawn"
+	// EVENT_SPAWN_PROGRESS is published with (users int, spawnRate float64) every second with the running users
+	// while spawning at a spawn rate, and whenever a load shape starts or stops users.
+	EVENT_SPAWN_PROGRESS = "boomer:spawn_progress"
+	EVENT_STOP           = "boomer:stop"
+	EVENT_QUIT           = "boomer:quit"
 )
 
 // Events is the global event bus instance.
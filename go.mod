@@ -16,5 +16,7 @@ require (
 	github.com/stretchr/testify v1.8.2
 	github.com/ugorji/go/codec v1.2.6
 	github.com/zeromq/goczmq v0.0.0-20190906225145-a7546843a315
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	go.uber.org/ratelimit v0.2.0
 )
@@ -22,6 +22,10 @@ var memoryProfileFile string
 var memoryProfileDuration time.Duration
 var cpuProfileFile string
 var cpuProfileDuration time.Duration
+var drainTimeout time.Duration
+var runTime time.Duration
+var iterationLimit int64
+var exitOnThresholdsFailure bool
 
 var successRetiredWarning = &sync.Once{}
 var failureRetiredWarning = &sync.Once{}
@@ -177,4 +181,8 @@ func init() {
 	flag.DurationVar(&memoryProfileDuration, "mem-profile-duration", 30*time.Second, "Memory profile duration.")
 	flag.StringVar(&cpuProfileFile, "cpu-profile", "", "Enable CPU profiling.")
 	flag.DurationVar(&cpuProfileDuration, "cpu-profile-duration", 30*time.Second, "CPU profile duration.")
+	flag.DurationVar(&runTime, "run-time", 0, "Stop the test and quit after the specified time in standalone mode, disabled by default.")
+	flag.Int64Var(&iterationLimit, "iterations", 0, "Stop the test and quit after the specified number of iterations in standalone mode, disabled by default.")
+	flag.BoolVar(&exitOnThresholdsFailure, "exit-on-thresholds-failure", true, "Exit with code 1 if any threshold fails, use --exit-on-thresholds-failure=false to disable it.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", defaultDrainTimeout, "How long to wait for in-flight iterations to finish when boomer is stopped, 0 doesn't wait.")
 }
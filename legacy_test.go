@@ -23,10 +23,7 @@ func TestConvertResponseTime(t *testing.T) {
 }
 
 func TestInitEvents(t *testing.T) {
-	initLegacyEventHandlers()
-	defer Events.Unsubscribe("request_success", legacySuccessHandler)
-	defer Events.Unsubscribe("request_failure", legacyFailureHandler)
-
+	// legacy event handlers are subscribed by init()
 	masterHost := "127.0.0.1"
 	masterPort := 5557
 	defaultBoomer = NewBoomer(masterHost, masterPort)
@@ -35,22 +32,15 @@ func TestInitEvents(t *testing.T) {
 	Events.Publish("request_success", "http", "foo", int64(1), int64(10))
 	Events.Publish("request_failure", "udp", "bar", int64(2), "udp error")
 
-	requestSuccessMsg := <-defaultBoomer.slaveRunner.stats.requestSuccessChan
-	if requestSuccessMsg.requestType != "http" {
-		t.Error("Expected: http, got:", requestSuccessMsg.requestType)
-	}
-	if requestSuccessMsg.responseTime != int64(1) {
-		t.Error("Expected: 1, got:", requestSuccessMsg.responseTime)
-	}
-
-	requestFailureMsg := <-defaultBoomer.slaveRunner.stats.requestFailureChan
-	if requestFailureMsg.requestType != "udp" {
-		t.Error("Expected: udp, got:", requestFailureMsg.requestType)
+	stats := defaultBoomer.slaveRunner.stats
+	stats.mergeShards()
+	if entry := stats.get("foo", "http"); entry.NumRequests != int64(1) || entry.TotalResponseTime != int64(1) {
+		t.Error("Expected: 1 request of 1ms, got:", entry.NumRequests, entry.TotalResponseTime)
 	}
-	if requestFailureMsg.responseTime != int64(2) {
-		t.Error("Expected: 2, got:", requestFailureMsg.responseTime)
+	if entry := stats.get("bar", "udp"); entry.NumFailures != int64(1) || entry.TotalResponseTime != int64(2) {
+		t.Error("Expected: 1 failure of 2ms, got:", entry.NumFailures, entry.TotalResponseTime)
 	}
-	if requestFailureMsg.error != "udp error" {
-		t.Error("Expected: udp error, got:", requestFailureMsg.error)
+	if err := stats.getError("udp", "bar", "udp error"); err.occurrences != int64(1) {
+		t.Error("Expected: 1, got:", err.occurrences)
 	}
 }
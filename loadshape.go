@@ -0,0 +1,118 @@
+package boomer
+
+import (
+	"math"
+	"time"
+)
+
+// LoadShape controls the amount of users in standalone mode, like LoadTestShape in locust.
+type LoadShape interface {
+	// Tick is called every second with the time elapsed since the test started.
+	// It returns the target amount of users and how many users to start or stop per second,
+	// a spawnRate <= 0 means all at once. Returning false stops all the users.
+	Tick(runTime time.Duration) (userCount int, spawnRate float64, ok bool)
+}
+
+// Stage is a stage of StagesShape.
+type Stage struct {
+	// How long this stage lasts.
+	Duration  time.Duration
+	Users     int
+	SpawnRate float64
+}
+
+// StagesShape runs stages one by one, and stops after the last stage.
+type StagesShape struct {
+	Stages []Stage
+}
+
+// NewStagesShape returns a StagesShape, which is useful for ramp-hold-ramp profiles.
+func NewStagesShape(stages ...Stage) *StagesShape {
+	return &StagesShape{Stages: stages}
+}
+
+// Tick implements LoadShape.
+func (s *StagesShape) Tick(runTime time.Duration) (int, float64, bool) {
+	end := time.Duration(0)
+	for _, stage := range s.Stages {
+		end += stage.Duration
+		if runTime < end {
+			return stage.Users, stage.SpawnRate, true
+		}
+	}
+	return 0, 0, false
+}
+
+// StepShape adds StepUsers every StepDuration, until MaxUsers is reached.
+type StepShape struct {
+	StepUsers    int
+	StepDuration time.Duration
+	// MaxUsers <= 0 means no limit.
+	MaxUsers  int
+	SpawnRate float64
+	// TimeLimit <= 0 means running until boomer quits.
+	TimeLimit time.Duration
+}
+
+// Tick implements LoadShape.
+func (s *StepShape) Tick(runTime time.Duration) (int, float64, bool) {
+	if s.TimeLimit > 0 && runTime >= s.TimeLimit {
+		return 0, 0, false
+	}
+	step := 1
+	if s.StepDuration > 0 {
+		step = int(runTime/s.StepDuration) + 1
+	}
+	users := step * s.StepUsers
+	if s.MaxUsers > 0 && users > s.MaxUsers {
+		users = s.MaxUsers
+	}
+	return users, s.SpawnRate, true
+}
+
+// SpikeShape runs BaseUsers, and SpikeUsers instead from SpikeAt for SpikeDuration.
+type SpikeShape struct {
+	BaseUsers     int
+	SpikeUsers    int
+	SpikeAt       time.Duration
+	SpikeDuration time.Duration
+	SpawnRate     float64
+	// TimeLimit <= 0 means running until boomer quits.
+	TimeLimit time.Duration
+}
+
+// Tick implements LoadShape.
+func (s *SpikeShape) Tick(runTime time.Duration) (int, float64, bool) {
+	if s.TimeLimit > 0 && runTime >= s.TimeLimit {
+		return 0, 0, false
+	}
+	if runTime >= s.SpikeAt && runTime < s.SpikeAt+s.SpikeDuration {
+		return s.SpikeUsers, s.SpawnRate, true
+	}
+	return s.BaseUsers, s.SpawnRate, true
+}
+
+// SineShape changes the amount of users between MinUsers and MaxUsers like a sine wave,
+// it starts from the middle and reaches MaxUsers after a quarter of Period.
+type SineShape struct {
+	MinUsers  int
+	MaxUsers  int
+	Period    time.Duration
+	SpawnRate float64
+	// TimeLimit <= 0 means running until boomer quits.
+	TimeLimit time.Duration
+}
+
+// Tick implements LoadShape.
+func (s *SineShape) Tick(runTime time.Duration) (int, float64, bool) {
+	if s.TimeLimit > 0 && runTime >= s.TimeLimit {
+		return 0, 0, false
+	}
+	if s.Period <= 0 {
+		return s.MaxUsers, s.SpawnRate, true
+	}
+	amplitude := float64(s.MaxUsers-s.MinUsers) / 2
+	phase := 2 * math.Pi * float64(runTime) / float64(s.Period)
+	users := float64(s.MinUsers) + amplitude + amplitude*math.Sin(phase)
+	return int(math.Round(users)), s.SpawnRate, true
+}
@@ -0,0 +1,58 @@
+package boomer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertTick(t *testing.T, shape LoadShape, runTime time.Duration, expectedUsers int, expectedOk bool) {
+	t.Helper()
+	users, _, ok := shape.Tick(runTime)
+	assert.Equal(t, expectedOk, ok, "runTime: %v", runTime)
+	if ok {
+		assert.Equal(t, expectedUsers, users, "runTime: %v", runTime)
+	}
+}
+
+func TestStagesShape(t *testing.T) {
+	shape := NewStagesShape(
+		Stage{Duration: 10 * time.Second, Users: 10, SpawnRate: 1},
+		Stage{Duration: 20 * time.Second, Users: 50, SpawnRate: 5},
+		Stage{Duration: 10 * time.Second, Users: 0, SpawnRate: 10},
+	)
+	assertTick(t, shape, 0, 10, true)
+	assertTick(t, shape, 10*time.Second, 50, true)
+	assertTick(t, shape, 29*time.Second, 50, true)
+	assertTick(t, shape, 35*time.Second, 0, true)
+	assertTick(t, shape, 40*time.Second, 0, false)
+
+	_, spawnRate, _ := shape.Tick(15 * time.Second)
+	assert.Equal(t, float64(5), spawnRate)
+}
+
+func TestStepShape(t *testing.T) {
+	shape := &StepShape{StepUsers: 10, StepDuration: 10 * time.Second, MaxUsers: 25, TimeLimit: time.Minute}
+	assertTick(t, shape, 0, 10, true)
+	assertTick(t, shape, 10*time.Second, 20, true)
+	assertTick(t, shape, 30*time.Second, 25, true)
+	assertTick(t, shape, time.Minute, 0, false)
+}
+
+func TestSpikeShape(t *testing.T) {
+	shape := &SpikeShape{BaseUsers: 5, SpikeUsers: 100, SpikeAt: 10 * time.Second, SpikeDuration: 5 * time.Second}
+	assertTick(t, shape, 0, 5, true)
+	assertTick(t, shape, 10*time.Second, 100, true)
+	assertTick(t, shape, 15*time.Second, 5, true)
+	assertTick(t, shape, time.Hour, 5, true)
+}
+
+func TestSineShape(t *testing.T) {
+	shape := &SineShape{MinUsers: 10, MaxUsers: 30, Period: 40 * time.Second, TimeLimit: time.Minute}
+	assertTick(t, shape, 0, 20, true)
+	assertTick(t, shape, 10*time.Second, 30, true)
+	assertTick(t, shape, 20*time.Second, 20, true)
+	assertTick(t, shape, 30*time.Second, 10, true)
+	assertTick(t, shape, time.Minute, 0, false)
+}
@@ -0,0 +1,634 @@
+package boomer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhan/gomq/zmtp"
+)
+
+const (
+	// same as HEARTBEAT_LIVENESS * HEARTBEAT_INTERVAL in locust
+	workerHeartbeatTimeout = 3 * heartbeatInterval
+
+	// used by Master.Spawn if no user class is specified.
+	defaultUserClassName = "User"
+)
+
+// workerNode is a boomer worker connected to Master.
+type workerNode struct {
+	id            string
+	index         int
+	state         string
+	userCount     int64
+	cpuUsage      float64
+	lastHeartbeat time.Time
+
+	netConn  net.Conn
+	zmtpConn *zmtp.Connection
+	sendLock sync.Mutex
+}
+
+func (w *workerNode) send(msg message) {
+	serializedMessage, err := msg.serialize()
+	if err != nil {
+		log.Printf("Msgpack encode fail: %v\n", err)
+		return
+	}
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	if err = w.zmtpConn.SendFrame(serializedMessage); err != nil {
+		log.Printf("Error sending to worker(%s): %v\n", w.id, err)
+	}
+}
+
+// workerMessage is a message received from a worker connection.
+// msg is nil if the connection is closed.
+type workerMessage struct {
+	netConn  net.Conn
+	zmtpConn *zmtp.Connection
+	msg      *CustomMessage
+}
+
+// Master is a native Go implementation of the locust master. It binds a ZeroMQ ROUTER socket
+// and speaks the same protocol as locust, so boomer workers can run without a python master.
+// Users are split across connected workers, and the stats reported by workers are aggregated
+// and passed to outputs like a standalone boomer.
+//
+// Master is kept in package boomer, because it decodes and merges the same messages and stats
+// entries as workers, and drives the same outputs, which aren't exported.
+type Master struct {
+	bindHost string
+	bindPort int
+	nodeID   string
+
+	listener net.Listener
+
+	workers     map[string]*workerNode
+	workerIndex int
+	workersLock sync.RWMutex
+
+	state            string
+	userClassesCount map[string]int64
+	spawnRate        float64
+
+	stats   *requestStats
+	outputs []Output
+
+	fromWorkers  chan *workerMessage
+	shutdownChan chan bool
+	doneChan     chan bool
+	shutdownOnce sync.Once
+}
+
+// NewMaster returns a new Master, which binds to bindHost:bindPort after calling Run.
+func NewMaster(bindHost string, bindPort int) *Master {
+	return &Master{
+		bindHost:     bindHost,
+		bindPort:     bindPort,
+		nodeID:       getNodeID(),
+		workers:      make(map[string]*workerNode),
+		state:        stateInit,
+		stats:        newRequestStats(),
+		fromWorkers:  make(chan *workerMessage, 100),
+		shutdownChan: make(chan bool),
+		doneChan:     make(chan bool),
+	}
+}
+
+// AddOutput accepts outputs which implements the boomer.Output interface.
+// The aggregated stats of all the workers are passed to outputs.
+func (m *Master) AddOutput(o Output) {
+	m.outputs = append(m.outputs, o)
+}
+
+// SetMaxErrorKeys limits the number of distinct errors of all the workers, like Boomer.SetMaxErrorKeys.
+// It must be called before Run.
+func (m *Master) SetMaxErrorKeys(n int) {
+	m.stats.maxErrorKeys = n
+}
+
+// SetErrorExamples keeps the first n distinct examples reported by workers for every error,
+// like Boomer.SetErrorExamples. It must be called before Run.
+func (m *Master) SetErrorExamples(n int) {
+	m.stats.errorExamples = n
+}
+
+// Run binds the ROUTER socket and starts to accept workers, it doesn't block.
+func (m *Master) Run() (err error) {
+	addr := fmt.Sprintf("%s:%d", m.bindHost, m.bindPort)
+	m.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Master is listening on tcp://%s\n", addr)
+
+	r := &runner{outputs: m.outputs}
+	r.outputOnStart()
+
+	go m.serve()
+	go m.loop()
+	return nil
+}
+
+// WorkerCount returns the number of connected workers.
+func (m *Master) WorkerCount() int {
+	m.workersLock.RLock()
+	defer m.workersLock.RUnlock()
+	return len(m.workers)
+}
+
+// UserCount returns the number of users reported by workers.
+func (m *Master) UserCount() int64 {
+	m.workersLock.RLock()
+	defer m.workersLock.RUnlock()
+	userCount := int64(0)
+	for _, w := range m.workers {
+		userCount += atomic.LoadInt64(&w.userCount)
+	}
+	return userCount
+}
+
+// Spawn asks workers to run userCount users in total, spawnRate users are added every second.
+// If spawnRate <= 0, all the users are spawned at once.
+func (m *Master) Spawn(userCount int, spawnRate float64) {
+	m.SpawnUserClasses(map[string]int64{defaultUserClassName: int64(userCount)}, spawnRate)
+}
+
+// SpawnUserClasses is like Spawn, but the amount of users of every user class is specified.
+// The stats aggregated since the previous spawn are cleared.
+func (m *Master) SpawnUserClasses(userClassesCount map[string]int64, spawnRate float64) {
+	m.workersLock.Lock()
+	m.state = stateSpawning
+	m.spawnRate = spawnRate
+	m.workersLock.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.clearAll()
+	m.stats.mu.Unlock()
+
+	m.sendSpawn(userClassesCount)
+}
+
+// sendSpawn splits the users across workers and sends spawn messages to them.
+// Every worker is sent the final amount of its users, and ramps them up by itself
+// with its share of the spawn rate, so running users are never restarted during a ramp up.
+func (m *Master) sendSpawn(userClassesCount map[string]int64) {
+	m.workersLock.Lock()
+	m.userClassesCount = userClassesCount
+	spawnRate := m.spawnRate
+	workers := m.sortedWorkers()
+	m.workersLock.Unlock()
+
+	if len(workers) == 0 {
+		log.Println("No worker is connected, users will be spawned when workers are ready.")
+		return
+	}
+
+	timestamp := time.Now().UnixNano()
+	for i, userClasses := range distributeUsers(userClassesCount, len(workers)) {
+		w := workers[i]
+		data := map[string]interface{}{
+			"timestamp":          timestamp,
+			"user_classes_count": userClasses,
+			"host":               "",
+		}
+		if spawnRate > 0 {
+			data["spawn_rate"] = spawnRate / float64(len(workers))
+		}
+		w.send(newGenericMessage("spawn", data, w.id))
+	}
+}
+
+// updateState marks the master as running once all the workers complete spawning.
+func (m *Master) updateState() {
+	m.workersLock.Lock()
+	defer m.workersLock.Unlock()
+	if m.state != stateSpawning {
+		return
+	}
+	for _, w := range m.workers {
+		if w.state != stateRunning {
+			return
+		}
+	}
+	m.state = stateRunning
+}
+
+// sortedWorkers returns workers sorted by the order they connected, workersLock must be held.
+func (m *Master) sortedWorkers() []*workerNode {
+	workers := make([]*workerNode, 0, len(m.workers))
+	for _, w := range m.workers {
+		workers = append(workers, w)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].index < workers[j].index
+	})
+	return workers
+}
+
+// distributeUsers splits the users of every class evenly across workerCount workers.
+// The remainders are given to the first workers, but are shifted between classes,
+// so one worker doesn't get all of them.
+func distributeUsers(userClassesCount map[string]int64, workerCount int) []map[string]int64 {
+	result := make([]map[string]int64, workerCount)
+	for i := range result {
+		result[i] = make(map[string]int64, len(userClassesCount))
+	}
+	if workerCount == 0 {
+		return result
+	}
+
+	classes := make([]string, 0, len(userClassesCount))
+	for class := range userClassesCount {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	offset := 0
+	for _, class := range classes {
+		n := userClassesCount[class]
+		base, remainder := n/int64(workerCount), int(n%int64(workerCount))
+		for i := 0; i < workerCount; i++ {
+			result[i][class] = base
+		}
+		for i := 0; i < remainder; i++ {
+			result[(offset+i)%workerCount][class]++
+		}
+		offset = (offset + remainder) % workerCount
+	}
+	return result
+}
+
+// Stop asks all the workers to stop running users.
+func (m *Master) Stop() {
+	m.workersLock.Lock()
+	m.state = stateStopped
+	m.userClassesCount = nil
+	workers := m.sortedWorkers()
+	m.workersLock.Unlock()
+
+	for _, w := range workers {
+		w.send(newGenericMessage("stop", nil, w.id))
+	}
+}
+
+// Quit asks all the workers to quit, and stops the master.
+func (m *Master) Quit() {
+	m.shutdownOnce.Do(func() {
+		m.workersLock.Lock()
+		m.state = stateQuitting
+		workers := m.sortedWorkers()
+		m.workersLock.Unlock()
+
+		for _, w := range workers {
+			w.send(newGenericMessage("quit", nil, w.id))
+		}
+
+		close(m.shutdownChan)
+		if m.listener != nil {
+			m.listener.Close()
+			<-m.doneChan
+		}
+
+		for _, w := range workers {
+			w.netConn.Close()
+		}
+	})
+}
+
+func (m *Master) serve() {
+	for {
+		netConn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.shutdownChan:
+				return
+			default:
+				log.Printf("Error accepting worker: %v\n", err)
+				continue
+			}
+		}
+		go m.handleConnection(netConn)
+	}
+}
+
+func (m *Master) handleConnection(netConn net.Conn) {
+	zmtpConn := zmtp.NewConnection(netConn)
+	_, err := zmtpConn.Prepare(zmtp.NewSecurityNull(), zmtp.RouterSocketType, zmtp.SocketIdentity(m.nodeID), true, nil)
+	if err != nil {
+		log.Printf("Error handshaking with %s: %v\n", netConn.RemoteAddr(), err)
+		netConn.Close()
+		return
+	}
+
+	recvChan := make(chan *zmtp.Message, 100)
+	zmtpConn.RecvMultipart(recvChan)
+	for {
+		select {
+		case <-m.shutdownChan:
+			return
+		case msg := <-recvChan:
+			if msg.MessageType == zmtp.CommandMessage {
+				continue
+			}
+			if msg.Err != nil || msg.MessageType == zmtp.ErrorMessage {
+				m.forward(&workerMessage{netConn: netConn, zmtpConn: zmtpConn})
+				return
+			}
+			if len(msg.Body) == 0 {
+				continue
+			}
+			// boomer and locust workers send all kinds of messages as [type, data, node_id],
+			// decoding data as interface{} works for all of them.
+			decoded, err := newCustomMessageFromBytes(msg.Body[0])
+			if err != nil {
+				log.Printf("Msgpack decode fail: %v\n", err)
+				continue
+			}
+			m.forward(&workerMessage{netConn: netConn, zmtpConn: zmtpConn, msg: decoded})
+		}
+	}
+}
+
+// forward passes wm to the main loop, unless the master is quitting.
+func (m *Master) forward(wm *workerMessage) {
+	select {
+	case m.fromWorkers <- wm:
+	case <-m.shutdownChan:
+	}
+}
+
+func (m *Master) loop() {
+	reportTicker := time.NewTicker(slaveReportInterval)
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer reportTicker.Stop()
+	defer heartbeatTicker.Stop()
+
+	r := &runner{outputs: m.outputs}
+	for {
+		select {
+		case wm := <-m.fromWorkers:
+			m.onWorkerMessage(wm)
+		case <-heartbeatTicker.C:
+			m.heartbeat()
+		case <-reportTicker.C:
+			r.outputOnEevent(m.collectReportData())
+		case <-m.shutdownChan:
+			r.outputOnEevent(m.collectReportData())
+			r.outputOnStop()
+			close(m.doneChan)
+			return
+		}
+	}
+}
+
+func (m *Master) collectReportData() map[string]interface{} {
+	data := m.stats.report()
+	data["user_count"] = int32(m.UserCount())
+	data["worker_count"] = m.WorkerCount()
+	return data
+}
+
+// heartbeat sends heartbeats to workers, and removes those which miss heartbeats.
+func (m *Master) heartbeat() {
+	m.workersLock.Lock()
+	missing := false
+	for id, w := range m.workers {
+		if time.Since(w.lastHeartbeat) > workerHeartbeatTimeout {
+			log.Printf("Worker(%s) failed to send heartbeat, removed.\n", id)
+			delete(m.workers, id)
+			w.netConn.Close()
+			missing = true
+		}
+	}
+	workers := m.sortedWorkers()
+	m.workersLock.Unlock()
+
+	for _, w := range workers {
+		w.send(newGenericMessage("heartbeat", nil, w.id))
+	}
+	if missing {
+		m.rebalance()
+	}
+}
+
+// rebalance splits users across workers again, after workers join or leave.
+func (m *Master) rebalance() {
+	m.workersLock.RLock()
+	userClassesCount := m.userClassesCount
+	running := m.state == stateSpawning || m.state == stateRunning
+	m.workersLock.RUnlock()
+	if running && userClassesCount != nil {
+		m.sendSpawn(userClassesCount)
+	}
+}
+
+func (m *Master) onWorkerMessage(wm *workerMessage) {
+	if wm.msg == nil {
+		m.onWorkerDisconnected(wm.netConn)
+		return
+	}
+
+	msg := wm.msg
+	if msg.Type == "client_ready" {
+		m.onClientReady(wm)
+		return
+	}
+
+	m.workersLock.RLock()
+	w, ok := m.workers[msg.NodeID]
+	m.workersLock.RUnlock()
+	if !ok {
+		// the worker was connected to a previous master or was removed, ask it to register again.
+		log.Printf("Recv a %s message from unknown worker(%s), ask it to reconnect.\n", msg.Type, msg.NodeID)
+		unknown := &workerNode{id: msg.NodeID, netConn: wm.netConn, zmtpConn: wm.zmtpConn}
+		unknown.send(newGenericMessage("reconnect", nil, msg.NodeID))
+		return
+	}
+
+	data, _ := normalizeMsgpack(msg.Data).(map[string]interface{})
+	w.lastHeartbeat = time.Now()
+	switch msg.Type {
+	case "heartbeat":
+		if state, ok := data["state"].(string); ok {
+			w.state = state
+		}
+		if cpuUsage, ok := data["current_cpu_usage"].(float64); ok {
+			w.cpuUsage = cpuUsage
+		}
+		if count, ok := castToInt64(data["count"]); ok {
+			atomic.StoreInt64(&w.userCount, count)
+		}
+	case "spawning":
+		w.state = stateSpawning
+	case "spawning_complete":
+		w.state = stateRunning
+		if count, ok := castToInt64(data["count"]); ok {
+			atomic.StoreInt64(&w.userCount, count)
+		}
+		m.updateState()
+	case "stats":
+		if userCount, ok := castToInt64(data["user_count"]); ok {
+			atomic.StoreInt64(&w.userCount, userCount)
+		}
+		if err := m.mergeWorkerStats(data); err != nil {
+			log.Printf("Failed to merge stats from worker(%s): %v\n", w.id, err)
+		}
+	case "client_stopped":
+		w.state = stateStopped
+		atomic.StoreInt64(&w.userCount, 0)
+	case "quit":
+		log.Printf("Worker(%s) quit.\n", w.id)
+		m.removeWorker(w.id)
+		m.rebalance()
+	case "exception":
+		log.Printf("Worker(%s) reported an exception: %v\n", w.id, data["msg"])
+	default:
+		Events.Publish(msg.Type, msg)
+	}
+}
+
+func (m *Master) onClientReady(wm *workerMessage) {
+	id := wm.msg.NodeID
+	m.workersLock.Lock()
+	m.workerIndex++
+	w := &workerNode{
+		id:            id,
+		index:         m.workerIndex,
+		state:         stateInit,
+		lastHeartbeat: time.Now(),
+		netConn:       wm.netConn,
+		zmtpConn:      wm.zmtpConn,
+	}
+	m.workers[id] = w
+	m.workersLock.Unlock()
+
+	log.Printf("Worker(%s) is ready, %d workers connected.\n", id, m.WorkerCount())
+	w.send(newGenericMessage("ack", map[string]interface{}{"index": w.index}, id))
+	m.rebalance()
+}
+
+func (m *Master) onWorkerDisconnected(netConn net.Conn) {
+	m.workersLock.RLock()
+	var id string
+	for _, w := range m.workers {
+		if w.netConn == netConn {
+			id = w.id
+		}
+	}
+	m.workersLock.RUnlock()
+	if id != "" {
+		log.Printf("Worker(%s) is disconnected.\n", id)
+		m.removeWorker(id)
+		m.rebalance()
+	}
+}
+
+func (m *Master) removeWorker(id string) {
+	m.workersLock.Lock()
+	delete(m.workers, id)
+	m.workersLock.Unlock()
+}
+
+// mergeWorkerStats merges the stats reported by a worker into the master's stats, like locust does.
+func (m *Master) mergeWorkerStats(data map[string]interface{}) error {
+	// stats are cleared by SpawnUserClasses out of the main loop
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+
+	stats, _ := data["stats"].([]interface{})
+	for _, stat := range stats {
+		entry, err := decodeStatsEntry(stat)
+		if err != nil {
+			return err
+		}
+		m.stats.get(entry.Name, entry.Method).extend(entry)
+	}
+
+	if total, ok := data["stats_total"]; ok {
+		entry, err := decodeStatsEntry(total)
+		if err != nil {
+			return err
+		}
+		m.stats.total.extend(entry)
+	}
+
+	if dropped, ok := castToInt64(data["dropped_iterations"]); ok {
+		atomic.AddInt64(&m.stats.droppedIterations, dropped)
+	}
+	if abandoned, ok := castToInt64(data["abandoned_iterations"]); ok {
+		m.stats.logAbandonedIterations(abandoned)
+	}
+
+	errors, _ := data["errors"].(map[string]interface{})
+	for _, value := range errors {
+		e, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		occurrences, _ := castToInt64(e["occurrences"])
+		name, _ := e["name"].(string)
+		method, _ := e["method"].(string)
+		err, _ := e["error"].(string)
+		entry := m.stats.getError(method, name, err)
+		entry.occurrences += occurrences
+		examples, _ := normalizeMsgpack(e["examples"]).([]interface{})
+		for _, example := range examples {
+			if example, ok := example.(string); ok {
+				entry.addExamples([]string{example}, m.stats.errorExamples)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeStatsEntry converts a serialized statsEntry, which is decoded by msgpack, to statsEntry.
+func decodeStatsEntry(stat interface{}) (*statsEntry, error) {
+	statBytes, err := json.Marshal(normalizeMsgpack(stat))
+	if err != nil {
+		return nil, err
+	}
+	entry := &statsEntry{}
+	if err = json.Unmarshal(statBytes, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// normalizeMsgpack converts values decoded by msgpack as interface{}, to types used by boomer.
+// Maps are converted to map[string]interface{}, raw bytes to string and unsigned integers to int64.
+func normalizeMsgpack(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m[fmt.Sprint(normalizeMsgpack(k))] = normalizeMsgpack(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m[k] = normalizeMsgpack(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			s = append(s, normalizeMsgpack(item))
+		}
+		return s
+	case []byte:
+		return string(value)
+	case uint64:
+		return int64(value)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,212 @@
+package boomer
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type captureOutput struct {
+	lock    sync.Mutex
+	events  []map[string]interface{}
+	stopped bool
+}
+
+func (o *captureOutput) OnStart() {}
+
+func (o *captureOutput) OnEvent(data map[string]interface{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, data)
+}
+
+func (o *captureOutput) OnStop() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.stopped = true
+}
+
+func (o *captureOutput) numRequests() (numRequests int64, userCount int32) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, data := range o.events {
+		total := data["stats_total"].(map[string]interface{})
+		numRequests += total["num_requests"].(int64)
+		if count := data["user_count"].(int32); count > userCount {
+			userCount = count
+		}
+	}
+	return numRequests, userCount
+}
+
+func TestDistributeUsers(t *testing.T) {
+	result := distributeUsers(map[string]int64{"A": 5, "B": 4}, 3)
+	if len(result) != 3 {
+		t.Fatal("len(result) is wrong, expected: 3, got:", len(result))
+	}
+
+	expected := []map[string]int64{
+		{"A": 2, "B": 1},
+		{"A": 2, "B": 1},
+		{"A": 1, "B": 2},
+	}
+	for i := range expected {
+		for class, n := range expected[i] {
+			if result[i][class] != n {
+				t.Error("Worker", i, "should run", n, class, "users, got:", result[i][class])
+			}
+		}
+	}
+
+	if len(distributeUsers(map[string]int64{"A": 5}, 0)) != 0 {
+		t.Error("No users should be distributed without workers")
+	}
+}
+
+func TestStatsEntryExtend(t *testing.T) {
+	first := newRequestStats()
+	first.recordSuccess("http", "foo", 20, 0, 10)
+	first.recordSuccess("http", "foo", 30, 0, 10)
+	second := newRequestStats()
+	second.recordSuccess("http", "foo", 5, 0, 10)
+	first.mergeShards()
+	second.mergeShards()
+
+	merged := newRequestStats()
+	merged.get("foo", "http").extend(first.get("foo", "http"))
+	merged.get("foo", "http").extend(second.get("foo", "http"))
+	entry := merged.get("foo", "http")
+
+	if entry.NumRequests != 3 {
+		t.Error("numRequests is wrong, expected: 3, got:", entry.NumRequests)
+	}
+	if entry.MinResponseTime != 5 {
+		t.Error("minResponseTime is wrong, expected: 5, got:", entry.MinResponseTime)
+	}
+	if entry.MaxResponseTime != 30 {
+		t.Error("maxResponseTime is wrong, expected: 30, got:", entry.MaxResponseTime)
+	}
+	if entry.TotalContentLength != 30 {
+		t.Error("totalContentLength is wrong, expected: 30, got:", entry.TotalContentLength)
+	}
+	if entry.ResponseTimes[20] != 1 || entry.ResponseTimes[5] != 1 {
+		t.Error("responseTimes is wrong, got:", entry.ResponseTimes)
+	}
+}
+
+func TestMasterWithWorker(t *testing.T) {
+	defaultReportInterval := slaveReportInterval
+	slaveReportInterval = 300 * time.Millisecond
+	defer func() {
+		slaveReportInterval = defaultReportInterval
+	}()
+
+	rand.Seed(Now())
+	port := rand.Intn(1000) + 11240
+	output := &captureOutput{}
+	master := NewMaster("127.0.0.1", port)
+	master.AddOutput(output)
+	if err := master.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer master.Quit()
+
+	b := NewBoomer("127.0.0.1", port)
+	b.SetIsOldSpawnWorker(true)
+	task := &Task{
+		Name: "foo",
+		Fn: func() {
+			b.RecordSuccess("http", "foo", 1, 10)
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+	b.Run(task)
+	defer b.Quit()
+
+	for i := 0; i < 20 && master.WorkerCount() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if master.WorkerCount() != 1 {
+		t.Fatal("WorkerCount is wrong, expected: 1, got:", master.WorkerCount())
+	}
+
+	master.Spawn(4, 0)
+	time.Sleep(time.Second)
+
+	if master.UserCount() != 4 {
+		t.Error("UserCount is wrong, expected: 4, got:", master.UserCount())
+	}
+	numRequests, userCount := output.numRequests()
+	if numRequests == 0 {
+		t.Error("Stats from the worker should be aggregated by master")
+	}
+	if userCount != 4 {
+		t.Error("user_count in output is wrong, expected: 4, got:", userCount)
+	}
+}
+
+func TestMasterSpawnClearsStats(t *testing.T) {
+	master := NewMaster("127.0.0.1", 0)
+	master.stats.recordSuccess("http", "foo", 20, 0, 10)
+	master.stats.mergeShards()
+	master.stats.total.NumRequests = 1
+
+	master.Spawn(4, 0)
+
+	if len(master.stats.entries) != 0 {
+		t.Error("Entries should be cleared on spawn, got:", len(master.stats.entries))
+	}
+	if master.stats.total.NumRequests != 0 {
+		t.Error("Total should be cleared on spawn, got:", master.stats.total.NumRequests)
+	}
+}
+
+func TestMasterWorkerRampsUpWithSpawnRate(t *testing.T) {
+	rand.Seed(Now())
+	port := rand.Intn(1000) + 12240
+	master := NewMaster("127.0.0.1", port)
+	if err := master.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer master.Quit()
+
+	b := NewBoomer("127.0.0.1", port)
+	b.SetIsOldSpawnWorker(true)
+	task := &Task{
+		Name: "foo",
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+	b.Run(task)
+	defer b.Quit()
+
+	for i := 0; i < 20 && master.WorkerCount() == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if master.WorkerCount() != 1 {
+		t.Fatal("WorkerCount is wrong, expected: 1, got:", master.WorkerCount())
+	}
+
+	// the worker is sent 6 users at once, and ramps them up in about 2 seconds
+	master.Spawn(6, 3)
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&b.slaveRunner.numClients); n >= 6 {
+		t.Error("Users should be ramped up by the worker, got:", n)
+	}
+
+	for i := 0; i < 40 && master.UserCount() != 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if master.UserCount() != 6 {
+		t.Error("UserCount is wrong, expected: 6, got:", master.UserCount())
+	}
+	master.workersLock.RLock()
+	state := master.state
+	master.workersLock.RUnlock()
+	if state != stateRunning {
+		t.Error("Master should be running after workers complete spawning, got:", state)
+	}
+}
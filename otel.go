@@ -0,0 +1,547 @@
+package boomer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultOtelBounds are the default explicit bounds of OpenTelemetry histograms, in milliseconds.
+var defaultOtelBounds = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+// maxQueuedSpans caps the spans waiting to be exported, more spans are dropped.
+const maxQueuedSpans = 10000
+
+const otelScopeName = "github.com/myzhan/boomer"
+
+// IterationTracer starts a span around every iteration of tasks, see Boomer.EnableIterationTracing.
+type IterationTracer interface {
+	// StartIteration returns a context carrying the span, which is passed to Task.FnCtx,
+	// and a function to end the span.
+	StartIteration(ctx context.Context, taskName string) (context.Context, func())
+}
+
+// iterationFailure is the first failure recorded in an iteration, tasks may record from more than one goroutine.
+type iterationFailure struct {
+	lock    sync.Mutex
+	failed  bool
+	message string
+}
+
+func (f *iterationFailure) set(message string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.failed {
+		f.failed, f.message = true, message
+	}
+}
+
+func (f *iterationFailure) get() (failed bool, message string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.failed, f.message
+}
+
+type iterationFailureKey struct{}
+
+// contextWithIterationFailure returns a copy of ctx, failures recorded with it are kept in the returned iterationFailure.
+func contextWithIterationFailure(ctx context.Context) (context.Context, *iterationFailure) {
+	failure := &iterationFailure{}
+	return context.WithValue(ctx, iterationFailureKey{}, failure), failure
+}
+
+// markIterationFailed marks the span of the iteration in ctx as failed, ctx can be nil.
+func markIterationFailed(ctx context.Context, message string) {
+	if ctx == nil {
+		return
+	}
+	if failure, ok := ctx.Value(iterationFailureKey{}).(*iterationFailure); ok {
+		failure.set(message)
+	}
+}
+
+// otelIterationTracer starts spans of iterations by a Tracer of the OpenTelemetry SDK.
+type otelIterationTracer struct {
+	tracer trace.Tracer
+}
+
+// NewOtelIterationTracer returns an IterationTracer, which starts spans of iterations by tracer, like
+// otel.Tracer("boomer") with a TracerProvider of the OpenTelemetry SDK. The spans are exported by the SDK,
+// together with the spans started by tasks, like the spans of otelhttp.
+func NewOtelIterationTracer(tracer trace.Tracer) IterationTracer {
+	return &otelIterationTracer{tracer: tracer}
+}
+
+// StartIteration implements IterationTracer.
+func (t *otelIterationTracer) StartIteration(ctx context.Context, taskName string) (context.Context, func()) {
+	ctx, span := t.tracer.Start(ctx, taskName, trace.WithAttributes(attribute.String("boomer.task", taskName)))
+	ctx, failure := contextWithIterationFailure(ctx)
+	return ctx, func() {
+		if failed, message := failure.get(); failed {
+			span.SetStatus(codes.Error, message)
+		}
+		span.End()
+	}
+}
+
+// OpenTelemetryOutput exports boomer stats as OTLP metrics to an OpenTelemetry collector, by OTLP/HTTP
+// with JSON encoding, so it doesn't need the OpenTelemetry SDK.
+//
+// Requests and failures are exported as the cumulative counters boomer.requests and boomer.failures,
+// and response times as the cumulative histogram boomer.response_time in milliseconds, with the attributes
+// request.type and request.name. The ID of the node is exported as the resource attribute boomer.node_id.
+// Corrected latencies of tasks aren't requests, they're only exported as the histogram boomer.corrected_response_time.
+//
+// Metrics are exported in the background, and OnStop waits for them to be exported.
+//
+// It's also an IterationTracer, see Boomer.EnableIterationTracing. Spans are exported with the metrics.
+// Spans started by tasks aren't exported by it, use NewOtelIterationTracer to export all of them by the SDK.
+type OpenTelemetryOutput struct {
+	endpoint string
+	client   *http.Client
+	bounds   []float64
+	nodeID   string
+	// ResourceAttributes are added to the resource of metrics and spans, like deployment.environment.
+	ResourceAttributes map[string]string
+
+	// metrics and spans are exported in the background, so a slow or down collector doesn't block other outputs
+	metricsSender *streamSender
+	tracesSender  *streamSender
+
+	lock         sync.Mutex
+	startTime    time.Time
+	data         map[[2]string]*otelRequestData
+	corrected    map[[2]string]*otelRequestData
+	userCount    int32
+	spans        []otelSpan
+	droppedSpans int64
+}
+
+// otelRequestData is aggregated since the start of the test.
+type otelRequestData struct {
+	requests int64
+	failures int64
+	counts   []uint64
+	sum      float64
+	min      int64
+	max      int64
+}
+
+// NewOpenTelemetryOutput returns an OpenTelemetryOutput, which exports to the OTLP/HTTP endpoint of a collector,
+// like "http://localhost:4318". Bounds of the histogram of response times are in milliseconds,
+// the default bounds of OpenTelemetry are used if it's empty.
+func NewOpenTelemetryOutput(endpoint string, bounds ...float64) *OpenTelemetryOutput {
+	if len(bounds) == 0 {
+		bounds = defaultOtelBounds
+	}
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	o := &OpenTelemetryOutput{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		bounds:    bounds,
+		nodeID:    getNodeID(),
+		data:      make(map[[2]string]*otelRequestData),
+		corrected: make(map[[2]string]*otelRequestData),
+	}
+	o.metricsSender = newStreamSender("OpenTelemetry collector", func(body string) error {
+		return o.export("/v1/metrics", body)
+	})
+	o.tracesSender = newStreamSender("OpenTelemetry collector", func(body string) error {
+		return o.export("/v1/traces", body)
+	})
+	return o
+}
+
+// OnStart records the start of the cumulative metrics.
+func (o *OpenTelemetryOutput) OnStart() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.startTime = time.Now()
+}
+
+// OnEvent aggregates data, and queues the metrics and the spans ended since the last report to export.
+func (o *OpenTelemetryOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+
+	o.lock.Lock()
+	if o.startTime.IsZero() {
+		o.startTime = time.Now()
+	}
+	if nodeID, ok := data["node_id"].(string); ok {
+		o.nodeID = nodeID
+	}
+	o.userCount = output.UserCount
+	o.aggregate(o.data, output.Stats)
+	o.aggregate(o.corrected, output.CorrectedStats)
+	metrics := o.buildMetrics(time.Now())
+	spans := o.takeSpans()
+	o.lock.Unlock()
+
+	o.enqueue(o.metricsSender, metrics)
+	if spans != nil {
+		o.enqueue(o.tracesSender, spans)
+	}
+}
+
+// aggregate adds stats to data.
+func (o *OpenTelemetryOutput) aggregate(data map[[2]string]*otelRequestData, stats []*statsEntryOutput) {
+	for _, stat := range stats {
+		key := [2]string{stat.Method, stat.Name}
+		d, ok := data[key]
+		if !ok {
+			d = &otelRequestData{counts: make([]uint64, len(o.bounds)+1)}
+			data[key] = d
+		}
+		if stat.NumRequests > 0 && (d.requests == 0 || stat.MinResponseTime < d.min) {
+			d.min = stat.MinResponseTime
+		}
+		if stat.MaxResponseTime > d.max {
+			d.max = stat.MaxResponseTime
+		}
+		d.requests += stat.NumRequests
+		d.failures += stat.NumFailures
+		d.sum += float64(stat.TotalResponseTime)
+		for responseTime, count := range stat.ResponseTimes {
+			// the bucket i counts values in (bounds[i-1], bounds[i]]
+			d.counts[sort.SearchFloat64s(o.bounds, float64(responseTime))] += uint64(count)
+		}
+	}
+}
+
+// OnStop queues the spans ended since the last report, and waits for the metrics and the spans to be exported.
+func (o *OpenTelemetryOutput) OnStop() {
+	o.lock.Lock()
+	spans := o.takeSpans()
+	o.lock.Unlock()
+	if spans != nil {
+		o.enqueue(o.tracesSender, spans)
+	}
+	o.metricsSender.stop()
+	o.tracesSender.stop()
+}
+
+// StartIteration implements IterationTracer. The span is put into the context by the OpenTelemetry API,
+// so spans started by tasks with a Tracer of the SDK are its children, and propagators inject it into requests.
+// But it isn't recording, attributes and events added to it by tasks are ignored.
+func (o *OpenTelemetryOutput) StartIteration(ctx context.Context, taskName string) (context.Context, func()) {
+	parent := trace.SpanContextFromContext(ctx)
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	if parent.IsValid() {
+		traceID = parent.TraceID()
+	} else {
+		rand.Read(traceID[:])
+	}
+	rand.Read(spanID[:])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+	ctx, failure := contextWithIterationFailure(trace.ContextWithSpanContext(ctx, sc))
+	startTime := time.Now()
+
+	return ctx, func() {
+		span := otelSpan{
+			TraceID:           traceID.String(),
+			SpanID:            spanID.String(),
+			Name:              taskName,
+			Kind:              otelSpanKindInternal,
+			StartTimeUnixNano: otelTime(startTime),
+			EndTimeUnixNano:   otelTime(time.Now()),
+			Attributes:        []otelKeyValue{otelStringAttribute("boomer.task", taskName)},
+		}
+		if parent.IsValid() {
+			span.ParentSpanID = parent.SpanID().String()
+		}
+		if failed, message := failure.get(); failed {
+			span.Status = &otelStatus{Code: otelStatusCodeError, Message: message}
+		}
+		o.lock.Lock()
+		if len(o.spans) < maxQueuedSpans {
+			o.spans = append(o.spans, span)
+		} else {
+			o.droppedSpans++
+		}
+		o.lock.Unlock()
+	}
+}
+
+// takeSpans returns the request of queued spans and clears the queue, or nil if there are no spans.
+func (o *OpenTelemetryOutput) takeSpans() *otelTracesRequest {
+	if o.droppedSpans > 0 {
+		log.Printf("%d spans are dropped, because more than %d spans are ended in a report interval.\n", o.droppedSpans, maxQueuedSpans)
+		o.droppedSpans = 0
+	}
+	if len(o.spans) == 0 {
+		return nil
+	}
+	spans := o.spans
+	o.spans = nil
+	return &otelTracesRequest{
+		ResourceSpans: []otelResourceSpans{{
+			Resource:   o.resource(),
+			ScopeSpans: []otelScopeSpans{{Scope: otelScope{Name: otelScopeName}, Spans: spans}},
+		}},
+	}
+}
+
+func (o *OpenTelemetryOutput) resource() otelResource {
+	attributes := []otelKeyValue{
+		otelStringAttribute("service.name", "boomer"),
+		otelStringAttribute("boomer.node_id", o.nodeID),
+	}
+	keys := make([]string, 0, len(o.ResourceAttributes))
+	for key := range o.ResourceAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attributes = append(attributes, otelStringAttribute(key, o.ResourceAttributes[key]))
+	}
+	return otelResource{Attributes: attributes}
+}
+
+func (o *OpenTelemetryOutput) buildMetrics(now time.Time) *otelMetricsRequest {
+	startTime, timestamp := otelTime(o.startTime), otelTime(now)
+
+	keys := sortedOtelKeys(o.data)
+	requests := &otelSum{AggregationTemporality: otelTemporalityCumulative, IsMonotonic: true}
+	failures := &otelSum{AggregationTemporality: otelTemporalityCumulative, IsMonotonic: true}
+	for _, key := range keys {
+		d := o.data[key]
+		attributes := otelRequestAttributes(key)
+		requests.DataPoints = append(requests.DataPoints, otelNumberDataPoint{
+			Attributes: attributes, StartTimeUnixNano: startTime, TimeUnixNano: timestamp, AsInt: strconv.FormatInt(d.requests, 10),
+		})
+		failures.DataPoints = append(failures.DataPoints, otelNumberDataPoint{
+			Attributes: attributes, StartTimeUnixNano: startTime, TimeUnixNano: timestamp, AsInt: strconv.FormatInt(d.failures, 10),
+		})
+	}
+
+	metrics := []otelMetric{
+		{Name: "boomer.users", Description: "The current number of users", Unit: "{user}", Gauge: &otelGauge{
+			DataPoints: []otelNumberDataPoint{{TimeUnixNano: timestamp, AsInt: strconv.FormatInt(int64(o.userCount), 10)}},
+		}},
+	}
+	if len(keys) > 0 {
+		metrics = append(metrics,
+			otelMetric{Name: "boomer.requests", Description: "The number of requests", Unit: "{request}", Sum: requests},
+			otelMetric{Name: "boomer.failures", Description: "The number of failures", Unit: "{request}", Sum: failures},
+			otelMetric{Name: "boomer.response_time", Description: "The response times of requests", Unit: "ms",
+				Histogram: o.buildHistogram(o.data, keys, startTime, timestamp)},
+		)
+	}
+	if len(o.corrected) > 0 {
+		metrics = append(metrics, otelMetric{
+			Name: "boomer.corrected_response_time", Description: "The latencies of tasks from their intended starts", Unit: "ms",
+			Histogram: o.buildHistogram(o.corrected, sortedOtelKeys(o.corrected), startTime, timestamp),
+		})
+	}
+	return &otelMetricsRequest{
+		ResourceMetrics: []otelResourceMetrics{{
+			Resource:     o.resource(),
+			ScopeMetrics: []otelScopeMetrics{{Scope: otelScope{Name: otelScopeName}, Metrics: metrics}},
+		}},
+	}
+}
+
+func (o *OpenTelemetryOutput) buildHistogram(data map[[2]string]*otelRequestData, keys [][2]string, startTime, timestamp string) *otelHistogram {
+	histogram := &otelHistogram{AggregationTemporality: otelTemporalityCumulative}
+	for _, key := range keys {
+		d := data[key]
+		point := otelHistogramDataPoint{
+			Attributes:        otelRequestAttributes(key),
+			StartTimeUnixNano: startTime,
+			TimeUnixNano:      timestamp,
+			Count:             strconv.FormatInt(d.requests, 10),
+			Sum:               d.sum,
+			BucketCounts:      make([]string, len(d.counts)),
+			ExplicitBounds:    o.bounds,
+		}
+		for i, count := range d.counts {
+			point.BucketCounts[i] = strconv.FormatUint(count, 10)
+		}
+		if d.requests > 0 {
+			min, max := float64(d.min), float64(d.max)
+			point.Min, point.Max = &min, &max
+		}
+		histogram.DataPoints = append(histogram.DataPoints, point)
+	}
+	return histogram
+}
+
+// sortedOtelKeys returns the keys of data sorted by name and method.
+func sortedOtelKeys(data map[[2]string]*otelRequestData) [][2]string {
+	keys := make([][2]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][1]+keys[i][0] < keys[j][1]+keys[j][0]
+	})
+	return keys
+}
+
+func otelRequestAttributes(key [2]string) []otelKeyValue {
+	return []otelKeyValue{otelStringAttribute("request.type", key[0]), otelStringAttribute("request.name", key[1])}
+}
+
+// enqueue encodes request to JSON, and queues it to export by sender.
+func (o *OpenTelemetryOutput) enqueue(sender *streamSender, request interface{}) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("Failed to encode OTLP request, %v\n", err)
+		return
+	}
+	sender.enqueue(string(body))
+}
+
+// export posts body to the path of the endpoint, like /v1/metrics.
+func (o *OpenTelemetryOutput) export(path string, body string) error {
+	resp, err := o.client.Post(o.endpoint+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		// a permanent error is still found by retrySend
+		return fmt.Errorf("%s%s, %w", o.endpoint, path, err)
+	}
+	return nil
+}
+
+func otelTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otelStringAttribute(key, value string) otelKeyValue {
+	return otelKeyValue{Key: key, Value: otelAnyValue{StringValue: value}}
+}
+
+// The JSON encoding of OTLP, 64 bits integers are encoded as strings like the JSON mapping of protobuf.
+// See https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto
+
+const (
+	otelTemporalityCumulative = 2
+	otelSpanKindInternal      = 1
+	otelStatusCodeError       = 2
+)
+
+type otelKeyValue struct {
+	Key   string       `json:"key"`
+	Value otelAnyValue `json:"value"`
+}
+
+type otelAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otelResource struct {
+	Attributes []otelKeyValue `json:"attributes"`
+}
+
+type otelScope struct {
+	Name string `json:"name"`
+}
+
+type otelMetricsRequest struct {
+	ResourceMetrics []otelResourceMetrics `json:"resourceMetrics"`
+}
+
+type otelResourceMetrics struct {
+	Resource     otelResource       `json:"resource"`
+	ScopeMetrics []otelScopeMetrics `json:"scopeMetrics"`
+}
+
+type otelScopeMetrics struct {
+	Scope   otelScope    `json:"scope"`
+	Metrics []otelMetric `json:"metrics"`
+}
+
+type otelMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otelGauge     `json:"gauge,omitempty"`
+	Sum         *otelSum       `json:"sum,omitempty"`
+	Histogram   *otelHistogram `json:"histogram,omitempty"`
+}
+
+type otelGauge struct {
+	DataPoints []otelNumberDataPoint `json:"dataPoints"`
+}
+
+type otelSum struct {
+	DataPoints             []otelNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otelNumberDataPoint struct {
+	Attributes        []otelKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otelHistogram struct {
+	DataPoints             []otelHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otelHistogramDataPoint struct {
+	Attributes        []otelKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+}
+
+type otelTracesRequest struct {
+	ResourceSpans []otelResourceSpans `json:"resourceSpans"`
+}
+
+type otelResourceSpans struct {
+	Resource   otelResource     `json:"resource"`
+	ScopeSpans []otelScopeSpans `json:"scopeSpans"`
+}
+
+type otelScopeSpans struct {
+	Scope otelScope  `json:"scope"`
+	Spans []otelSpan `json:"spans"`
+}
+
+type otelSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otelKeyValue `json:"attributes"`
+	Status            *otelStatus    `json:"status,omitempty"`
+}
+
+type otelStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code"`
+}
@@ -0,0 +1,353 @@
+package boomer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelCollector is an in-process stand-in of the OTLP/HTTP receiver of an OpenTelemetry collector.
+type otelCollector struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	metrics []otelMetricsRequest
+	traces  []otelTracesRequest
+}
+
+// testTracer records spans by the OpenTelemetry API, like the SDK, so the tests don't depend on the SDK.
+type testTracer struct {
+	lock   sync.Mutex
+	nextID uint64
+	ended  []*testSpan
+}
+
+type testSpan struct {
+	// the methods which aren't recorded are of a non-recording span
+	trace.Span
+	tracer      *testTracer
+	name        string
+	spanContext trace.SpanContext
+	parent      trace.SpanContext
+	code        codes.Code
+	description string
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.lock.Lock()
+	t.nextID++
+	id := t.nextID
+	t.lock.Unlock()
+
+	parent := trace.SpanContextFromContext(ctx)
+	traceID := parent.TraceID()
+	if !traceID.IsValid() {
+		binary.BigEndian.PutUint64(traceID[8:], id)
+	}
+	var spanID trace.SpanID
+	binary.BigEndian.PutUint64(spanID[:], id)
+	span := &testSpan{
+		Span:   trace.SpanFromContext(context.Background()),
+		tracer: t,
+		name:   name,
+		spanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}),
+		parent: parent,
+	}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (s *testSpan) SpanContext() trace.SpanContext {
+	return s.spanContext
+}
+
+func (s *testSpan) IsRecording() bool {
+	return true
+}
+
+func (s *testSpan) SetStatus(code codes.Code, description string) {
+	s.code, s.description = code, description
+}
+
+func (s *testSpan) End(options ...trace.SpanEndOption) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+func newOtelCollector() *otelCollector {
+	c := &otelCollector{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		var err error
+		switch r.URL.Path {
+		case "/v1/metrics":
+			var request otelMetricsRequest
+			err = json.NewDecoder(r.Body).Decode(&request)
+			c.metrics = append(c.metrics, request)
+		case "/v1/traces":
+			var request otelTracesRequest
+			err = json.NewDecoder(r.Body).Decode(&request)
+			c.traces = append(c.traces, request)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	return c
+}
+
+func findOtelMetric(request otelMetricsRequest, name string) *otelMetric {
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if metric.Name == name {
+			m := metric
+			return &m
+		}
+	}
+	return nil
+}
+
+func TestOpenTelemetryOutputMetrics(t *testing.T) {
+	collector := newOtelCollector()
+	defer collector.server.Close()
+
+	o := NewOpenTelemetryOutput(collector.server.URL+"/", 50, 500)
+	o.ResourceAttributes = map[string]string{"deployment.environment": "test"}
+	o.OnStart()
+	o.OnEvent(newTestReportData())
+	data := newTestReportData()
+	data["node_id"] = "worker-1"
+	o.OnEvent(data)
+	o.OnStop()
+
+	assert.Len(t, collector.metrics, 2)
+	assert.Empty(t, collector.traces)
+	request := collector.metrics[1]
+	assert.Equal(t, []otelKeyValue{
+		otelStringAttribute("service.name", "boomer"),
+		otelStringAttribute("boomer.node_id", "worker-1"),
+		otelStringAttribute("deployment.environment", "test"),
+	}, request.ResourceMetrics[0].Resource.Attributes)
+
+	users := findOtelMetric(request, "boomer.users")
+	assert.Equal(t, "5", users.Gauge.DataPoints[0].AsInt)
+
+	// home is sorted before login
+	requests := findOtelMetric(request, "boomer.requests")
+	assert.True(t, requests.Sum.IsMonotonic)
+	assert.Equal(t, otelTemporalityCumulative, requests.Sum.AggregationTemporality)
+	assert.Equal(t, otelStringAttribute("request.name", "home"), requests.Sum.DataPoints[0].Attributes[1])
+	assert.Equal(t, "2", requests.Sum.DataPoints[0].AsInt)
+	assert.Equal(t, "4", requests.Sum.DataPoints[1].AsInt)
+	failures := findOtelMetric(request, "boomer.failures")
+	assert.Equal(t, "2", failures.Sum.DataPoints[0].AsInt)
+	assert.Equal(t, "0", failures.Sum.DataPoints[1].AsInt)
+
+	responseTime := findOtelMetric(request, "boomer.response_time")
+	login := responseTime.Histogram.DataPoints[1]
+	assert.Equal(t, "4", login.Count)
+	assert.Equal(t, float64(420), login.Sum)
+	assert.Equal(t, []float64{50, 500}, login.ExplicitBounds)
+	assert.Equal(t, []string{"2", "2", "0"}, login.BucketCounts)
+	assert.Equal(t, float64(10), *login.Min)
+	assert.Equal(t, float64(200), *login.Max)
+}
+
+func TestOpenTelemetryOutputCorrectedStats(t *testing.T) {
+	collector := newOtelCollector()
+	defer collector.server.Close()
+
+	o := NewOpenTelemetryOutput(collector.server.URL, 50, 500)
+	stats := newRequestStats()
+	stats.recordSuccess("http", "login", 20, 0, 10)
+	stats.recordCorrectedLatency("task", 120000)
+	data := stats.collectReportData()
+	data["user_count"] = int32(1)
+	o.OnEvent(data)
+	o.OnStop()
+
+	assert.Len(t, collector.metrics, 1)
+	request := collector.metrics[0]
+	requests := findOtelMetric(request, "boomer.requests")
+	assert.Len(t, requests.Sum.DataPoints, 1)
+	assert.Equal(t, otelStringAttribute("request.name", "login"), requests.Sum.DataPoints[0].Attributes[1])
+	assert.Equal(t, "1", requests.Sum.DataPoints[0].AsInt)
+	assert.Len(t, findOtelMetric(request, "boomer.failures").Sum.DataPoints, 1)
+	assert.Len(t, findOtelMetric(request, "boomer.response_time").Histogram.DataPoints, 1)
+
+	corrected := findOtelMetric(request, "boomer.corrected_response_time")
+	assert.Len(t, corrected.Histogram.DataPoints, 1)
+	point := corrected.Histogram.DataPoints[0]
+	assert.Equal(t, otelStringAttribute("request.type", "corrected"), point.Attributes[0])
+	assert.Equal(t, otelStringAttribute("request.name", "task"), point.Attributes[1])
+	assert.Equal(t, "1", point.Count)
+	assert.Equal(t, []string{"0", "1", "0"}, point.BucketCounts)
+}
+
+func TestOpenTelemetryOutputDoesNotBlock(t *testing.T) {
+	defer func(timeout time.Duration) { streamFlushTimeout = timeout }(streamFlushTimeout)
+	streamFlushTimeout = 50 * time.Millisecond
+
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// the collector doesn't respond, but reports are queued without waiting for it
+	o := NewOpenTelemetryOutput(server.URL)
+	start := time.Now()
+	o.OnEvent(newTestReportData())
+	o.OnEvent(newTestReportData())
+	assert.True(t, time.Since(start) < time.Second, "OnEvent should not wait for exporting")
+
+	// metrics not exported in streamFlushTimeout are dropped
+	o.OnStop()
+	assert.True(t, time.Since(start) < time.Second, "OnStop should not wait longer than streamFlushTimeout")
+}
+
+func TestOpenTelemetryOutputBadRequest(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	o := NewOpenTelemetryOutput(server.URL)
+	err := retrySend(func() error {
+		return o.export("/v1/metrics", "{}")
+	})
+	assert.EqualError(t, err, server.URL+"/v1/metrics, status: 400 Bad Request, bad metrics")
+	// bad requests aren't retried
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestOpenTelemetryOutputTracing(t *testing.T) {
+	collector := newOtelCollector()
+	defer collector.server.Close()
+	o := NewOpenTelemetryOutput(collector.server.URL)
+
+	runner := newLocalRunner(nil, nil, 1, 1)
+	defer runner.stats.close()
+	runner.tracer = o
+
+	// spans of tasks started by the OpenTelemetry API are children of the iteration
+	tracer := &testTracer{}
+	header := http.Header{}
+	task := &Task{
+		Name: "traced",
+		FnCtx: func(ctx context.Context) {
+			_, span := tracer.Start(ctx, "request")
+			span.End()
+			propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+		},
+	}
+	runner.runTask(context.Background(), task)
+	o.OnStop()
+
+	assert.Len(t, collector.traces, 1)
+	spans := collector.traces[0].ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "traced", spans[0].Name)
+	assert.Equal(t, "00-"+spans[0].TraceID+"-"+spans[0].SpanID+"-01", header.Get("traceparent"))
+	assert.Len(t, spans[0].TraceID, 32)
+	assert.Len(t, spans[0].SpanID, 16)
+	assert.NotEmpty(t, spans[0].StartTimeUnixNano)
+	assert.NotEmpty(t, spans[0].EndTimeUnixNano)
+
+	children := tracer.ended
+	assert.Len(t, children, 1)
+	assert.Equal(t, spans[0].TraceID, children[0].spanContext.TraceID().String())
+	assert.Equal(t, spans[0].SpanID, children[0].parent.SpanID().String())
+}
+
+func TestOpenTelemetryOutputChildSpan(t *testing.T) {
+	o := NewOpenTelemetryOutput("http://127.0.0.1:0")
+	parent := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}})
+	ctx, end := o.StartIteration(trace.ContextWithSpanContext(context.Background(), parent), "child")
+	end()
+
+	sc := trace.SpanContextFromContext(ctx)
+	assert.Equal(t, parent.TraceID(), sc.TraceID())
+	assert.NotEqual(t, parent.SpanID(), sc.SpanID())
+	assert.Equal(t, "0200000000000000", o.spans[0].ParentSpanID)
+}
+
+func TestOpenTelemetryOutputFailedSpan(t *testing.T) {
+	o := NewOpenTelemetryOutput("http://127.0.0.1:0")
+	b := NewStandaloneBoomer(1, 1)
+	b.localRunner = newLocalRunner(nil, nil, 1, 1)
+	defer b.localRunner.stats.close()
+	b.localRunner.tracer = o
+
+	task := &Task{
+		Name: "failed",
+		FnCtx: func(ctx context.Context) {
+			b.RecordFailureContext(ctx, "http", "login", time.Millisecond, "500 error")
+			b.RecordError(ctx, "http", "login", time.Millisecond, io.EOF)
+		},
+	}
+	b.localRunner.runTask(context.Background(), task)
+	assert.Equal(t, &otelStatus{Code: otelStatusCodeError, Message: "500 error"}, o.spans[0].Status)
+
+	// failures recorded without the context of the iteration aren't linked to the span
+	task.FnCtx = func(ctx context.Context) {
+		b.RecordFailure("http", "login", 1, "500 error")
+	}
+	b.localRunner.runTask(context.Background(), task)
+	assert.Nil(t, o.spans[1].Status)
+}
+
+func TestOtelIterationTracer(t *testing.T) {
+	tracer := &testTracer{}
+	b := NewStandaloneBoomer(1, 1)
+	b.localRunner = newLocalRunner(nil, nil, 1, 1)
+	defer b.localRunner.stats.close()
+	b.localRunner.tracer = NewOtelIterationTracer(tracer)
+
+	task := &Task{
+		Name: "failed",
+		FnCtx: func(ctx context.Context) {
+			_, span := tracer.Start(ctx, "request")
+			span.End()
+			b.RecordFailureContext(ctx, "http", "login", time.Millisecond, "500 error")
+		},
+	}
+	b.localRunner.runTask(context.Background(), task)
+
+	spans := tracer.ended
+	assert.Len(t, spans, 2)
+	child, iteration := spans[0], spans[1]
+	assert.Equal(t, "failed", iteration.name)
+	assert.Equal(t, iteration.spanContext.SpanID(), child.parent.SpanID())
+	assert.Equal(t, codes.Error, iteration.code)
+	assert.Equal(t, "500 error", iteration.description)
+	assert.Equal(t, codes.Unset, child.code)
+}
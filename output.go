@@ -7,6 +7,7 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
@@ -34,51 +35,111 @@ type Output interface {
 }
 
 // ConsoleOutput is the default output for standalone mode.
+// It prints a table of requests and errors on every report, and a summary of the whole test at OnStop.
 type ConsoleOutput struct {
+	options OutputOptions
+	// print a line of the total stats instead of tables on every report
+	compact   bool
+	startTime time.Time
+
+	lock  sync.Mutex
+	stats *statsAggregator
 }
 
+// OutputOptions are the options of ConsoleOutput and JsonFileOutput, every output has its own copy.
 type OutputOptions struct {
-	PercentTime        int
+	// PercentTime is the percentile of percent_response_time, it's 90 if it's not positive.
+	PercentTime int
+	// RealTimeResultPath is the file of JsonFileOutput, which has a line of the stats of every report.
 	RealTimeResultPath string
-	TotalResultPath    string
+	// TotalResultPath is the file of JsonFileOutput, which is rewritten with the stats since the start on every report.
+	TotalResultPath string
 }
 
-func NewConsoleOutputWithOptions(outputOps *OutputOptions) *ConsoleOutput {
-	OutputOps = outputOps
-	if OutputOps.PercentTime <= 0 {
-		OutputOps.PercentTime = 90
+// OutputOps is the default options of ConsoleOutput and JsonFileOutput created by NewConsoleOutput,
+// NewCompactConsoleOutput and NewJsonFileOutput, they copy it when they're created.
+//
+// Deprecated: pass OutputOptions to NewConsoleOutputWithOptions or NewJsonFileOutputWithOptions instead.
+// It's no longer set by them, and changes after an output is created don't affect the output.
+var OutputOps = new(OutputOptions)
+
+// defaultPercentTime is the percentile of percent_response_time if OutputOptions.PercentTime isn't set.
+const defaultPercentTime = 90
+
+func (o *OutputOptions) percentTime() int {
+	if o.PercentTime <= 0 {
+		return defaultPercentTime
 	}
-	return &ConsoleOutput{}
+	return o.PercentTime
 }
 
-func NewJsonFileOutputWithOptions(outputOps *OutputOptions) *JsonFileOutput {
-	OutputOps = outputOps
-	if OutputOps.PercentTime <= 0 {
-		OutputOps.PercentTime = 90
-	}
-	return &JsonFileOutput{}
+// NewConsoleOutputWithOptions returns a ConsoleOutput with a copy of outputOps.
+func NewConsoleOutputWithOptions(outputOps *OutputOptions) *ConsoleOutput {
+	o := NewConsoleOutput()
+	o.options = *outputOps
+	return o
 }
 
-var OutputOps = new(OutputOptions)
+// NewJsonFileOutputWithOptions returns a JsonFileOutput with a copy of outputOps.
+func NewJsonFileOutputWithOptions(outputOps *OutputOptions) *JsonFileOutput {
+	o := NewJsonFileOutput()
+	o.options = *outputOps
+	return o
+}
 
-// NewConsoleOutput returns a ConsoleOutput.
+// NewConsoleOutput returns a ConsoleOutput with a copy of OutputOps.
 func NewConsoleOutput() *ConsoleOutput {
-	return &ConsoleOutput{}
+	return &ConsoleOutput{options: *OutputOps, stats: newStatsAggregator()}
 }
 
-// OnStart of ConsoleOutput has nothing to do.
-func (o *ConsoleOutput) OnStart() {
+// NewCompactConsoleOutput returns a ConsoleOutput, which prints a line of the total stats on every report.
+func NewCompactConsoleOutput() *ConsoleOutput {
+	o := NewConsoleOutput()
+	o.compact = true
+	return o
+}
 
+// OnStart records the start of the test.
+func (o *ConsoleOutput) OnStart() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.startTime = time.Now()
 }
 
-// OnStop of ConsoleOutput has nothing to do.
+// OnStop prints the summary of the whole test.
 func (o *ConsoleOutput) OnStop() {
-
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	allStats := o.stats.last
+	if allStats == nil {
+		println("Summary: no requests were made.")
+		return
+	}
+	total := aggregatedRow(allStats.TotalStats)
+	duration := time.Duration(0)
+	if !o.startTime.IsZero() {
+		duration = time.Since(o.startTime).Round(time.Second)
+	}
+	avgRps := float64(0)
+	if duration > 0 {
+		avgRps = float64(total.NumRequests) / duration.Seconds()
+	}
+	println(fmt.Sprintf("Summary: Duration: %s, Users: %d, Requests: %d, Failures: %d, Fail Ratio: %.1f%%, Average RPS: %.2f",
+		duration, allStats.UserCount, total.NumRequests, total.NumFailures,
+		getTotalFailRatio(total.NumRequests, total.NumFailures)*100, avgRps))
+	table := newConsoleTable(o.options.PercentTime)
+	for _, stat := range allStats.Stats {
+		table.Append(consoleStatsRow(stat))
+	}
+	table.Append(consoleStatsRow(total))
+	table.Render()
+	printConsoleErrors(allStats.Errors)
+	println()
 }
 
 // OnEvent will print to the console.
 func (o *ConsoleOutput) OnEvent(data map[string]interface{}) {
-	output, err := convertData(data)
+	output, err := convertDataWithPercentTime(data, o.options.percentTime())
 	if err != nil {
 		log.Println(fmt.Sprintf("convert data error: %v", err))
 		return
@@ -86,67 +147,144 @@ func (o *ConsoleOutput) OnEvent(data map[string]interface{}) {
 
 	output.Stats = sortOutput(output.Stats)
 
-	buildAllStats(output)
-	sortOutput(allStats.Stats)
-
 	currentTime := time.Now()
+	if o.compact {
+		o.lock.Lock()
+		o.stats.cumulative(output, o.options.percentTime())
+		o.lock.Unlock()
+		o.printCompact(currentTime, output)
+		return
+	}
+
 	computerMonitor := GetCpuMem()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	allStats := o.stats.cumulative(output, o.options.percentTime())
 	println(fmt.Sprintf("Current Data: %s, Users: %d, Total RPS: %d, Total Fail Ratio: %.1f%%",
 		currentTime.Format("2006/01/02 15:04:05"), output.UserCount, output.TotalRPS, output.TotalFailRatio*100))
 	println(fmt.Sprintf("Summary data: %s, Users: %d, Total RPS: %d, Total Fail Ratio: %.1f%%",
 		currentTime.Format("2006/01/02 15:04:05"), allStats.UserCount, allStats.TotalRPS, allStats.TotalFailRatio*100))
 	println(fmt.Sprintf("Client Monitor: Cpu:%.1f%%, Memory:%.1f%%", computerMonitor.CPU, computerMonitor.Mem))
-	table := tablewriter.NewWriter(os.Stdout)
-
-	pTitle := "P90"
-	if OutputOps.PercentTime > 0 {
-		pTitle = fmt.Sprintf("L%d", OutputOps.PercentTime)
+	if output.DroppedIterations > 0 {
+		println(fmt.Sprintf("Dropped iterations: %d", output.DroppedIterations))
 	}
-
-	table.SetHeader([]string{"Type", "Name", "# requests", "# fails", "P50", pTitle, "P95", "Average", "Min", "Max", "Content Size", "# reqs/sec", "# fails/sec"})
+	if output.AbandonedIterations > 0 {
+		println(fmt.Sprintf("Abandoned iterations: %d", output.AbandonedIterations))
+	}
+	table := newConsoleTable(o.options.PercentTime)
 
 	table.Append([]string{"Current Data:"})
 	for _, stat := range output.Stats {
-		row := make([]string, 13)
-		row[0] = stat.Method
-		row[1] = stat.Name
-		row[2] = strconv.FormatInt(stat.NumRequests, 10)
-		row[3] = strconv.FormatInt(stat.NumFailures, 10)
-		row[4] = strconv.FormatInt(stat.MedianResponseTime, 10)
-		row[5] = strconv.FormatInt(stat.PercentResponseTime, 10)
-		row[6] = strconv.FormatInt(stat.Percent95ResponseTime, 10)
-		row[7] = strconv.FormatFloat(stat.AvgResponseTime, 'f', 2, 64)
-		row[8] = strconv.FormatInt(stat.MinResponseTime, 10)
-		row[9] = strconv.FormatInt(stat.MaxResponseTime, 10)
-		row[10] = strconv.FormatInt(stat.AvgContentLength, 10)
-		row[11] = strconv.FormatInt(stat.CurrentRps, 10)
-		row[12] = strconv.FormatInt(stat.CurrentFailPerSec, 10)
-		table.Append(row)
+		table.Append(consoleStatsRow(stat))
+	}
+	if output.TotalStats != nil {
+		table.Append(consoleStatsRow(aggregatedRow(output.TotalStats)))
 	}
 
-	table.Append([]string{"Summary Data:"})
+	if len(output.CorrectedStats) > 0 {
+		table.Append([]string{"Corrected Latency:"})
+		for _, stat := range sortOutput(output.CorrectedStats) {
+			table.Append(consoleStatsRow(stat))
+		}
+	}
 
+	table.Append([]string{"Summary Data:"})
 	for _, stat := range allStats.Stats {
-		row := make([]string, 13)
-		row[0] = stat.Method
-		row[1] = stat.Name
-		row[2] = strconv.FormatInt(stat.NumRequests, 10)
-		row[3] = strconv.FormatInt(stat.NumFailures, 10)
-		row[4] = strconv.FormatInt(stat.MedianResponseTime, 10)
-		row[5] = strconv.FormatInt(stat.PercentResponseTime, 10)
-		row[6] = strconv.FormatInt(stat.Percent95ResponseTime, 10)
-		row[7] = strconv.FormatFloat(stat.AvgResponseTime, 'f', 2, 64)
-		row[8] = strconv.FormatInt(stat.MinResponseTime, 10)
-		row[9] = strconv.FormatInt(stat.MaxResponseTime, 10)
-		row[10] = strconv.FormatInt(stat.AvgContentLength, 10)
-		row[11] = strconv.FormatInt(stat.CurrentRps, 10)
-		row[12] = strconv.FormatInt(stat.CurrentFailPerSec, 10)
-		table.Append(row)
+		table.Append(consoleStatsRow(stat))
 	}
+	table.Append(consoleStatsRow(aggregatedRow(allStats.TotalStats)))
 	table.Render()
+	printConsoleErrors(output.Errors)
 	println()
 }
 
+func (o *ConsoleOutput) printCompact(currentTime time.Time, output *dataOutput) {
+	line := fmt.Sprintf("%s Users: %d, RPS: %d, Fail Ratio: %.1f%%",
+		currentTime.Format("2006/01/02 15:04:05"), output.UserCount, output.TotalRPS, output.TotalFailRatio*100)
+	if total := output.TotalStats; total != nil {
+		line += fmt.Sprintf(", Requests: %d, Failures: %d, P50: %dms, P95: %dms, Avg: %.2fms, Max: %dms",
+			total.NumRequests, total.NumFailures, total.MedianResponseTime, total.Percent95ResponseTime,
+			total.AvgResponseTime, total.MaxResponseTime)
+	}
+	if output.DroppedIterations > 0 {
+		line += fmt.Sprintf(", Dropped: %d", output.DroppedIterations)
+	}
+	if output.AbandonedIterations > 0 {
+		line += fmt.Sprintf(", Abandoned: %d", output.AbandonedIterations)
+	}
+	println(line)
+}
+
+func newConsoleTable(percentTime int) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	pTitle := "P90"
+	if percentTime > 0 {
+		pTitle = fmt.Sprintf("L%d", percentTime)
+	}
+	table.SetHeader([]string{"Type", "Name", "# requests", "# fails", "P50", pTitle, "P95", "Average", "Min", "Max", "Content Size", "# reqs/sec", "# fails/sec"})
+	return table
+}
+
+func consoleStatsRow(stat *statsEntryOutput) []string {
+	row := make([]string, 13)
+	row[0] = stat.Method
+	row[1] = stat.Name
+	row[2] = strconv.FormatInt(stat.NumRequests, 10)
+	row[3] = strconv.FormatInt(stat.NumFailures, 10)
+	row[4] = strconv.FormatInt(stat.MedianResponseTime, 10)
+	row[5] = strconv.FormatInt(stat.PercentResponseTime, 10)
+	row[6] = strconv.FormatInt(stat.Percent95ResponseTime, 10)
+	row[7] = strconv.FormatFloat(stat.AvgResponseTime, 'f', 2, 64)
+	row[8] = strconv.FormatInt(stat.MinResponseTime, 10)
+	row[9] = strconv.FormatInt(stat.MaxResponseTime, 10)
+	row[10] = strconv.FormatInt(stat.AvgContentLength, 10)
+	row[11] = strconv.FormatInt(stat.CurrentRps, 10)
+	row[12] = strconv.FormatInt(stat.CurrentFailPerSec, 10)
+	return row
+}
+
+// printConsoleErrors prints a table of errors by occurrences in descending order.
+func printConsoleErrors(errors map[string]map[string]interface{}) {
+	if len(errors) == 0 {
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"# occurrences", "Type", "Name", "Error"})
+	for _, e := range sortErrors(errors) {
+		table.Append([]string{strconv.FormatInt(e.occurrences, 10), e.method, e.name, e.error})
+	}
+	table.Render()
+}
+
+// sortErrors returns the errors of report data by occurrences in descending order.
+func sortErrors(errors map[string]map[string]interface{}) []*statsError {
+	sorted := make([]*statsError, 0, len(errors))
+	for _, e := range errors {
+		statsErr := &statsError{}
+		statsErr.occurrences, _ = castToInt64(e["occurrences"])
+		statsErr.method, _ = e["method"].(string)
+		statsErr.name, _ = e["name"].(string)
+		statsErr.error, _ = e["error"].(string)
+		statsErr.examples = errorExamples(e)
+		sorted = append(sorted, statsErr)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].occurrences != sorted[j].occurrences {
+			return sorted[i].occurrences > sorted[j].occurrences
+		}
+		return sorted[i].name+sorted[i].error < sorted[j].name+sorted[j].error
+	})
+	return sorted
+}
+
+// aggregatedRow returns a copy of the total stats named Aggregated, like the last row of locust's tables.
+// The total is the one reported to master and the other outputs, instead of being aggregated again.
+func aggregatedRow(total *statsEntryOutput) *statsEntryOutput {
+	row := *total
+	row.Method, row.Name = "", "Aggregated"
+	return &row
+}
+
 func getMedianResponseTime(numRequests int64, responseTimes map[int64]int64) int64 {
 	medianResponseTime := int64(0)
 	if len(responseTimes) != 0 {
@@ -207,15 +345,51 @@ func getPercentResponseTime(numRequests int64, responseTimes map[int64]int64, pe
 	return medianResponseTime
 }
 
+// getPercentileFromMicros returns the percentile of response times in milliseconds,
+// responseTimesMicros is the high resolution histogram, see statsEntry.ResponseTimesMicros.
+func getPercentileFromMicros(responseTimesMicros map[int64]int64, percentile float64) float64 {
+	return float64(getPercentileFromHistogram(responseTimesMicros, percentile)) / 1000
+}
+
+// getPercentileFromHistogram returns the percentile of a {response_time => count} histogram,
+// in the unit of its keys. Unlike getPercentResponseTime, the percentile can be a fraction like 99.9.
+func getPercentileFromHistogram(histogram map[int64]int64, percentile float64) int64 {
+	if len(histogram) == 0 {
+		return 0
+	}
+	var numRequests int64
+	sortedKeys := make([]int64, 0, len(histogram))
+	for k, v := range histogram {
+		sortedKeys = append(sortedKeys, k)
+		numRequests += v
+	}
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		return sortedKeys[i] < sortedKeys[j]
+	})
+	pos := int64(float64(numRequests-1) * percentile / 100)
+	for _, k := range sortedKeys {
+		if pos < histogram[k] {
+			return k
+		}
+		pos -= histogram[k]
+	}
+	return sortedKeys[len(sortedKeys)-1]
+}
+
 func getCurrentRps(numRequests int64, numReqsPerSecond map[int64]int64) (currentRps int64) {
+	return getRpsOfSeconds(numRequests, int64(len(numReqsPerSecond)))
+}
+
+func getRpsOfSeconds(numRequests int64, seconds int64) (currentRps int64) {
 	currentRps = int64(0)
 
 	//fix accuracy issue by robert
+	// the first and the last seconds are partial, so they're counted as one.
 	var count int64
-	if len(numReqsPerSecond) > 2 {
-		count = int64(len(numReqsPerSecond) - 1)
+	if seconds > 2 {
+		count = seconds - 1
 	} else {
-		count = int64(len(numReqsPerSecond))
+		count = seconds
 	}
 	if count != 0 {
 		currentRps = numRequests / count
@@ -224,14 +398,33 @@ func getCurrentRps(numRequests int64, numReqsPerSecond map[int64]int64) (current
 }
 
 func getCurrentFailPerSec(numFailures int64, numFailPerSecond map[int64]int64) (currentFailPerSec int64) {
+	return getFailPerSecOfSeconds(numFailures, int64(len(numFailPerSecond)))
+}
+
+func getFailPerSecOfSeconds(numFailures int64, seconds int64) (currentFailPerSec int64) {
 	currentFailPerSec = int64(0)
-	numFailPerSecondLength := int64(len(numFailPerSecond))
-	if numFailPerSecondLength != 0 {
-		currentFailPerSec = numFailures / numFailPerSecondLength
+	if seconds != 0 {
+		currentFailPerSec = numFailures / seconds
 	}
 	return currentFailPerSec
 }
 
+// getEntryRps returns the rps of entry, cumulative entries count their seconds instead of keeping all the per-second counts.
+func getEntryRps(entry *statsEntry) int64 {
+	if entry.NumSeconds > 0 {
+		return getRpsOfSeconds(entry.NumRequests, entry.NumSeconds)
+	}
+	return getCurrentRps(entry.NumRequests, entry.NumReqsPerSec)
+}
+
+// getEntryFailPerSec is like getEntryRps, but of failures.
+func getEntryFailPerSec(entry *statsEntry) int64 {
+	if entry.NumFailSeconds > 0 {
+		return getFailPerSecOfSeconds(entry.NumFailures, entry.NumFailSeconds)
+	}
+	return getCurrentFailPerSec(entry.NumFailures, entry.NumFailPerSec)
+}
+
 func getTotalFailRatio(totalRequests, totalFailures int64) (failRatio float64) {
 	if totalRequests == 0 {
 		return 0
@@ -239,11 +432,19 @@ func getTotalFailRatio(totalRequests, totalFailures int64) (failRatio float64) {
 	return float64(totalFailures) / float64(totalRequests)
 }
 
+// JsonFileOutput writes the stats of every report to OutputOptions.RealTimeResultPath, a line per report,
+// and rewrites OutputOptions.TotalResultPath with the stats since the start of the test.
 type JsonFileOutput struct {
+	options OutputOptions
+
+	lock  sync.Mutex
+	stats *statsAggregator
 }
 
+// NewJsonFileOutput returns a JsonFileOutput with a copy of OutputOps, it writes nothing without paths,
+// use NewJsonFileOutputWithOptions instead.
 func NewJsonFileOutput() *JsonFileOutput {
-	return &JsonFileOutput{}
+	return &JsonFileOutput{options: *OutputOps, stats: newStatsAggregator()}
 }
 
 func (o *JsonFileOutput) OnStart() {
@@ -255,7 +456,7 @@ func (o *JsonFileOutput) OnStop() {
 }
 
 func (o *JsonFileOutput) OnEvent(data map[string]interface{}) {
-	output, err := convertData(data)
+	output, err := convertDataWithPercentTime(data, o.options.percentTime())
 	if err != nil {
 		log.Println(fmt.Sprintf("convert data error: %v", err))
 		return
@@ -263,14 +464,15 @@ func (o *JsonFileOutput) OnEvent(data map[string]interface{}) {
 
 	output.Stats = sortOutput(output.Stats)
 
-	buildAllStats(output)
-	sortOutput(allStats.Stats)
-
 	currentTime := time.Now()
 	computerMonitor := GetCpuMem()
 
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	allStats := o.stats.cumulative(output, o.options.percentTime())
+
 	// 当前统计数据
-	if OutputOps.RealTimeResultPath != "" {
+	if o.options.RealTimeResultPath != "" {
 		realTimeResult := ResultData{
 			UserCount:      output.UserCount,
 			TotalRPS:       output.TotalRPS,
@@ -278,167 +480,178 @@ func (o *JsonFileOutput) OnEvent(data map[string]interface{}) {
 			//Errors:         output.Errors,
 		}
 		if output.TotalStats != nil {
-			realTimeResult.TotalStats = *output.TotalStats
-			realTimeResult.TotalStats.NumReqsPerSec = nil
-			realTimeResult.TotalStats.NumFailPerSec = nil
-			realTimeResult.TotalStats.ResponseTimes = nil
+			realTimeResult.TotalStats = withoutMaps(output.TotalStats)
 		}
 		if output.Stats != nil {
 			realTimeResult.Stats = []statsEntryOutput{}
 			for _, stat := range output.Stats {
-				temStat := *stat
-				temStat.NumFailPerSec = nil
-				temStat.NumReqsPerSec = nil
-				temStat.ResponseTimes = nil
-				realTimeResult.Stats = append(realTimeResult.Stats, temStat)
+				realTimeResult.Stats = append(realTimeResult.Stats, withoutMaps(stat))
 			}
 		}
+		for _, stat := range output.CorrectedStats {
+			realTimeResult.CorrectedStats = append(realTimeResult.CorrectedStats, withoutMaps(stat))
+		}
 		jsonOutPut := RealTimeJsonOutput{
 			CurrTime:   currentTime,
 			CurrResult: realTimeResult,
 			Monitor:    computerMonitor,
 		}
 		jsonStr, _ := json.Marshal(jsonOutPut)
-		AppendLineToFile(OutputOps.RealTimeResultPath, string(jsonStr))
+		AppendLineToFile(o.options.RealTimeResultPath, string(jsonStr))
 	}
 
 	// 累计统计数据
-	if OutputOps.TotalResultPath != "" && allStats != nil {
+	if o.options.TotalResultPath != "" {
 		totalResult := ResultData{
 			UserCount:      allStats.UserCount,
 			TotalRPS:       allStats.TotalRPS,
 			TotalFailRatio: allStats.TotalFailRatio,
+			TotalStats:     withoutMaps(allStats.TotalStats),
+			Stats:          []statsEntryOutput{},
 			Errors:         allStats.Errors,
 		}
-		if allStats.TotalStats != nil {
-			totalResult.TotalStats = *allStats.TotalStats
-			totalResult.TotalStats.NumFailPerSec = nil
-			totalResult.TotalStats.NumReqsPerSec = nil
-			totalResult.TotalStats.ResponseTimes = nil
-		}
-		if output.Stats != nil {
-			totalResult.Stats = []statsEntryOutput{}
-			for _, stat := range allStats.Stats {
-				temStat := *stat
-				temStat.NumFailPerSec = nil
-				temStat.NumReqsPerSec = nil
-				temStat.ResponseTimes = nil
-				totalResult.Stats = append(totalResult.Stats, temStat)
-			}
+		for _, stat := range allStats.Stats {
+			totalResult.Stats = append(totalResult.Stats, withoutMaps(stat))
 		}
 		totalOutput := TotalJsonOutput{
 			TotalData: totalResult,
 			CurrTime:  currentTime,
 		}
 		jsonStr, _ := json.Marshal(totalOutput)
-		WriteTextToFile(OutputOps.TotalResultPath, string(jsonStr))
+		WriteTextToFile(o.options.TotalResultPath, string(jsonStr))
 	}
 }
 
-var allStats *dataOutput
+// withoutMaps returns a copy of stat without the maps of seconds and response times, which are too large for files.
+func withoutMaps(stat *statsEntryOutput) statsEntryOutput {
+	result := *stat
+	result.NumReqsPerSec = nil
+	result.NumFailPerSec = nil
+	result.ResponseTimes = nil
+	result.ResponseTimesMicros = nil
+	return result
+}
 
-func buildAllStats(output *dataOutput) {
-	if allStats == nil {
-		allStats = new(dataOutput)
-	}
-	allStats.UserCount = output.UserCount
-
-	for _, oItem := range output.Stats {
-		hasItem := false
-		for _, aItem := range allStats.Stats {
-			if oItem.Name == aItem.Name {
-				aItem.NumRequests = aItem.NumRequests + oItem.NumRequests
-				aItem.NumFailures = aItem.NumFailures + oItem.NumFailures
-				if oItem.MaxResponseTime > aItem.MaxResponseTime {
-					aItem.MaxResponseTime = oItem.MaxResponseTime
-				}
-				if oItem.MinResponseTime < aItem.MinResponseTime {
-					aItem.MinResponseTime = oItem.MinResponseTime
-				}
-				aItem.TotalResponseTime = aItem.TotalResponseTime + oItem.TotalResponseTime
-				aItem.TotalContentLength = aItem.TotalContentLength + oItem.TotalContentLength
-				if aItem.NumRequests > 0 {
-					aItem.AvgContentLength = aItem.TotalContentLength / aItem.NumRequests
-				}
-				for key, value := range oItem.ResponseTimes {
-					if _, ok := aItem.ResponseTimes[key]; ok {
-						aItem.ResponseTimes[key] = aItem.ResponseTimes[key] + value
-					} else {
-						aItem.ResponseTimes[key] = value
-					}
-				}
-				for key, value := range oItem.NumReqsPerSec {
-					if _, ok := aItem.NumReqsPerSec[key]; ok {
-						aItem.NumReqsPerSec[key] = aItem.NumReqsPerSec[key] + value
-					} else {
-						aItem.NumReqsPerSec[key] = value
-					}
-				}
-				for key, value := range oItem.NumFailPerSec {
-					aItem.NumFailPerSec[key] = value
-				}
-				aItem.MedianResponseTime = getMedianResponseTime(aItem.NumRequests, aItem.ResponseTimes)
-				aItem.PercentResponseTime = getPercentResponseTime(aItem.NumRequests, aItem.ResponseTimes, OutputOps.PercentTime)
-				aItem.Percent95ResponseTime = getPercentResponseTime(aItem.NumRequests, aItem.ResponseTimes, 95)
-				aItem.AvgResponseTime = getAvgResponseTime(aItem.NumRequests, aItem.TotalResponseTime)
-				aItem.CurrentRps = getCurrentRps(aItem.NumRequests, aItem.NumReqsPerSec)
-				aItem.CurrentFailPerSec = getCurrentFailPerSec(aItem.NumFailures, aItem.NumFailPerSec)
-				hasItem = true
-				break
-			}
-		}
+// statsAggregator aggregates the stats of reports since the start of the test, every output has its own.
+// It's only used if the data doesn't have stats_cumulative, like data replayed from files.
+// It isn't safe for concurrent use.
+type statsAggregator struct {
+	// the stats since the start returned by the last call of cumulative
+	last      *dataOutput
+	userCount int32
+	// keyed by name + method like requestStats.entries
+	entries map[string]*statsEntry
+	total   *statsEntry
+	errors  map[string]map[string]interface{}
+	// examples of every report are capped by requestStats.errorExamples, so the most of them is the cap.
+	maxExamples int
+}
 
-		if !hasItem {
-			allStats.Stats = append(allStats.Stats, oItem)
-		}
+func newStatsAggregator() *statsAggregator {
+	return &statsAggregator{
+		entries: make(map[string]*statsEntry),
+		total:   newAggregatedEntry("Total", ""),
+		errors:  make(map[string]map[string]interface{}),
 	}
+}
 
-	if allStats.TotalStats == nil {
-		allStats.TotalStats = &statsEntryOutput{
-			statsEntry: statsEntry{
-				Name: "Total",
-			},
-		}
+// cumulative returns the stats since the start of the test, including output.
+func (a *statsAggregator) cumulative(output *dataOutput, percentTime int) *dataOutput {
+	if output.Cumulative != nil {
+		a.last = output.Cumulative
+	} else {
+		a.add(output)
+		a.last = a.dataOutput(percentTime)
 	}
-	//else {
-	allStats.TotalStats.NumRequests += output.TotalStats.NumRequests
-	allStats.TotalStats.NumFailures += output.TotalStats.NumFailures
-	//}
+	return a.last
+}
 
-	if allStats.Errors == nil {
-		allStats.Errors = map[string]map[string]interface{}{}
+// add merges output, which isn't referenced afterwards, so the data shared by outputs is never modified.
+// Like the cumulative stats of requestStats, the per-second counts don't grow with the test.
+func (a *statsAggregator) add(output *dataOutput) {
+	a.userCount = output.UserCount
+	for _, stat := range output.Stats {
+		key := stat.Name + stat.Method
+		entry, ok := a.entries[key]
+		if !ok {
+			entry = newAggregatedEntry(stat.Name, stat.Method)
+			a.entries[key] = entry
+		}
+		entry.accumulate(&stat.statsEntry)
+	}
+	if output.TotalStats != nil {
+		a.total.accumulate(&output.TotalStats.statsEntry)
 	}
-	for key, value := range output.Errors {
-		hasAdd := false
-		for key1, value1 := range allStats.Errors {
-			if key == key1 {
-				value1["occurrences"] = value1["occurrences"].(int64) + value["occurrences"].(int64)
-				hasAdd = true
+	for key, e := range output.Errors {
+		occurrences, _ := castToInt64(e["occurrences"])
+		aggregated, ok := a.errors[key]
+		if !ok {
+			aggregated = map[string]interface{}{
+				"method":      e["method"],
+				"name":        e["name"],
+				"error":       e["error"],
+				"occurrences": int64(0),
+			}
+			a.errors[key] = aggregated
+		}
+		aggregated["occurrences"] = aggregated["occurrences"].(int64) + occurrences
+
+		examples := errorExamples(e)
+		if len(examples) > a.maxExamples {
+			a.maxExamples = len(examples)
+		}
+		kept, _ := aggregated["examples"].([]string)
+		for _, example := range examples {
+			if len(kept) >= a.maxExamples {
 				break
 			}
+			if !containsString(kept, example) {
+				kept = append(kept, example)
+			}
 		}
-		if !hasAdd {
-			allStats.Errors[key] = value
+		if len(kept) > 0 {
+			aggregated["examples"] = kept
 		}
 	}
+}
 
-	if allStats.NumReqsPerSec == nil {
-		allStats.NumReqsPerSec = map[int64]int64{}
+// errorExamples returns the examples of a serialized error, which are decoded by msgpack as []interface{}.
+func errorExamples(e map[string]interface{}) []string {
+	switch examples := e["examples"].(type) {
+	case []string:
+		return examples
+	case []interface{}:
+		result := make([]string, 0, len(examples))
+		for _, example := range examples {
+			if example, ok := example.(string); ok {
+				result = append(result, example)
+			}
+		}
+		return result
 	}
+	return nil
+}
 
-	allStats.TotalRPS = 0
-	allStats.TotalRequestCount = 0
-	allStats.TotalFailedCount = 0
-	for _, aItem := range allStats.Stats {
-		allStats.TotalRPS = allStats.TotalRPS + aItem.CurrentRps
-		allStats.TotalRequestCount = allStats.TotalRequestCount + aItem.NumRequests
-		allStats.TotalFailedCount = allStats.TotalFailedCount + aItem.NumFailures
+// dataOutput returns the aggregated stats, the percentiles are calculated from the merged histograms.
+// The result shares the maps of the aggregator, so it must not be used after the next add.
+func (a *statsAggregator) dataOutput(percentTime int) *dataOutput {
+	total := newStatsEntryOutput(*a.total, percentTime)
+	output := &dataOutput{
+		UserCount:         a.userCount,
+		TotalStats:        total,
+		TotalRPS:          total.CurrentRps,
+		TotalFailRatio:    getTotalFailRatio(total.NumRequests, total.NumFailures),
+		Stats:             make([]*statsEntryOutput, 0, len(a.entries)),
+		Errors:            a.errors,
+		TotalRequestCount: total.NumRequests,
+		TotalFailedCount:  total.NumFailures,
+		NumReqsPerSec:     total.NumReqsPerSec,
 	}
-
-	//allStats.TotalStats
-	if allStats.TotalRequestCount != 0 {
-		allStats.TotalFailRatio = float64(allStats.TotalFailedCount) / float64(allStats.TotalRequestCount)
+	for _, entry := range a.entries {
+		output.Stats = append(output.Stats, newStatsEntryOutput(*entry, percentTime))
 	}
+	sortOutput(output.Stats)
+	return output
 }
 
 func sortOutput(stats []*statsEntryOutput) []*statsEntryOutput {
@@ -467,6 +680,12 @@ type statsEntryOutput struct {
 	AvgContentLength      int64   `json:"avg_content_length"`    // average content size
 	CurrentRps            int64   `json:"current_rps"`           // # reqs/sec
 	CurrentFailPerSec     int64   `json:"current_fail_per_sec"`  // # fails/sec
+
+	// percentiles in milliseconds from the latency histogram, zero if it's not enabled
+	P50ResponseTime  float64 `json:"p50_response_time,omitempty"`
+	P90ResponseTime  float64 `json:"p90_response_time,omitempty"`
+	P99ResponseTime  float64 `json:"p99_response_time,omitempty"`
+	P999ResponseTime float64 `json:"p999_response_time,omitempty"`
 }
 
 type dataOutput struct {
@@ -480,6 +699,15 @@ type dataOutput struct {
 	TotalRequestCount int64           `json:"total_request_count"`
 	TotalFailedCount  int64           `json:"total_failed_count"`
 	NumReqsPerSec     map[int64]int64 `json:"-"`
+
+	// iterations dropped by the arrival rate executor
+	DroppedIterations int64 `json:"dropped_iterations"`
+	// iterations still running after the drain timeout when boomer stops
+	AbandonedIterations int64 `json:"abandoned_iterations"`
+	// latencies of tasks from their intended starts, if the rate limiter or wait time is used
+	CorrectedStats []*statsEntryOutput `json:"stats_corrected,omitempty"`
+	// stats since the start of the test, nil if the data doesn't have stats_cumulative
+	Cumulative *dataOutput `json:"-"`
 }
 type DataOutputJson struct {
 	UserCount int32
@@ -491,7 +719,7 @@ type RealTimeJsonOutput struct {
 }
 type TotalJsonOutput struct {
 	TotalData ResultData `json:"total_result"`
-	CurrTime  time.Time  `json:"curr_time""`
+	CurrTime  time.Time  `json:"curr_time"`
 }
 
 type ResultData struct {
@@ -501,9 +729,15 @@ type ResultData struct {
 	TotalStats     statsEntryOutput                  `json:"stats_total"`
 	Stats          []statsEntryOutput                `json:"stats"`
 	Errors         map[string]map[string]interface{} `json:"errors"`
+	CorrectedStats []statsEntryOutput                `json:"stats_corrected,omitempty"`
 }
 
 func convertData(data map[string]interface{}) (output *dataOutput, err error) {
+	return convertDataWithPercentTime(data, defaultPercentTime)
+}
+
+// convertDataWithPercentTime is convertData, with percent_response_time of the percentile percentTime.
+func convertDataWithPercentTime(data map[string]interface{}, percentTime int) (output *dataOutput, err error) {
 	userCount, ok := data["user_count"].(int32)
 	if !ok {
 		return nil, fmt.Errorf("user_count is not int32")
@@ -518,34 +752,61 @@ func convertData(data map[string]interface{}) (output *dataOutput, err error) {
 	if !ok {
 		return nil, fmt.Errorf("stats_total is not interface{}")
 	}
-	entryTotalOutput, err := deserializeStatsEntry(statsTotal)
+	entryTotalOutput, err := deserializeStatsEntry(statsTotal, percentTime)
 	if err != nil {
 		return nil, err
 	}
-	errors := data["errors"].(map[string]map[string]interface{})
+	errors, _ := data["errors"].(map[string]map[string]interface{})
+	droppedIterations, _ := castToInt64(data["dropped_iterations"])
+	abandonedIterations, _ := castToInt64(data["abandoned_iterations"])
 
 	output = &dataOutput{
 		UserCount:      userCount,
 		TotalStats:     entryTotalOutput,
-		TotalRPS:       getCurrentRps(entryTotalOutput.NumRequests, entryTotalOutput.NumReqsPerSec),
+		TotalRPS:       entryTotalOutput.CurrentRps,
 		TotalFailRatio: getTotalFailRatio(entryTotalOutput.NumRequests, entryTotalOutput.NumFailures),
 		Stats:          make([]*statsEntryOutput, 0, len(stats)),
 		NumReqsPerSec:  entryTotalOutput.NumReqsPerSec,
 		Errors:         errors,
+
+		DroppedIterations:   droppedIterations,
+		AbandonedIterations: abandonedIterations,
 	}
 
 	// convert stats
 	for _, stat := range stats {
-		entryOutput, err := deserializeStatsEntry(stat)
+		entryOutput, err := deserializeStatsEntry(stat, percentTime)
 		if err != nil {
 			return nil, err
 		}
 		output.Stats = append(output.Stats, entryOutput)
 	}
+
+	if cumulative, ok := data["stats_cumulative"].(map[string]interface{}); ok {
+		cumulativeData := map[string]interface{}{"user_count": userCount}
+		for k, v := range cumulative {
+			cumulativeData[k] = v
+		}
+		if output.Cumulative, err = convertDataWithPercentTime(cumulativeData, percentTime); err != nil {
+			return nil, err
+		}
+		output.Cumulative.Stats = sortOutput(output.Cumulative.Stats)
+		output.Cumulative.TotalRequestCount = output.Cumulative.TotalStats.NumRequests
+		output.Cumulative.TotalFailedCount = output.Cumulative.TotalStats.NumFailures
+	}
+
+	corrected, _ := data["stats_corrected"].([]interface{})
+	for _, stat := range corrected {
+		entryOutput, err := deserializeStatsEntry(stat, percentTime)
+		if err != nil {
+			return nil, err
+		}
+		output.CorrectedStats = append(output.CorrectedStats, entryOutput)
+	}
 	return
 }
 
-func deserializeStatsEntry(stat interface{}) (entryOutput *statsEntryOutput, err error) {
+func deserializeStatsEntry(stat interface{}, percentTime int) (entryOutput *statsEntryOutput, err error) {
 	statBytes, err := json.Marshal(stat)
 	if err != nil {
 		return nil, err
@@ -555,18 +816,26 @@ func deserializeStatsEntry(stat interface{}) (entryOutput *statsEntryOutput, err
 		return nil, err
 	}
 
+	return newStatsEntryOutput(entry, percentTime), nil
+}
+
+// newStatsEntryOutput calculates the fields for output of entry, percent_response_time is of the percentile percentTime.
+func newStatsEntryOutput(entry statsEntry, percentTime int) *statsEntryOutput {
 	numRequests := entry.NumRequests
-	entryOutput = &statsEntryOutput{
+	return &statsEntryOutput{
 		statsEntry:            entry,
 		MedianResponseTime:    getMedianResponseTime(numRequests, entry.ResponseTimes),
-		PercentResponseTime:   getPercentResponseTime(numRequests, entry.ResponseTimes, OutputOps.PercentTime),
+		PercentResponseTime:   getPercentResponseTime(numRequests, entry.ResponseTimes, percentTime),
 		Percent95ResponseTime: getPercentResponseTime(numRequests, entry.ResponseTimes, 95),
 		AvgResponseTime:       getAvgResponseTime(numRequests, entry.TotalResponseTime),
 		AvgContentLength:      getAvgContentLength(numRequests, entry.TotalContentLength),
-		CurrentRps:            getCurrentRps(numRequests, entry.NumReqsPerSec),
-		CurrentFailPerSec:     getCurrentFailPerSec(entry.NumFailures, entry.NumFailPerSec),
+		CurrentRps:            getEntryRps(&entry),
+		CurrentFailPerSec:     getEntryFailPerSec(&entry),
+		P50ResponseTime:       getPercentileFromMicros(entry.ResponseTimesMicros, 50),
+		P90ResponseTime:       getPercentileFromMicros(entry.ResponseTimesMicros, 90),
+		P99ResponseTime:       getPercentileFromMicros(entry.ResponseTimesMicros, 99),
+		P999ResponseTime:      getPercentileFromMicros(entry.ResponseTimesMicros, 99.9),
 	}
-	return
 }
 
 const (
@@ -649,6 +918,42 @@ var (
 	)
 )
 
+// gauges for corrected latencies, which aren't requests
+var (
+	gaugeCorrectedMedianResponseTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "corrected_median_response_time",
+			Help:      "The median response time from the intended start of tasks",
+		},
+		[]string{"method", "name"},
+	)
+	gaugeCorrectedAverageResponseTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "corrected_average_response_time",
+			Help:      "The average response time from the intended start of tasks",
+		},
+		[]string{"method", "name"},
+	)
+	gaugeCorrectedMinResponseTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "corrected_min_response_time",
+			Help:      "The min response time from the intended start of tasks",
+		},
+		[]string{"method", "name"},
+	)
+	gaugeCorrectedMaxResponseTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "corrected_max_response_time",
+			Help:      "The max response time from the intended start of tasks",
+		},
+		[]string{"method", "name"},
+	)
+)
+
 // gauges for total
 var (
 	gaugeUsers = prometheus.NewGauge(
@@ -701,6 +1006,11 @@ func (o *PrometheusPusherOutput) OnStart() {
 		gaugeAverageContentLength,
 		gaugeCurrentRPS,
 		gaugeCurrentFailPerSec,
+		// gauge vectors for corrected latencies
+		gaugeCorrectedMedianResponseTime,
+		gaugeCorrectedAverageResponseTime,
+		gaugeCorrectedMinResponseTime,
+		gaugeCorrectedMaxResponseTime,
 		// gauges for total
 		gaugeUsers,
 		gaugeTotalRPS,
@@ -745,6 +1055,15 @@ func (o *PrometheusPusherOutput) OnEvent(data map[string]interface{}) {
 		gaugeCurrentFailPerSec.WithLabelValues(method, name).Set(float64(stat.CurrentFailPerSec))
 	}
 
+	for _, stat := range output.CorrectedStats {
+		method := stat.Method
+		name := stat.Name
+		gaugeCorrectedMedianResponseTime.WithLabelValues(method, name).Set(float64(stat.MedianResponseTime))
+		gaugeCorrectedAverageResponseTime.WithLabelValues(method, name).Set(float64(stat.AvgResponseTime))
+		gaugeCorrectedMinResponseTime.WithLabelValues(method, name).Set(float64(stat.MinResponseTime))
+		gaugeCorrectedMaxResponseTime.WithLabelValues(method, name).Set(float64(stat.MaxResponseTime))
+	}
+
 	if err := o.pusher.Push(); err != nil {
 		log.Println(fmt.Sprintf("Could not push to Pushgateway: error: %v", err))
 	}
@@ -1,7 +1,14 @@
 package boomer
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -70,9 +77,33 @@ func TestGetCurrentRps(t *testing.T) {
 	numReqsPerSecond[3] = 2
 	numReqsPerSecond[4] = 3
 
+	// the first and the last seconds of a report are partial, they're about a second together,
+	// so 10 requests are made in 3 seconds
 	currentRps = getCurrentRps(numRequests, numReqsPerSecond)
-	if currentRps != 2 {
-		t.Error("CurrentRps should be 2")
+	if currentRps != 3 {
+		t.Error("CurrentRps should be 3")
+	}
+}
+
+func TestGetPercentileFromMicros(t *testing.T) {
+	responseTimesMicros := map[int64]int64{
+		150:  500,
+		900:  490,
+		5000: 9,
+		9000: 1,
+	}
+
+	if p := getPercentileFromMicros(responseTimesMicros, 50); p != 0.15 {
+		t.Error("P50 should be 0.15, got:", p)
+	}
+	if p := getPercentileFromMicros(responseTimesMicros, 99); p != 0.9 {
+		t.Error("P99 should be 0.9, got:", p)
+	}
+	if p := getPercentileFromMicros(responseTimesMicros, 99.9); p != 5 {
+		t.Error("P99.9 should be 5, got:", p)
+	}
+	if p := getPercentileFromMicros(map[int64]int64{}, 99); p != 0 {
+		t.Error("Percentile of an empty histogram should be 0, got:", p)
 	}
 }
 
@@ -109,3 +140,232 @@ func TestConsoleOutput(t *testing.T) {
 
 	o.OnStop()
 }
+
+func TestConvertDataWithCorrectedStats(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	newStats.recordCorrectedLatency("task", 120000)
+	newStats.droppedIterations = 3
+	data := newStats.collectReportData()
+	data["user_count"] = int32(1)
+
+	output, err := convertData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.CorrectedStats) != 1 {
+		t.Fatal("len(CorrectedStats) is wrong, expected: 1, got:", len(output.CorrectedStats))
+	}
+	if output.CorrectedStats[0].Method != "corrected" || output.CorrectedStats[0].MaxResponseTime != 120 {
+		t.Error("Corrected stats is wrong, got:", output.CorrectedStats[0].Method, output.CorrectedStats[0].MaxResponseTime)
+	}
+	if output.DroppedIterations != 3 {
+		t.Error("DroppedIterations is wrong, expected: 3, got:", output.DroppedIterations)
+	}
+}
+
+func TestCompactConsoleOutput(t *testing.T) {
+	o := NewCompactConsoleOutput()
+	o.OnStart()
+	o.OnEvent(newTestReportData())
+	o.OnStop()
+}
+
+func TestAggregatedRow(t *testing.T) {
+	output, err := convertData(newTestReportData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := aggregatedRow(output.TotalStats)
+	if total.Name != "Aggregated" || output.TotalStats.Name != "Total" {
+		t.Error("Name is wrong, expected: Aggregated, got:", total.Name, output.TotalStats.Name)
+	}
+	if total.NumRequests != 3 || total.NumFailures != 1 {
+		t.Error("Requests or failures are wrong, got:", total.NumRequests, total.NumFailures)
+	}
+	if total.MinResponseTime != 10 || total.MaxResponseTime != 200 {
+		t.Error("Min or max response time is wrong, got:", total.MinResponseTime, total.MaxResponseTime)
+	}
+	if total.MedianResponseTime != 30 {
+		t.Error("Median response time is wrong, expected: 30, got:", total.MedianResponseTime)
+	}
+
+	row := consoleStatsRow(total)
+	if row[1] != "Aggregated" || row[2] != "3" || row[3] != "1" {
+		t.Error("Row is wrong, got:", row)
+	}
+}
+
+func TestJsonFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boomer-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &OutputOptions{
+		PercentTime:        50,
+		RealTimeResultPath: filepath.Join(dir, "realtime50.json"),
+		TotalResultPath:    filepath.Join(dir, "total50.json"),
+	}
+	o50 := NewJsonFileOutputWithOptions(options)
+	// the options are copied, other outputs aren't affected
+	options.PercentTime = 0
+	options.RealTimeResultPath = ""
+	options.TotalResultPath = filepath.Join(dir, "total90.json")
+	o90 := NewJsonFileOutputWithOptions(options)
+	if NewConsoleOutput().options.PercentTime != 0 {
+		t.Error("Options of ConsoleOutput are affected by JsonFileOutput")
+	}
+
+	// the second report has the cumulative stats of both reports
+	stats := newRequestStats()
+	var reports []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		stats.recordSuccess("http", "login", 10, 0, 100)
+		stats.recordSuccess("http", "login", 200, 0, 100)
+		stats.recordSuccess("http", "home", 30, 0, 500)
+		stats.logError("http", "home", "timeout|500")
+		data := stats.collectReportData()
+		data["user_count"] = int32(5)
+		reports = append(reports, data)
+	}
+	var wg sync.WaitGroup
+	for _, o := range []*JsonFileOutput{o50, o90} {
+		wg.Add(1)
+		go func(o *JsonFileOutput) {
+			defer wg.Done()
+			for _, data := range reports {
+				o.OnEvent(data)
+			}
+		}(o)
+	}
+	wg.Wait()
+
+	for _, e := range reports[0]["errors"].(map[string]map[string]interface{}) {
+		if e["occurrences"] != int64(1) {
+			t.Error("Errors of the shared data are modified, got:", e["occurrences"])
+		}
+	}
+
+	readTotal := func(path string) ResultData {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total TotalJsonOutput
+		if err := json.Unmarshal(content, &total); err != nil {
+			t.Fatal(err)
+		}
+		return total.TotalData
+	}
+	total50, total90 := readTotal(filepath.Join(dir, "total50.json")), readTotal(filepath.Join(dir, "total90.json"))
+	if total50.TotalStats.NumRequests != 6 || total50.TotalStats.NumFailures != 2 {
+		t.Error("Requests or failures of the total are wrong, got:", total50.TotalStats.NumRequests, total50.TotalStats.NumFailures)
+	}
+	if total50.TotalStats.MaxResponseTime != 200 || total50.TotalStats.MedianResponseTime != 30 {
+		t.Error("Latency of the total is wrong, got:", total50.TotalStats.MaxResponseTime, total50.TotalStats.MedianResponseTime)
+	}
+	if len(total50.Stats) != 2 || total50.Stats[1].Name != "login" || total50.Stats[1].NumRequests != 4 {
+		t.Fatal("Stats are wrong, got:", total50.Stats)
+	}
+	// percentiles of the merged histogram of 10, 10, 200, 200
+	if total50.Stats[1].PercentResponseTime != 10 || total90.Stats[1].PercentResponseTime != 200 {
+		t.Error("Percent response time is wrong, got:", total50.Stats[1].PercentResponseTime, total90.Stats[1].PercentResponseTime)
+	}
+	for _, e := range total90.Errors {
+		if e["occurrences"] != float64(2) {
+			t.Error("Occurrences are wrong, expected: 2, got:", e["occurrences"])
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "realtime50.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 2 {
+		t.Error("Lines of the real time file are wrong, expected: 2, got:", lines)
+	}
+}
+
+func TestConvertDataCumulative(t *testing.T) {
+	output, err := convertData(newTestReportData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Cumulative == nil || output.Cumulative.UserCount != 5 || output.Cumulative.TotalRequestCount != 3 {
+		t.Fatal("Cumulative stats are wrong, got:", output.Cumulative)
+	}
+
+	// stats are aggregated by outputs without stats_cumulative
+	aggregator := newStatsAggregator()
+	for i := 0; i < 2; i++ {
+		data := newTestReportData()
+		delete(data, "stats_cumulative")
+		output, err := convertData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregator.cumulative(output, defaultPercentTime)
+	}
+	if aggregator.last.TotalStats.NumRequests != 6 || aggregator.last.TotalFailedCount != 2 {
+		t.Error("Aggregated stats are wrong, got:", aggregator.last.TotalStats.NumRequests, aggregator.last.TotalFailedCount)
+	}
+	if aggregator.last.Stats[1].Name != "login" || aggregator.last.Stats[1].PercentResponseTime != 200 {
+		t.Error("Aggregated login is wrong, got:", aggregator.last.Stats[1])
+	}
+	// the seconds are counted instead of keeping the per-second counts of every report
+	if len(aggregator.total.NumReqsPerSec) > 1 || aggregator.total.NumSeconds == 0 {
+		t.Error("Per-second counts of the aggregated stats are wrong, got:", aggregator.total.NumReqsPerSec, aggregator.total.NumSeconds)
+	}
+}
+
+func TestStatsAggregatorErrorExamples(t *testing.T) {
+	aggregator := newStatsAggregator()
+	for _, examples := range [][]string{{"GET /users/1001: timeout"}, {"GET /users/1002: timeout", "GET /users/1003: timeout"}} {
+		stats := newRequestStats()
+		stats.errorExamples = 2
+		stats.errorNormalizers = []ErrorNormalizer{IDErrorNormalizer}
+		for _, example := range examples {
+			stats.recordError("http", "users", 10, 0, errors.New(example))
+		}
+		data := stats.collectReportData()
+		data["user_count"] = int32(1)
+		delete(data, "stats_cumulative")
+		output, err := convertData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregator.cumulative(output, defaultPercentTime)
+	}
+
+	errs := sortErrors(aggregator.last.Errors)
+	if len(errs) != 1 || errs[0].occurrences != 3 {
+		t.Fatal("Aggregated errors are wrong, got:", aggregator.last.Errors)
+	}
+	// the examples are kept up to the cap of the reports
+	if len(errs[0].examples) != 2 || errs[0].examples[0] != "GET /users/1001: timeout" || errs[0].examples[1] != "GET /users/1002: timeout" {
+		t.Error("Aggregated examples are wrong, got:", errs[0].examples)
+	}
+}
+
+func TestDeprecatedOutputOps(t *testing.T) {
+	defer func(ops OutputOptions) { *OutputOps = ops }(*OutputOps)
+
+	// outputs without options copy OutputOps when they're created
+	OutputOps.PercentTime = 95
+	o := NewJsonFileOutput()
+	OutputOps.PercentTime = 99
+	if o.options.PercentTime != 95 {
+		t.Error("PercentTime of the output is wrong, expected: 95, got:", o.options.PercentTime)
+	}
+	if c := NewConsoleOutput(); c.options.PercentTime != 99 {
+		t.Error("PercentTime of the output is wrong, expected: 99, got:", c.options.PercentTime)
+	}
+
+	// outputs with options don't change OutputOps
+	NewConsoleOutputWithOptions(&OutputOptions{PercentTime: 50})
+	if OutputOps.PercentTime != 99 {
+		t.Error("OutputOps shouldn't be changed, expected: 99, got:", OutputOps.PercentTime)
+	}
+}
@@ -0,0 +1,277 @@
+package boomer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runnerStates are exposed by PrometheusExporterOutput as boomer_state{state="..."}.
+var runnerStates = []string{stateInit, stateSpawning, stateRunning, stateStopping, stateStopped, stateQuitting}
+
+// startedExporters are the started PrometheusExporterOutputs. Their state follows the events of the runner,
+// because in distributed mode, no stats are reported when the runner is ready or stopped.
+var (
+	startedExporters      = make(map[*PrometheusExporterOutput]bool)
+	startedExportersLock  sync.Mutex
+	subscribeExporterOnce sync.Once
+)
+
+// setExportersState sets the state of all the started PrometheusExporterOutputs.
+func setExportersState(state string) {
+	startedExportersLock.Lock()
+	defer startedExportersLock.Unlock()
+	for o := range startedExporters {
+		o.setState(state)
+	}
+}
+
+// subscribeExporterEvents subscribes the events which change the state of the runner once,
+// so outputs don't need to unsubscribe.
+func subscribeExporterEvents() {
+	Events.Subscribe(EVENT_CONNECTED, func() {
+		setExportersState(stateInit)
+	})
+	Events.Subscribe(EVENT_SPAWN, func(users int, spawnRate float64) {
+		setExportersState(stateSpawning)
+	})
+	Events.Subscribe(EVENT_STOP, func() {
+		setExportersState(stateStopped)
+	})
+	Events.Subscribe(EVENT_QUIT, func() {
+		setExportersState(stateQuitting)
+	})
+}
+
+// PrometheusExporterOutput serves boomer stats on /metrics for Prometheus to scrape, it doesn't need a Pushgateway.
+//
+// Unlike PrometheusPusherOutput, it has its own registry, so more than one of them can be used in a process.
+// Requests and failures are exposed as counters, and response times as histograms in seconds,
+// which are aggregated since the start of the test. So rate() and histogram_quantile() work as usual.
+// Latencies from the intended starts of tasks are in their own histogram, boomer_corrected_response_time_seconds,
+// they aren't counted in the requests.
+type PrometheusExporterOutput struct {
+	addr    string
+	buckets []float64
+
+	registry *prometheus.Registry
+	listener net.Listener
+	server   *http.Server
+
+	requests *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	users    prometheus.Gauge
+	state    *prometheus.GaugeVec
+
+	lock                sync.Mutex
+	histograms          map[[2]string]*exporterHistogram
+	correctedHistograms map[[2]string]*exporterHistogram
+	desc                *prometheus.Desc
+	correctedDesc       *prometheus.Desc
+}
+
+// exporterHistogram is a histogram of response times of a request, the counts aren't cumulative.
+type exporterHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewPrometheusExporterOutput returns a PrometheusExporterOutput, which serves /metrics on addr, like ":9646".
+// Buckets of the histogram of response times are in seconds, prometheus.DefBuckets is used if it's empty.
+func NewPrometheusExporterOutput(addr string, buckets ...float64) *PrometheusExporterOutput {
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	o := &PrometheusExporterOutput{
+		addr:                addr,
+		buckets:             buckets,
+		registry:            prometheus.NewRegistry(),
+		histograms:          make(map[[2]string]*exporterHistogram),
+		correctedHistograms: make(map[[2]string]*exporterHistogram),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "requests_total",
+				Help:      "The number of requests",
+			},
+			[]string{"method", "name"},
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "failures_total",
+				Help:      "The number of failures",
+			},
+			[]string{"method", "name"},
+		),
+		users: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "users",
+				Help:      "The current number of users",
+			},
+		),
+		state: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "state",
+				Help:      "The state of the runner, the gauge of the current state is 1",
+			},
+			[]string{"state"},
+		),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "response_time_seconds"),
+			"The response times of requests",
+			[]string{"method", "name"}, nil,
+		),
+		correctedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "corrected_response_time_seconds"),
+			"The response times of requests from the intended starts of tasks, if the rate limiter or wait time is used",
+			[]string{"method", "name"}, nil,
+		),
+	}
+	o.registry.MustRegister(o.requests, o.failures, o.users, o.state, o)
+	return o
+}
+
+// Describe implements prometheus.Collector for the histograms.
+func (o *PrometheusExporterOutput) Describe(ch chan<- *prometheus.Desc) {
+	ch <- o.desc
+	ch <- o.correctedDesc
+}
+
+// Collect implements prometheus.Collector for the histograms.
+func (o *PrometheusExporterOutput) Collect(ch chan<- prometheus.Metric) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.collectHistograms(ch, o.desc, o.histograms)
+	o.collectHistograms(ch, o.correctedDesc, o.correctedHistograms)
+}
+
+func (o *PrometheusExporterOutput) collectHistograms(ch chan<- prometheus.Metric, desc *prometheus.Desc, histograms map[[2]string]*exporterHistogram) {
+	for labels, histogram := range histograms {
+		buckets := make(map[float64]uint64, len(o.buckets))
+		cumulative := uint64(0)
+		for i, upperBound := range o.buckets {
+			cumulative += histogram.counts[i]
+			buckets[upperBound] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(desc, histogram.count, histogram.sum, buckets, labels[0], labels[1])
+	}
+}
+
+// OnStart starts serving /metrics.
+func (o *PrometheusExporterOutput) OnStart() {
+	o.setState(stateInit)
+	subscribeExporterOnce.Do(subscribeExporterEvents)
+	startedExportersLock.Lock()
+	startedExporters[o] = true
+	startedExportersLock.Unlock()
+
+	listener, err := net.Listen("tcp", o.addr)
+	if err != nil {
+		log.Printf("Failed to serve prometheus metrics on %s, %v\n", o.addr, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(o.registry, promhttp.HandlerOpts{}))
+	o.listener = listener
+	o.server = &http.Server{Handler: mux}
+	log.Printf("Serving prometheus metrics on %s/metrics\n", listener.Addr())
+	go func() {
+		if err := o.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Failed to serve prometheus metrics, %v\n", err)
+		}
+	}()
+}
+
+// OnStop stops serving /metrics.
+func (o *PrometheusExporterOutput) OnStop() {
+	startedExportersLock.Lock()
+	delete(startedExporters, o)
+	startedExportersLock.Unlock()
+
+	if o.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop serving prometheus metrics, %v\n", err)
+	}
+}
+
+// OnEvent adds data to the metrics.
+func (o *PrometheusExporterOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+
+	o.users.Set(float64(output.UserCount))
+	if state, ok := data["state"].(string); ok {
+		o.setState(state)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, stat := range output.Stats {
+		o.requests.WithLabelValues(stat.Method, stat.Name).Add(float64(stat.NumRequests))
+		o.failures.WithLabelValues(stat.Method, stat.Name).Add(float64(stat.NumFailures))
+		o.observe(o.histograms, stat)
+	}
+	for _, stat := range output.CorrectedStats {
+		o.observe(o.correctedHistograms, stat)
+	}
+}
+
+// setState sets the gauge of state to 1, and the others to 0.
+func (o *PrometheusExporterOutput) setState(state string) {
+	for _, s := range runnerStates {
+		value := float64(0)
+		if s == state {
+			value = 1
+		}
+		o.state.WithLabelValues(s).Set(value)
+	}
+}
+
+// observe adds the response times of stat to its histogram in histograms.
+func (o *PrometheusExporterOutput) observe(histograms map[[2]string]*exporterHistogram, stat *statsEntryOutput) {
+	labels := [2]string{stat.Method, stat.Name}
+	histogram, ok := histograms[labels]
+	if !ok {
+		histogram = &exporterHistogram{counts: make([]uint64, len(o.buckets))}
+		histograms[labels] = histogram
+	}
+	for responseTime, count := range stat.ResponseTimes {
+		seconds := float64(responseTime) / 1000
+		// response times greater than the last bucket are only counted in +Inf
+		if i := sort.SearchFloat64s(o.buckets, seconds); i < len(o.buckets) {
+			histogram.counts[i] += uint64(count)
+		}
+		histogram.count += uint64(count)
+	}
+	histogram.sum += float64(stat.TotalResponseTime) / 1000
+}
+
+// listenAddr returns the address /metrics is served on, it's useful if the port is 0.
+func (o *PrometheusExporterOutput) listenAddr() string {
+	if o.listener == nil {
+		return ""
+	}
+	return o.listener.Addr().String()
+}
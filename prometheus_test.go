@@ -0,0 +1,99 @@
+package boomer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T, o *PrometheusExporterOutput) string {
+	resp, err := http.Get("http://" + o.listenAddr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPrometheusExporterOutput(t *testing.T) {
+	o := NewPrometheusExporterOutput("127.0.0.1:0", 0.05, 0.5)
+	o.OnStart()
+	defer o.OnStop()
+
+	data := newTestReportData()
+	data["state"] = stateRunning
+	o.OnEvent(data)
+	o.OnEvent(newTestReportData())
+
+	metrics := scrapeMetrics(t, o)
+	assert.Contains(t, metrics, `boomer_requests_total{method="http",name="login"} 4`)
+	assert.Contains(t, metrics, `boomer_failures_total{method="http",name="home"} 2`)
+	assert.Contains(t, metrics, `boomer_users 5`)
+	assert.Contains(t, metrics, `boomer_state{state="running"} 1`)
+	assert.Contains(t, metrics, `boomer_state{state="stopped"} 0`)
+	assert.Contains(t, metrics, `boomer_response_time_seconds_bucket{method="http",name="login",le="0.05"} 2`)
+	assert.Contains(t, metrics, `boomer_response_time_seconds_bucket{method="http",name="login",le="0.5"} 4`)
+	assert.Contains(t, metrics, `boomer_response_time_seconds_bucket{method="http",name="login",le="+Inf"} 4`)
+	assert.Contains(t, metrics, `boomer_response_time_seconds_sum{method="http",name="login"} 0.42`)
+	assert.Contains(t, metrics, `boomer_response_time_seconds_count{method="http",name="login"} 4`)
+}
+
+func TestPrometheusExporterOutputStateEvents(t *testing.T) {
+	o := NewPrometheusExporterOutput("127.0.0.1:0")
+	o.OnStart()
+	defer o.OnStop()
+
+	// in distributed mode, no stats are reported when the runner is ready or stopped.
+	assert.Contains(t, scrapeMetrics(t, o), `boomer_state{state="ready"} 1`)
+
+	Events.Publish(EVENT_SPAWN, 10, float64(0))
+	assert.Contains(t, scrapeMetrics(t, o), `boomer_state{state="spawning"} 1`)
+
+	Events.Publish(EVENT_STOP)
+	metrics := scrapeMetrics(t, o)
+	assert.Contains(t, metrics, `boomer_state{state="stopped"} 1`)
+	assert.Contains(t, metrics, `boomer_state{state="spawning"} 0`)
+
+	Events.Publish(EVENT_CONNECTED)
+	assert.Contains(t, scrapeMetrics(t, o), `boomer_state{state="ready"} 1`)
+}
+
+func TestPrometheusExporterOutputCorrectedStats(t *testing.T) {
+	o := NewPrometheusExporterOutput("127.0.0.1:0", 0.05, 0.5)
+	o.OnStart()
+	defer o.OnStop()
+
+	stats := newRequestStats()
+	stats.recordSuccess("http", "login", 20, 0, 10)
+	stats.recordCorrectedLatency("task", 120000)
+	data := stats.collectReportData()
+	data["user_count"] = int32(1)
+	o.OnEvent(data)
+
+	metrics := scrapeMetrics(t, o)
+	assert.Contains(t, metrics, `boomer_requests_total{method="http",name="login"} 1`)
+	assert.NotContains(t, metrics, `boomer_requests_total{method="corrected"`)
+	assert.NotContains(t, metrics, `boomer_response_time_seconds_count{method="corrected"`)
+	assert.Contains(t, metrics, `boomer_corrected_response_time_seconds_bucket{method="corrected",name="task",le="0.5"} 1`)
+	assert.Contains(t, metrics, `boomer_corrected_response_time_seconds_count{method="corrected",name="task"} 1`)
+}
+
+func TestPrometheusExporterOutputInstances(t *testing.T) {
+	o1 := NewPrometheusExporterOutput("127.0.0.1:0")
+	o2 := NewPrometheusExporterOutput("127.0.0.1:0")
+	o1.OnStart()
+	defer o1.OnStop()
+	o2.OnStart()
+	defer o2.OnStop()
+
+	o1.OnEvent(newTestReportData())
+
+	assert.Contains(t, scrapeMetrics(t, o1), `boomer_requests_total{method="http",name="login"} 2`)
+	assert.NotContains(t, scrapeMetrics(t, o2), `boomer_requests_total`)
+}
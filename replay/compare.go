@@ -0,0 +1,165 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Tolerance is how much worse a request can be in the head run than in the base run,
+// before it's a regression.
+type Tolerance struct {
+	// Latency is the ratio of increase of the avg, median, p95 and p99 response times, like 0.1 for 10%.
+	Latency float64
+	// RPS is the ratio of decrease of requests per second.
+	RPS float64
+	// FailRatio is the increase of the ratio of failed requests, like 0.01 for 1 percentage point.
+	FailRatio float64
+}
+
+// Delta is the difference of requests of a type and name between two runs.
+type Delta struct {
+	Name   string
+	Method string
+	// Base or Head is nil if there aren't such requests in the run.
+	Base *Entry
+	Head *Entry
+	// Regressions describe the metrics worse than the tolerance, like "p95 120ms -> 180ms (+50.0%)".
+	Regressions []string
+}
+
+// Comparison is the differences of all the requests between two runs.
+type Comparison struct {
+	Deltas []*Delta
+}
+
+// Compare compares the stats of requests in head with base, they're usually the total of runs.
+func Compare(base, head *Report, tolerance Tolerance) *Comparison {
+	c := &Comparison{}
+	deltas := make(map[string]*Delta)
+	getDelta := func(e *Entry) *Delta {
+		key := e.Method + " " + e.Name
+		d, ok := deltas[key]
+		if !ok {
+			d = &Delta{Name: e.Name, Method: e.Method}
+			deltas[key] = d
+			c.Deltas = append(c.Deltas, d)
+		}
+		return d
+	}
+	for i := range base.Stats {
+		getDelta(&base.Stats[i]).Base = &base.Stats[i]
+	}
+	for i := range head.Stats {
+		getDelta(&head.Stats[i]).Head = &head.Stats[i]
+	}
+	sort.Slice(c.Deltas, func(i, j int) bool {
+		if c.Deltas[i].Name != c.Deltas[j].Name {
+			return c.Deltas[i].Name < c.Deltas[j].Name
+		}
+		return c.Deltas[i].Method < c.Deltas[j].Method
+	})
+	for _, d := range c.Deltas {
+		d.check(tolerance)
+	}
+	return c
+}
+
+func (d *Delta) check(tolerance Tolerance) {
+	if d.Base == nil || d.Head == nil {
+		return
+	}
+	latencies := []struct {
+		metric     string
+		base, head float64
+	}{
+		{"avg", d.Base.AvgResponseTime, d.Head.AvgResponseTime},
+		{"median", float64(d.Base.MedianResponseTime), float64(d.Head.MedianResponseTime)},
+		{"p95", float64(d.Base.Percent95ResponseTime), float64(d.Head.Percent95ResponseTime)},
+		{"p99", d.Base.P99ResponseTime, d.Head.P99ResponseTime},
+	}
+	for _, l := range latencies {
+		if l.base > 0 && l.head > l.base*(1+tolerance.Latency) {
+			d.Regressions = append(d.Regressions, fmt.Sprintf("%s %sms -> %sms (%s)",
+				l.metric, formatFloat(l.base), formatFloat(l.head), formatChange(l.base, l.head)))
+		}
+	}
+
+	baseRps, headRps := float64(d.Base.CurrentRps), float64(d.Head.CurrentRps)
+	if baseRps > 0 && headRps < baseRps*(1-tolerance.RPS) {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("rps %s -> %s (%s)",
+			formatFloat(baseRps), formatFloat(headRps), formatChange(baseRps, headRps)))
+	}
+
+	baseFailRatio, headFailRatio := d.Base.FailRatio(), d.Head.FailRatio()
+	if headFailRatio-baseFailRatio > tolerance.FailRatio {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("fail ratio %.2f%% -> %.2f%%",
+			baseFailRatio*100, headFailRatio*100))
+	}
+}
+
+// Regressed returns true if any request is worse than the tolerance.
+func (c *Comparison) Regressed() bool {
+	for _, d := range c.Deltas {
+		if len(d.Regressions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Print prints a table of the differences of requests, and the regressions.
+func (c *Comparison) Print(w io.Writer) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Type", "Name", "Median", "P95", "Average", "# reqs/sec", "Fail ratio", "Result"})
+	for _, d := range c.Deltas {
+		row := []string{d.Method, d.Name}
+		switch {
+		case d.Base == nil:
+			row = append(row, "", "", "", "", "", "new")
+		case d.Head == nil:
+			row = append(row, "", "", "", "", "", "missing")
+		default:
+			row = append(row,
+				formatDelta(float64(d.Base.MedianResponseTime), float64(d.Head.MedianResponseTime)),
+				formatDelta(float64(d.Base.Percent95ResponseTime), float64(d.Head.Percent95ResponseTime)),
+				formatDelta(d.Base.AvgResponseTime, d.Head.AvgResponseTime),
+				formatDelta(float64(d.Base.CurrentRps), float64(d.Head.CurrentRps)),
+				fmt.Sprintf("%.2f%% -> %.2f%%", d.Base.FailRatio()*100, d.Head.FailRatio()*100),
+			)
+			if len(d.Regressions) > 0 {
+				row = append(row, "REGRESSION")
+			} else {
+				row = append(row, "ok")
+			}
+		}
+		table.Append(row)
+	}
+	table.Render()
+
+	for _, d := range c.Deltas {
+		for _, r := range d.Regressions {
+			fmt.Fprintf(w, "Regression of %s %s: %s\n", d.Method, d.Name, r)
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatChange formats the change from base to head in percentage, like +12.5%.
+func formatChange(base, head float64) string {
+	if base == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", (head-base)/base*100)
+}
+
+func formatDelta(base, head float64) string {
+	return fmt.Sprintf("%s -> %s (%s)", strconv.FormatFloat(base, 'f', 2, 64),
+		strconv.FormatFloat(head, 'f', 2, 64), formatChange(base, head))
+}
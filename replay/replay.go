@@ -0,0 +1,304 @@
+// Package replay loads the result files written by boomer's JsonFileOutput, re-renders them through
+// any boomer.Output, and compares two runs request by request.
+//
+// JsonFileOutput doesn't keep the histograms of response times, so a histogram is rebuilt from the
+// min, median, percentiles and max in the files. Outputs get the same values as the files for them,
+// other percentiles are approximations.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/myzhan/boomer"
+)
+
+// Entry is the stats of requests of a type and name, as written by JsonFileOutput.
+type Entry struct {
+	Name                  string  `json:"name"`
+	Method                string  `json:"method"`
+	NumRequests           int64   `json:"num_requests"`
+	NumFailures           int64   `json:"num_failures"`
+	TotalResponseTime     int64   `json:"total_response_time"`
+	MinResponseTime       int64   `json:"min_response_time"`
+	MaxResponseTime       int64   `json:"max_response_time"`
+	TotalContentLength    int64   `json:"total_content_length"`
+	StartTime             int64   `json:"start_time"`
+	LastRequestTimestamp  int64   `json:"last_request_timestamp"`
+	MedianResponseTime    int64   `json:"median_response_time"`
+	PercentResponseTime   int64   `json:"percent_response_time"`
+	Percent95ResponseTime int64   `json:"p95_response_time"`
+	AvgResponseTime       float64 `json:"avg_response_time"`
+	AvgContentLength      int64   `json:"avg_content_length"`
+	CurrentRps            int64   `json:"current_rps"`
+	CurrentFailPerSec     int64   `json:"current_fail_per_sec"`
+	P50ResponseTime       float64 `json:"p50_response_time"`
+	P90ResponseTime       float64 `json:"p90_response_time"`
+	P99ResponseTime       float64 `json:"p99_response_time"`
+	P999ResponseTime      float64 `json:"p999_response_time"`
+}
+
+// FailRatio returns the ratio of failed requests.
+func (e *Entry) FailRatio() float64 {
+	if e.NumRequests == 0 {
+		return 0
+	}
+	return float64(e.NumFailures) / float64(e.NumRequests)
+}
+
+// Report is a line of the real time file, or the total file of JsonFileOutput.
+type Report struct {
+	Time           time.Time                         `json:"-"`
+	UserCount      int32                             `json:"user_count"`
+	TotalRPS       int64                             `json:"total_rps"`
+	TotalFailRatio float64                           `json:"total_fail_ratio"`
+	Total          Entry                             `json:"stats_total"`
+	Stats          []Entry                           `json:"stats"`
+	Errors         map[string]map[string]interface{} `json:"errors"`
+	// CPU and memory usage of the process, only in the real time file
+	Monitor boomer.ComputerMonitor `json:"-"`
+}
+
+// Entry returns the stats of requests of name and method, or nil if there isn't any.
+// The method is ignored if it's empty.
+func (r *Report) Entry(name, method string) *Entry {
+	for i := range r.Stats {
+		if r.Stats[i].Name == name && (method == "" || r.Stats[i].Method == method) {
+			return &r.Stats[i]
+		}
+	}
+	return nil
+}
+
+// Run is a test loaded from the files of JsonFileOutput.
+type Run struct {
+	// Reports are the lines of the real time file, in order.
+	Reports []*Report
+	// Total is the content of the total file, nil if it's not loaded.
+	Total *Report
+	// PercentTime is OutputOptions.PercentTime of the test, which isn't in the files.
+	// percent_response_time is ignored if it's not positive.
+	PercentTime int
+}
+
+// Load loads the real time file and the total file of a test, either path can be empty.
+func Load(realTimePath, totalPath string) (*Run, error) {
+	run := &Run{PercentTime: 90}
+	if realTimePath != "" {
+		reports, err := LoadRealTime(realTimePath)
+		if err != nil {
+			return nil, err
+		}
+		run.Reports = reports
+	}
+	if totalPath != "" {
+		total, err := LoadTotal(totalPath)
+		if err != nil {
+			return nil, err
+		}
+		run.Total = total
+	}
+	return run, nil
+}
+
+// LoadRealTime loads the file of OutputOptions.RealTimeResultPath, a RealTimeJsonOutput per line.
+func LoadRealTime(path string) ([]*Report, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reports []*Report
+	scanner := bufio.NewScanner(file)
+	// a line has the stats of all the requests
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line struct {
+			Monitor    boomer.ComputerMonitor `json:"monitor"`
+			CurrResult Report                 `json:"curr_result"`
+			CurrTime   time.Time              `json:"curr_time"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		report := line.CurrResult
+		report.Time = line.CurrTime
+		report.Monitor = line.Monitor
+		reports = append(reports, &report)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// LoadTotal loads the file of OutputOptions.TotalResultPath, a TotalJsonOutput.
+func LoadTotal(path string) (*Report, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var total struct {
+		TotalData Report    `json:"total_result"`
+		CurrTime  time.Time `json:"curr_time"`
+	}
+	if err := json.Unmarshal(content, &total); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	report := total.TotalData
+	report.Time = total.CurrTime
+	return &report, nil
+}
+
+// Replay passes the reports of run to outputs like a test does, OnStart, OnEvent for every report
+// and OnStop. The total is passed as the only report if there aren't real time reports.
+// The times in outputs are the time of the replay, not the time of the test.
+func Replay(run *Run, outputs ...boomer.Output) error {
+	reports := run.Reports
+	if len(reports) == 0 && run.Total != nil {
+		reports = []*Report{run.Total}
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("no reports to replay")
+	}
+	for _, o := range outputs {
+		o.OnStart()
+	}
+	for _, report := range reports {
+		data := report.ReportData(run.PercentTime)
+		for _, o := range outputs {
+			o.OnEvent(data)
+		}
+	}
+	for _, o := range outputs {
+		o.OnStop()
+	}
+	return nil
+}
+
+// ReportData returns the report like the data passed to Output.OnEvent. percentTime is the percentile
+// of percent_response_time, it's ignored if it's not positive.
+func (r *Report) ReportData(percentTime int) map[string]interface{} {
+	stats := make([]interface{}, 0, len(r.Stats))
+	for i := range r.Stats {
+		stats = append(stats, r.Stats[i].serialize(percentTime))
+	}
+	// JSON numbers are decoded as float64, but outputs expect int64 occurrences
+	errors := make(map[string]map[string]interface{}, len(r.Errors))
+	for key, e := range r.Errors {
+		occurrences, _ := e["occurrences"].(float64)
+		errors[key] = map[string]interface{}{
+			"method":      e["method"],
+			"name":        e["name"],
+			"error":       e["error"],
+			"occurrences": int64(occurrences),
+		}
+	}
+	return map[string]interface{}{
+		"user_count":  r.UserCount,
+		"stats":       stats,
+		"stats_total": r.Total.serialize(percentTime),
+		"errors":      errors,
+	}
+}
+
+// serialize returns the entry like the stats entries reported by boomer.
+func (e *Entry) serialize(percentTime int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                   e.Name,
+		"method":                 e.Method,
+		"last_request_timestamp": e.LastRequestTimestamp,
+		"start_time":             e.StartTime,
+		"num_requests":           e.NumRequests,
+		"num_none_requests":      0,
+		"num_failures":           e.NumFailures,
+		"total_response_time":    e.TotalResponseTime,
+		"max_response_time":      e.MaxResponseTime,
+		"min_response_time":      e.MinResponseTime,
+		"total_content_length":   e.TotalContentLength,
+		"response_times":         e.histogram(percentTime),
+		"num_reqs_per_sec":       perSecond(e.NumRequests, e.CurrentRps, e.LastRequestTimestamp, true),
+		"num_fail_per_sec":       perSecond(e.NumFailures, e.CurrentFailPerSec, e.LastRequestTimestamp, false),
+	}
+}
+
+// histogram rebuilds a {response_time => count} histogram, which has the same min, median,
+// percentiles and max as the entry, calculated like boomer.
+func (e *Entry) histogram(percentTime int) map[int64]int64 {
+	histogram := make(map[int64]int64)
+	n := e.NumRequests
+	if n == 0 {
+		return histogram
+	}
+
+	type quantile struct {
+		pos   int64
+		value int64
+	}
+	quantiles := []quantile{
+		{(n - 1) / 2, e.MedianResponseTime},
+		{(n - 1) * 95 / 100, e.Percent95ResponseTime},
+		{n - 1, e.MaxResponseTime},
+	}
+	if percentTime > 0 && percentTime < 100 {
+		quantiles = append(quantiles, quantile{(n - 1) * int64(percentTime) / 100, e.PercentResponseTime})
+	}
+	if e.P99ResponseTime > 0 {
+		quantiles = append(quantiles, quantile{(n - 1) * 99 / 100, int64(e.P99ResponseTime + 0.5)})
+	}
+	sort.SliceStable(quantiles, func(i, j int) bool {
+		return quantiles[i].pos < quantiles[j].pos
+	})
+
+	// requests from the previous position to pos have the value of the quantile at pos
+	prev := int64(-1)
+	last := int64(0)
+	for i, q := range quantiles {
+		value := q.value
+		if value < last {
+			value = last
+		}
+		last = value
+		if q.pos <= prev {
+			continue
+		}
+		count := q.pos - prev
+		if i == 0 && count > 1 && e.MinResponseTime < value {
+			histogram[e.MinResponseTime]++
+			count--
+		}
+		histogram[value] += count
+		prev = q.pos
+	}
+	return histogram
+}
+
+// perSecond rebuilds a {second => count} map, boomer calculates the same rate from it.
+// The last second is ignored by boomer for the rate of requests, if there are more than 2 seconds.
+func perSecond(count, rate, lastSecond int64, ignoresLastSecond bool) map[int64]int64 {
+	perSecond := make(map[int64]int64)
+	if count == 0 || rate == 0 {
+		return perSecond
+	}
+	seconds := (count + rate/2) / rate
+	if seconds < 1 {
+		seconds = 1
+	}
+	if ignoresLastSecond && seconds > 2 {
+		seconds++
+	}
+	for i := int64(0); i < seconds; i++ {
+		perSecond[lastSecond-i] = count / seconds
+	}
+	perSecond[lastSecond] += count % seconds
+	return perSecond
+}
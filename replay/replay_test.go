@@ -0,0 +1,170 @@
+package replay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRealTime = `{"monitor":{"cpu":12.5,"mem":30},"curr_result":{"user_count":5,"total_rps":20,"total_fail_ratio":0,"stats_total":{"name":"Total","method":"","num_requests":60,"num_failures":0,"total_response_time":1200,"min_response_time":5,"max_response_time":90,"median_response_time":20,"percent_response_time":40,"p95_response_time":50,"current_rps":20,"last_request_timestamp":1600000003},"stats":[{"name":"login","method":"http","num_requests":60,"num_failures":0,"total_response_time":1200,"min_response_time":5,"max_response_time":90,"median_response_time":20,"percent_response_time":40,"p95_response_time":50,"avg_response_time":20,"current_rps":20,"last_request_timestamp":1600000003}],"errors":null},"curr_time":"2020-09-13T12:26:43Z"}
+
+{"monitor":{"cpu":10,"mem":31},"curr_result":{"user_count":10,"total_rps":30,"total_fail_ratio":0.1,"stats_total":{"name":"Total","method":"","num_requests":90,"num_failures":9},"stats":[{"name":"login","method":"http","num_requests":90,"num_failures":9,"total_response_time":1800,"min_response_time":5,"max_response_time":90,"median_response_time":20,"percent_response_time":40,"p95_response_time":50,"avg_response_time":20,"current_rps":30,"current_fail_per_sec":3,"last_request_timestamp":1600000006}],"errors":null},"curr_time":"2020-09-13T12:26:46Z"}
+`
+
+const testTotal = `{"total_result":{"user_count":10,"total_rps":25,"total_fail_ratio":0.06,"stats_total":{"name":"Total","num_requests":150,"num_failures":9},"stats":[{"name":"login","method":"http","num_requests":150,"num_failures":9,"total_response_time":3000,"min_response_time":5,"max_response_time":90,"median_response_time":20,"percent_response_time":40,"p95_response_time":50,"avg_response_time":20,"current_rps":25}],"errors":{"abc":{"method":"http","name":"login","error":"timeout","occurrences":9}}},"curr_time":"2020-09-13T12:26:46Z"}`
+
+func writeTestFiles(t *testing.T) (dir, realTimePath, totalPath string) {
+	dir, err := ioutil.TempDir("", "boomer-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	realTimePath = filepath.Join(dir, "realtime.json")
+	totalPath = filepath.Join(dir, "total.json")
+	ioutil.WriteFile(realTimePath, []byte(testRealTime), 0644)
+	ioutil.WriteFile(totalPath, []byte(testTotal), 0644)
+	return
+}
+
+// percentile calculates the percentile of a histogram like boomer.
+func percentile(histogram map[int64]int64, numRequests int64, percent int) int64 {
+	pos := (numRequests - 1) * int64(percent) / 100
+	keys := make([]int64, 0, len(histogram))
+	for k := range histogram {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		if pos < histogram[k] {
+			return k
+		}
+		pos -= histogram[k]
+	}
+	return 0
+}
+
+type recordOutput struct {
+	started, stopped bool
+	events           []map[string]interface{}
+}
+
+func (o *recordOutput) OnStart() { o.started = true }
+
+func (o *recordOutput) OnEvent(data map[string]interface{}) { o.events = append(o.events, data) }
+
+func (o *recordOutput) OnStop() { o.stopped = true }
+
+func TestLoad(t *testing.T) {
+	dir, realTimePath, totalPath := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	run, err := Load(realTimePath, totalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, run.Reports, 2)
+	assert.Equal(t, int32(10), run.Reports[1].UserCount)
+	assert.Equal(t, 12.5, run.Reports[0].Monitor.CPU)
+	assert.Equal(t, int64(1600000006), run.Reports[1].Time.Unix())
+	assert.Equal(t, int64(90), run.Reports[1].Entry("login", "http").NumRequests)
+	assert.Nil(t, run.Reports[1].Entry("home", ""))
+	assert.Equal(t, int64(150), run.Total.Stats[0].NumRequests)
+	assert.Equal(t, 0.06, run.Total.Stats[0].FailRatio())
+
+	ioutil.WriteFile(realTimePath, []byte("{\n"), 0644)
+	_, err = LoadRealTime(realTimePath)
+	assert.Error(t, err)
+}
+
+func TestHistogram(t *testing.T) {
+	e := &Entry{NumRequests: 100, MinResponseTime: 5, MedianResponseTime: 20, PercentResponseTime: 50,
+		Percent95ResponseTime: 80, P99ResponseTime: 150.4, MaxResponseTime: 300}
+	histogram := e.histogram(90)
+	var count int64
+	for _, v := range histogram {
+		count += v
+	}
+	assert.Equal(t, int64(100), count)
+	assert.Equal(t, int64(5), percentile(histogram, 100, 0))
+	assert.Equal(t, int64(20), percentile(histogram, 100, 50))
+	assert.Equal(t, int64(50), percentile(histogram, 100, 90))
+	assert.Equal(t, int64(80), percentile(histogram, 100, 95))
+	assert.Equal(t, int64(150), percentile(histogram, 100, 99))
+	assert.Equal(t, int64(300), percentile(histogram, 100, 100))
+
+	e = &Entry{NumRequests: 1, MinResponseTime: 7, MedianResponseTime: 7, Percent95ResponseTime: 7, MaxResponseTime: 7}
+	assert.Equal(t, map[int64]int64{7: 1}, e.histogram(90))
+	assert.Empty(t, (&Entry{}).histogram(90))
+}
+
+func TestPerSecond(t *testing.T) {
+	requests := perSecond(300, 100, 1600000010, true)
+	assert.Len(t, requests, 4)
+	assert.Equal(t, int64(75), requests[1600000010])
+	failures := perSecond(10, 5, 1600000010, false)
+	assert.Equal(t, map[int64]int64{1600000009: 5, 1600000010: 5}, failures)
+	assert.Empty(t, perSecond(10, 0, 1600000010, false))
+}
+
+func TestReplay(t *testing.T) {
+	dir, realTimePath, totalPath := writeTestFiles(t)
+	defer os.RemoveAll(dir)
+
+	run, err := Load(realTimePath, totalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &recordOutput{}
+	assert.NoError(t, Replay(run, o))
+	assert.True(t, o.started)
+	assert.True(t, o.stopped)
+	assert.Len(t, o.events, 2)
+	assert.Equal(t, int32(5), o.events[0]["user_count"])
+	login := o.events[0]["stats"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, int64(60), login["num_requests"])
+
+	// the total is replayed without real time reports
+	run.Reports = nil
+	o = &recordOutput{}
+	assert.NoError(t, Replay(run, o))
+	assert.Len(t, o.events, 1)
+	errors := o.events[0]["errors"].(map[string]map[string]interface{})
+	assert.Equal(t, int64(9), errors["abc"]["occurrences"])
+
+	assert.Error(t, Replay(&Run{}, o))
+}
+
+func TestCompare(t *testing.T) {
+	base := &Report{Stats: []Entry{
+		{Name: "login", Method: "http", NumRequests: 100, MedianResponseTime: 20, Percent95ResponseTime: 50, AvgResponseTime: 25, CurrentRps: 100},
+		{Name: "home", Method: "http", NumRequests: 100, MedianResponseTime: 10, Percent95ResponseTime: 30, AvgResponseTime: 12, CurrentRps: 100},
+		{Name: "logout", Method: "http", NumRequests: 10},
+	}}
+	head := &Report{Stats: []Entry{
+		{Name: "login", Method: "http", NumRequests: 100, MedianResponseTime: 21, Percent95ResponseTime: 80, AvgResponseTime: 26, CurrentRps: 80, NumFailures: 5},
+		{Name: "home", Method: "http", NumRequests: 100, MedianResponseTime: 10, Percent95ResponseTime: 32, AvgResponseTime: 12, CurrentRps: 95},
+		{Name: "search", Method: "http", NumRequests: 10},
+	}}
+
+	c := Compare(base, head, Tolerance{Latency: 0.1, RPS: 0.1, FailRatio: 0.01})
+	assert.True(t, c.Regressed())
+	assert.Len(t, c.Deltas, 4)
+	assert.Equal(t, "home", c.Deltas[0].Name)
+	assert.Empty(t, c.Deltas[0].Regressions)
+	assert.Equal(t, "login", c.Deltas[1].Name)
+	assert.Equal(t, []string{"p95 50ms -> 80ms (+60.0%)", "rps 100 -> 80 (-20.0%)", "fail ratio 0.00% -> 5.00%"}, c.Deltas[1].Regressions)
+	assert.Nil(t, c.Deltas[2].Head)
+	assert.Nil(t, c.Deltas[3].Base)
+
+	var buf bytes.Buffer
+	c.Print(&buf)
+	assert.Contains(t, buf.String(), "REGRESSION")
+	assert.Contains(t, buf.String(), "missing")
+	assert.Contains(t, buf.String(), "Regression of http login: p95 50ms -> 80ms (+60.0%)")
+
+	assert.False(t, Compare(base, base, Tolerance{}).Regressed())
+}
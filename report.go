@@ -0,0 +1,397 @@
+package boomer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// getReportMonitor samples CPU and memory usage for ReportOutput, it's replaced by unit tests.
+var getReportMonitor = GetCpuMem
+
+// ReportOutput collects the whole test, and writes a self-contained HTML report and a Markdown summary
+// at OnStop. The HTML report has per-request tables, percentile, RPS and user count charts over time,
+// errors, and CPU and memory usage. It doesn't need any external assets, so it can be kept as a CI artifact.
+type ReportOutput struct {
+	htmlPath     string
+	markdownPath string
+
+	lock      sync.Mutex
+	startTime time.Time
+	endTime   time.Time
+	// stats since the start, from stats_cumulative of the data
+	stats   *statsAggregator
+	samples []reportSample
+}
+
+// reportSample is the data of a report interval.
+type reportSample struct {
+	time      time.Time
+	userCount int32
+	rps       float64
+	failRatio float64
+	p50       float64
+	p95       float64
+	p99       float64
+	cpu       float64
+	mem       float64
+}
+
+// NewReportOutput returns a ReportOutput, which writes the HTML report to htmlPath and the Markdown summary
+// to markdownPath. Either of them can be empty.
+func NewReportOutput(htmlPath, markdownPath string) *ReportOutput {
+	return &ReportOutput{
+		htmlPath:     htmlPath,
+		markdownPath: markdownPath,
+		stats:        newStatsAggregator(),
+	}
+}
+
+// OnStart records the start of the test.
+func (o *ReportOutput) OnStart() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.startTime = time.Now()
+}
+
+// OnEvent aggregates data and keeps a sample of the interval.
+func (o *ReportOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+	monitor := getReportMonitor()
+	now := time.Now()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.startTime.IsZero() {
+		o.startTime = now
+	}
+	o.stats.cumulative(output, defaultPercentTime)
+
+	sample := reportSample{
+		time:      now,
+		userCount: output.UserCount,
+		rps:       float64(output.TotalRPS),
+		failRatio: output.TotalFailRatio,
+		cpu:       monitor.CPU,
+		mem:       monitor.Mem,
+	}
+	if output.TotalStats != nil {
+		sample.p50 = percentileOf(&output.TotalStats.statsEntry, 50)
+		sample.p95 = percentileOf(&output.TotalStats.statsEntry, 95)
+		sample.p99 = percentileOf(&output.TotalStats.statsEntry, 99)
+	}
+	o.samples = append(o.samples, sample)
+}
+
+// OnStop writes the HTML report and the Markdown summary.
+func (o *ReportOutput) OnStop() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.endTime = time.Now()
+	if o.startTime.IsZero() {
+		o.startTime = o.endTime
+	}
+
+	if o.htmlPath != "" {
+		html, err := o.renderHTML()
+		if err == nil {
+			err = ioutil.WriteFile(o.htmlPath, html, 0644)
+		}
+		if err != nil {
+			log.Printf("Failed to write the HTML report to %s, %v\n", o.htmlPath, err)
+		}
+	}
+	if o.markdownPath != "" {
+		if err := ioutil.WriteFile(o.markdownPath, []byte(o.renderMarkdown()), 0644); err != nil {
+			log.Printf("Failed to write the Markdown summary to %s, %v\n", o.markdownPath, err)
+		}
+	}
+}
+
+// reportRow is a row of the request table.
+type reportRow struct {
+	Method      string
+	Name        string
+	Requests    int64
+	Failures    int64
+	FailRatio   string
+	Median      string
+	P90         string
+	P95         string
+	P99         string
+	Avg         string
+	Min         int64
+	Max         int64
+	AvgSize     int64
+	RPS         string
+	IsTotalLine bool
+}
+
+func (o *ReportOutput) newReportRow(entry *statsEntry) reportRow {
+	duration := o.endTime.Sub(o.startTime).Seconds()
+	rps := float64(0)
+	if duration > 0 {
+		rps = float64(entry.NumRequests) / duration
+	}
+	formatMillis := func(v float64) string {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return reportRow{
+		Method:    entry.Method,
+		Name:      entry.Name,
+		Requests:  entry.NumRequests,
+		Failures:  entry.NumFailures,
+		FailRatio: fmt.Sprintf("%.2f%%", getTotalFailRatio(entry.NumRequests, entry.NumFailures)*100),
+		Median:    formatMillis(percentileOf(entry, 50)),
+		P90:       formatMillis(percentileOf(entry, 90)),
+		P95:       formatMillis(percentileOf(entry, 95)),
+		P99:       formatMillis(percentileOf(entry, 99)),
+		Avg:       fmt.Sprintf("%.2f", getAvgResponseTime(entry.NumRequests, entry.TotalResponseTime)),
+		Min:       entry.MinResponseTime,
+		Max:       entry.MaxResponseTime,
+		AvgSize:   getAvgContentLength(entry.NumRequests, entry.TotalContentLength),
+		RPS:       fmt.Sprintf("%.2f", rps),
+	}
+}
+
+// rows returns the rows of requests sorted by name, and the total row at last.
+func (o *ReportOutput) rows() []reportRow {
+	allStats := o.stats.last
+	if allStats == nil {
+		allStats = o.stats.dataOutput(defaultPercentTime)
+	}
+	rows := make([]reportRow, 0, len(allStats.Stats)+1)
+	for _, stat := range allStats.Stats {
+		rows = append(rows, o.newReportRow(&stat.statsEntry))
+	}
+	total := o.newReportRow(&allStats.TotalStats.statsEntry)
+	total.Method, total.Name = "", "Aggregated"
+	total.IsTotalLine = true
+	return append(rows, total)
+}
+
+// sortedErrors returns errors since the start by occurrences in descending order.
+func (o *ReportOutput) sortedErrors() []*statsError {
+	if o.stats.last == nil {
+		return nil
+	}
+	return sortErrors(o.stats.last.Errors)
+}
+
+func (o *ReportOutput) renderMarkdown() string {
+	var b strings.Builder
+	b.WriteString("# Boomer Test Report\n\n")
+	b.WriteString(fmt.Sprintf("- Start: %s\n", o.startTime.Format("2006-01-02 15:04:05")))
+	b.WriteString(fmt.Sprintf("- End: %s\n", o.endTime.Format("2006-01-02 15:04:05")))
+	b.WriteString(fmt.Sprintf("- Duration: %s\n", o.endTime.Sub(o.startTime).Round(time.Second)))
+	b.WriteString(fmt.Sprintf("- Max users: %d\n\n", o.maxUserCount()))
+
+	b.WriteString("## Requests\n\n")
+	b.WriteString("| Type | Name | # Requests | # Fails | Fail Ratio | Median (ms) | P90 (ms) | P95 (ms) | P99 (ms) | Average (ms) | Min (ms) | Max (ms) | Average Size (bytes) | RPS |\n")
+	b.WriteString("|---|---|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, row := range o.rows() {
+		name := escapeMarkdown(row.Name)
+		if row.IsTotalLine {
+			name = "**" + name + "**"
+		}
+		b.WriteString(fmt.Sprintf("| %s | %s | %d | %d | %s | %s | %s | %s | %s | %s | %d | %d | %d | %s |\n",
+			escapeMarkdown(row.Method), name, row.Requests, row.Failures, row.FailRatio, row.Median, row.P90,
+			row.P95, row.P99, row.Avg, row.Min, row.Max, row.AvgSize, row.RPS))
+	}
+
+	b.WriteString("\n## Errors\n\n")
+	errors := o.sortedErrors()
+	if len(errors) == 0 {
+		b.WriteString("No errors.\n")
+	} else {
+		b.WriteString("| # Occurrences | Type | Name | Error | Examples |\n")
+		b.WriteString("|---:|---|---|---|---|\n")
+		for _, e := range errors {
+			examples := make([]string, 0, len(e.examples))
+			for _, example := range e.examples {
+				examples = append(examples, escapeMarkdown(example))
+			}
+			b.WriteString(fmt.Sprintf("| %d | %s | %s | %s | %s |\n", e.occurrences, escapeMarkdown(e.method),
+				escapeMarkdown(e.name), escapeMarkdown(e.error), strings.Join(examples, "<br>")))
+		}
+	}
+	return b.String()
+}
+
+func escapeMarkdown(s string) string {
+	s = strings.Replace(s, "|", "\\|", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+func (o *ReportOutput) maxUserCount() int32 {
+	max := int32(0)
+	for _, sample := range o.samples {
+		if sample.userCount > max {
+			max = sample.userCount
+		}
+	}
+	return max
+}
+
+// chartSeries is a line in a chart.
+type chartSeries struct {
+	name   string
+	color  string
+	values []float64
+}
+
+const (
+	chartWidth   = 900
+	chartHeight  = 220
+	chartPadding = 50
+)
+
+// renderChart returns an inline SVG line chart of series over times.
+func renderChart(title, unit string, times []time.Time, series ...chartSeries) template.HTML {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		chartWidth, chartHeight, chartWidth, chartHeight))
+	b.WriteString(fmt.Sprintf(`<text x="%d" y="16" class="title">%s</text>`, chartPadding, template.HTMLEscapeString(title)))
+
+	maxValue := float64(0)
+	for _, s := range series {
+		for _, v := range s.values {
+			if v > maxValue {
+				maxValue = v
+			}
+		}
+	}
+	if maxValue == 0 {
+		maxValue = 1
+	}
+	left, top := float64(chartPadding), float64(30)
+	width, height := float64(chartWidth-2*chartPadding), float64(chartHeight-30-chartPadding)
+
+	// axes and labels
+	b.WriteString(fmt.Sprintf(`<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" class="axis"/>`, left, top, left, top+height))
+	b.WriteString(fmt.Sprintf(`<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" class="axis"/>`, left, top+height, left+width, top+height))
+	b.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" class="label" text-anchor="end">%.4g%s</text>`, left-4, top+4, maxValue, unit))
+	b.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" class="label" text-anchor="end">0</text>`, left-4, top+height))
+	if len(times) > 0 {
+		b.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" class="label">%s</text>`, left, top+height+16, times[0].Format("15:04:05")))
+		b.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" class="label" text-anchor="end">%s</text>`, left+width, top+height+16, times[len(times)-1].Format("15:04:05")))
+	}
+
+	for i, s := range series {
+		points := make([]string, 0, len(s.values))
+		for j, v := range s.values {
+			x := left
+			if len(s.values) > 1 {
+				x += width * float64(j) / float64(len(s.values)-1)
+			}
+			y := top + height - height*v/maxValue
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		b.WriteString(fmt.Sprintf(`<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`, s.color, strings.Join(points, " ")))
+		// legend
+		x := left + float64(i)*120
+		b.WriteString(fmt.Sprintf(`<rect x="%.0f" y="%.0f" width="10" height="10" fill="%s"/>`, x, top+height+26, s.color))
+		b.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" class="label">%s</text>`, x+14, top+height+35, template.HTMLEscapeString(s.name)))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func (o *ReportOutput) renderHTML() ([]byte, error) {
+	times := make([]time.Time, 0, len(o.samples))
+	var p50, p95, p99, rps, failRatio, users, cpu, mem []float64
+	for _, sample := range o.samples {
+		times = append(times, sample.time)
+		p50 = append(p50, sample.p50)
+		p95 = append(p95, sample.p95)
+		p99 = append(p99, sample.p99)
+		rps = append(rps, sample.rps)
+		failRatio = append(failRatio, sample.failRatio*100)
+		users = append(users, float64(sample.userCount))
+		cpu = append(cpu, sample.cpu)
+		mem = append(mem, sample.mem)
+	}
+
+	type reportError struct {
+		Occurrences int64
+		Method      string
+		Name        string
+		Error       string
+		Examples    []string
+	}
+	var errors []reportError
+	for _, e := range o.sortedErrors() {
+		errors = append(errors, reportError{e.occurrences, e.method, e.name, e.error, e.examples})
+	}
+
+	data := map[string]interface{}{
+		"StartTime": o.startTime.Format("2006-01-02 15:04:05"),
+		"EndTime":   o.endTime.Format("2006-01-02 15:04:05"),
+		"Duration":  o.endTime.Sub(o.startTime).Round(time.Second).String(),
+		"MaxUsers":  o.maxUserCount(),
+		"Rows":      o.rows(),
+		"Errors":    errors,
+		"Charts": []template.HTML{
+			renderChart("Response Time Percentiles", "ms", times,
+				chartSeries{"P50", "#2b8cbe", p50}, chartSeries{"P95", "#f39c12", p95}, chartSeries{"P99", "#e74c3c", p99}),
+			renderChart("Requests per Second", "", times,
+				chartSeries{"RPS", "#27ae60", rps}, chartSeries{"Fail Ratio (%)", "#e74c3c", failRatio}),
+			renderChart("Users", "", times, chartSeries{"Users", "#8e44ad", users}),
+			renderChart("CPU and Memory Usage", "%", times,
+				chartSeries{"CPU", "#d35400", cpu}, chartSeries{"Memory", "#16a085", mem}),
+		},
+	}
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Boomer Test Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 24px; color: #333; }
+table { border-collapse: collapse; margin-bottom: 24px; font-size: 13px; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+th { background: #f5f5f5; }
+td.text { text-align: left; }
+tr.total { font-weight: bold; }
+svg { display: block; margin-bottom: 16px; }
+svg .title { font-size: 14px; font-weight: bold; }
+svg .label { font-size: 11px; fill: #666; }
+svg .axis { stroke: #999; }
+</style>
+</head>
+<body>
+<h1>Boomer Test Report</h1>
+<p>Start: {{.StartTime}}, End: {{.EndTime}}, Duration: {{.Duration}}, Max users: {{.MaxUsers}}</p>
+<h2>Requests</h2>
+<table>
+<tr><th>Type</th><th>Name</th><th># Requests</th><th># Fails</th><th>Fail Ratio</th><th>Median (ms)</th><th>P90 (ms)</th><th>P95 (ms)</th><th>P99 (ms)</th><th>Average (ms)</th><th>Min (ms)</th><th>Max (ms)</th><th>Average Size (bytes)</th><th>RPS</th></tr>
+{{range .Rows}}<tr{{if .IsTotalLine}} class="total"{{end}}><td class="text">{{.Method}}</td><td class="text">{{.Name}}</td><td>{{.Requests}}</td><td>{{.Failures}}</td><td>{{.FailRatio}}</td><td>{{.Median}}</td><td>{{.P90}}</td><td>{{.P95}}</td><td>{{.P99}}</td><td>{{.Avg}}</td><td>{{.Min}}</td><td>{{.Max}}</td><td>{{.AvgSize}}</td><td>{{.RPS}}</td></tr>
+{{end}}</table>
+<h2>Charts</h2>
+{{range .Charts}}{{.}}
+{{end}}
+<h2>Errors</h2>
+{{if .Errors}}<table>
+<tr><th># Occurrences</th><th>Type</th><th>Name</th><th>Error</th><th>Examples</th></tr>
+{{range .Errors}}<tr><td>{{.Occurrences}}</td><td class="text">{{.Method}}</td><td class="text">{{.Name}}</td><td class="text">{{.Error}}</td><td class="text">{{range $i, $e := .Examples}}{{if $i}}<br>{{end}}{{$e}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No errors.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,92 @@
+package boomer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReportData() map[string]interface{} {
+	return collectTestReportData(newRequestStats())
+}
+
+// collectTestReportData records the requests of a report to stats and collects it,
+// so the stats_cumulative of reports collected from the same stats grows.
+func collectTestReportData(stats *requestStats) map[string]interface{} {
+	stats.recordSuccess("http", "login", 10, 0, 100)
+	stats.recordSuccess("http", "login", 200, 0, 100)
+	stats.recordSuccess("http", "home", 30, 0, 500)
+	stats.logError("http", "home", "timeout|500")
+	data := stats.collectReportData()
+	data["user_count"] = int32(5)
+	return data
+}
+
+func TestReportOutput(t *testing.T) {
+	defer func(f func() ComputerMonitor) { getReportMonitor = f }(getReportMonitor)
+	getReportMonitor = func() ComputerMonitor {
+		return ComputerMonitor{CPU: 12.5, Mem: 3}
+	}
+
+	dir, err := ioutil.TempDir("", "boomer-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	htmlPath := filepath.Join(dir, "report.html")
+	markdownPath := filepath.Join(dir, "summary.md")
+
+	o := NewReportOutput(htmlPath, markdownPath)
+	o.OnStart()
+	stats := newRequestStats()
+	o.OnEvent(collectTestReportData(stats))
+	o.OnEvent(collectTestReportData(stats))
+	o.OnStop()
+
+	assert.Len(t, o.samples, 2)
+	rows := o.rows()
+	assert.Len(t, rows, 3)
+	assert.Equal(t, "login", rows[1].Name)
+	assert.Equal(t, int64(4), rows[1].Requests)
+	assert.Equal(t, int64(6), rows[2].Requests)
+	assert.Equal(t, 12.5, o.samples[0].cpu)
+
+	html, err := ioutil.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(html), "<svg")
+	assert.Contains(t, string(html), "Response Time Percentiles")
+	assert.Contains(t, string(html), "CPU and Memory Usage")
+	assert.Contains(t, string(html), "timeout|500")
+	assert.NotContains(t, string(html), "<script src=")
+	assert.NotContains(t, string(html), "<link ")
+
+	markdown, err := ioutil.ReadFile(markdownPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(markdown), "| http | login | 4 | 0 |")
+	assert.Contains(t, string(markdown), "| http | home | 2 | 2 |")
+	assert.Contains(t, string(markdown), "| **Aggregated** | 6 | 2 |")
+	assert.Contains(t, string(markdown), "| 2 | http | home | timeout\\|500 |")
+	assert.Contains(t, string(markdown), "- Max users: 5")
+}
+
+func TestReportOutputWithoutPaths(t *testing.T) {
+	defer func(f func() ComputerMonitor) { getReportMonitor = f }(getReportMonitor)
+	getReportMonitor = func() ComputerMonitor { return ComputerMonitor{} }
+
+	o := NewReportOutput("", "")
+	o.OnStart()
+	o.OnEvent(newTestReportData())
+	o.OnStop()
+
+	assert.True(t, strings.HasPrefix(o.renderMarkdown(), "# Boomer Test Report"))
+	_, err := o.renderHTML()
+	assert.NoError(t, err)
+}
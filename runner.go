@@ -1,6 +1,7 @@
 package boomer
 
 import (
+	"context"
 	"fmt"
 	"github.com/panjf2000/ants/v2"
 	"go.uber.org/ratelimit"
@@ -18,6 +19,7 @@ const (
 	stateInit     = "ready"
 	stateSpawning = "spawning"
 	stateRunning  = "running"
+	stateStopping = "stopping"
 	stateStopped  = "stopped"
 	stateQuitting = "quitting"
 )
@@ -25,13 +27,33 @@ const (
 const (
 	//slaveReportInterval = 10 * time.Second
 	heartbeatInterval = 1 * time.Second
+
+	// same as MASTER_HEARTBEAT_TIMEOUT in locust
+	defaultMasterHeartbeatTimeout = 60 * time.Second
+	minReconnectBackoff           = 1 * time.Second
+	maxReconnectBackoff           = 30 * time.Second
 )
 
 // add by robert for support the feature of custom output interval
 var slaveReportInterval = 10 * time.Second
 
+// how often spawnGradually checks if more users should be spawned
+var spawnTickInterval = 100 * time.Millisecond
+
+// how often localRunner asks LoadShape for the target amount of users
+var loadShapeTickInterval = 1 * time.Second
+
+// how long runner.stop waits for in-flight iterations to finish by default
+const defaultDrainTimeout = 10 * time.Second
+
+// how often runner.drainIterations checks if in-flight iterations are finished
+var drainPollInterval = 10 * time.Millisecond
+
 type runner struct {
-	state string
+	// state is changed by the listener, spawning and load shape goroutines, and read by reporting goroutines,
+	// so it's accessed by getState and setState.
+	state     string
+	stateLock sync.RWMutex
 
 	tasks           []*Task
 	totalTaskWeight int
@@ -43,20 +65,73 @@ type runner struct {
 	// TODO: we save user_class_count in spawn message and send it back to master without modification, may be a bad idea?
 	userClassesCountFromMaster map[string]int64
 
+	// registered by Boomer.RegisterUserClass, tasks are used for classes not registered.
+	userClasses map[string]*userClass
+	// the user class of every user to spawn, it's empty if no user class is registered.
+	spawnPlan []*userClass
+	// the amount of users of every class in spawnPlan
+	userClassesCount map[string]int64
+
 	numClients       int32
 	spawnRate        float64
 	isOldSpawnWorker bool
+	// if it's set, iterations are started at the arrival rate instead of spawning users.
+	arrivalRate *ArrivalRate
+
+	// iterations being run, it's updated atomically.
+	activeIterations int32
+	// ID of the last spawned user, it's updated atomically.
+	lastUserID int64
+	// if it's set, a span is started around every iteration, see Boomer.EnableIterationTracing.
+	tracer IterationTracer
+	// if iterationLimit > 0, no more iterations are started after iterationLimit iterations,
+	// and iterationLimitChan is closed. startedIterations is updated atomically.
+	iterationLimit     int64
+	startedIterations  int64
+	iterationLimitChan chan bool
+	iterationLimitOnce sync.Once
+	// how long runner.stop waits for activeIterations to finish, a timeout <= 0 doesn't wait.
+	drainTimeout time.Duration
 
 	// all running workers(goroutines) will select on this channel.
 	// close this channel will stop all running workers.
 	stopChan chan bool
+	// closed by runner.stop after in-flight iterations are drained or abandoned.
+	drainedChan chan bool
+	// stopLock guards stopChan and drainedChan, which are replaced on every spawn, and closed only once.
+	stopLock sync.Mutex
 
 	// close this channel will stop all goroutines used in runner, including running workers.
 	shutdownChan chan bool
+	// closed after OnStop of all the outputs returns, or if the runner fails to start.
+	outputsStoppedChan chan bool
 
 	outputs []Output
 }
 
+func (r *runner) getState() string {
+	r.stateLock.RLock()
+	defer r.stateLock.RUnlock()
+	return r.state
+}
+
+func (r *runner) setState(state string) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	r.state = state
+}
+
+// swapState sets the state to new only if it's old, and returns whether it's set.
+func (r *runner) swapState(old, new string) bool {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	if r.state != old {
+		return false
+	}
+	r.state = new
+	return true
+}
+
 func (r *runner) SetSlaveReportInterval(interval int) {
 	if interval > 0 {
 		slaveReportInterval = time.Duration(interval) * time.Second
@@ -84,6 +159,123 @@ func (r *runner) safeRun(fn func()) {
 	fn()
 }
 
+// runTask runs a task with safeRun, passing ctx to Task.FnCtx if it's set.
+// The task is counted in r.activeIterations while it's running, and traced by r.tracer if it's set.
+// It's skipped if r.iterationLimit is reached.
+func (r *runner) runTask(ctx context.Context, task *Task) {
+	if r.iterationLimit > 0 {
+		started := atomic.AddInt64(&r.startedIterations, 1)
+		if started >= r.iterationLimit {
+			r.iterationLimitOnce.Do(func() {
+				close(r.iterationLimitChan)
+			})
+		}
+		if started > r.iterationLimit {
+			return
+		}
+	}
+	atomic.AddInt32(&r.activeIterations, 1)
+	defer atomic.AddInt32(&r.activeIterations, -1)
+	if r.tracer != nil {
+		var end func()
+		ctx, end = r.tracer.StartIteration(ctx, task.Name)
+		defer end()
+	}
+	r.safeRun(func() {
+		task.run(ctx)
+	})
+}
+
+// runTaskAndWait runs a task, then waits for Task.WaitTime or the wait time of user.
+// The wait is cut short if quit, leave or r.shutdownChan is closed, leave can be nil.
+// If intendedStart isn't zero, the latency from intendedStart to the completion of the task is logged
+// as the corrected latency, which includes the time the task is delayed by the rate limiter or pacing.
+// It returns the intended start of the next task, which is zero if there is no wait time.
+func (r *runner) runTaskAndWait(ctx context.Context, quit, leave chan bool, user *userClass, task *Task, intendedStart time.Time) time.Time {
+	waitTime := task.WaitTime
+	if waitTime == nil && user != nil {
+		waitTime = user.waitTime
+	}
+
+	startTime := time.Now()
+	r.runTask(ctx, task)
+	endTime := time.Now()
+	if !intendedStart.IsZero() {
+		r.stats.recordCorrectedLatency(task.Name, endTime.Sub(intendedStart).Microseconds())
+	}
+	if waitTime == nil {
+		return time.Time{}
+	}
+
+	d := waitTime(endTime.Sub(startTime))
+	// with ConstantPacing, it's in the past if the task is slower than the pacing.
+	nextIntendedStart := endTime.Add(d)
+	if d <= 0 {
+		return nextIntendedStart
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-quit:
+	case <-leave:
+	case <-r.shutdownChan:
+	}
+	return nextIntendedStart
+}
+
+// newSpawnContext returns a context which is cancelled when quit or r.shutdownChan is closed.
+// Tasks with FnCtx receive it, so in-flight requests can be aborted as soon as boomer stops.
+// If quit is r.stopChan, it's cancelled after runner.stop drains in-flight iterations instead,
+// so only the abandoned iterations are aborted. runner.stopImmediately cancels it at once.
+func (r *runner) newSpawnContext(quit chan bool) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := r.drainedChanOf(quit)
+	go func() {
+		select {
+		case <-quit:
+			if drained != nil {
+				select {
+				case <-drained:
+				case <-r.shutdownChan:
+				}
+			}
+		case <-r.shutdownChan:
+		}
+		cancel()
+	}()
+	return ctx
+}
+
+// drainedChanOf returns r.drainedChan if quit is r.stopChan, or nil.
+func (r *runner) drainedChanOf(quit chan bool) chan bool {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	if quit == r.stopChan {
+		return r.drainedChan
+	}
+	return nil
+}
+
+// drainIterations waits for in-flight iterations to finish, up to timeout.
+// It returns the amount of iterations which are still running.
+func (r *runner) drainIterations(timeout time.Duration) int32 {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		active := atomic.LoadInt32(&r.activeIterations)
+		if active <= 0 || !time.Now().Before(deadline) {
+			return active
+		}
+		select {
+		case <-ticker.C:
+		case <-r.shutdownChan:
+			return atomic.LoadInt32(&r.activeIterations)
+		}
+	}
+}
+
 func (r *runner) addOutput(o Output) {
 	r.outputs = append(r.outputs, o)
 }
@@ -136,75 +328,145 @@ func (r *runner) outputOnStop() {
 	wg.Wait()
 }
 
-func (r *runner) spawnWorkers(spawnCount int, quit chan bool, spawnCompleteFunc func()) {
-	log.Println("Spawning", spawnCount, "clients immediately")
+func (r *runner) spawnWorkers(spawnCount int, spawnRate float64, quit chan bool, spawnCompleteFunc func()) {
+	ctx := r.newSpawnContext(quit)
+
+	spawned := r.spawnGradually(spawnCount, spawnRate, quit, func(n int) {
+		for i := atomic.LoadInt32(&r.numClients); i < int32(n); i++ {
+			atomic.AddInt32(&r.numClients, 1)
+			go r.runWorker(ctx, quit, nil, r.userAt(int(i)))
+		}
+	})
 
-	for i := 1; i <= spawnCount; i++ {
+	if spawned && spawnCompleteFunc != nil {
+		spawnCompleteFunc()
+	}
+}
+
+// spawnGradually calls spawn with the amount of users that should be running, which grows by spawnRate
+// every second until spawnCount is reached. If spawnRate <= 0, spawn is called with spawnCount at once.
+// It returns false if spawning is cancelled by quit or r.shutdownChan.
+func (r *runner) spawnGradually(spawnCount int, spawnRate float64, quit chan bool, spawn func(n int)) bool {
+	if spawnRate <= 0 {
+		log.Println("Spawning", spawnCount, "clients immediately")
+		spawn(spawnCount)
+		return true
+	}
+
+	log.Printf("Spawning %d clients at the rate %g clients/s\n", spawnCount, spawnRate)
+	ticker := time.NewTicker(spawnTickInterval)
+	defer ticker.Stop()
+	startTime := time.Now()
+	lastPublished := startTime
+	for {
+		// like locust, the first user is started immediately, then one every 1/spawnRate seconds.
+		n := int(spawnRate*time.Since(startTime).Seconds()) + 1
+		if n > spawnCount {
+			n = spawnCount
+		}
+		spawn(n)
+		if n >= spawnCount {
+			return true
+		}
+		if time.Since(lastPublished) >= time.Second {
+			lastPublished = time.Now()
+			Events.Publish(EVENT_SPAWN_PROGRESS, n, spawnRate)
+		}
+
+		select {
+		case <-quit:
+			return false
+		case <-r.shutdownChan:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// runWorker keeps running tasks of user in the current goroutine until quit, leave or r.shutdownChan is closed.
+// quit stops all the workers, and leave stops only this one, it can be nil. If user is nil, tasks are picked
+// from r.tasks.
+func (r *runner) runWorker(ctx context.Context, quit, leave chan bool, user *userClass) {
+	ctx = contextWithUserID(ctx, atomic.AddInt64(&r.lastUserID, 1))
+	// the intended start of the next task, it's zero if neither the rate limiter nor wait time is used.
+	var intendedStart time.Time
+	for {
 		select {
 		case <-quit:
-			// quit spawning goroutine
+			return
+		case <-leave:
 			return
 		case <-r.shutdownChan:
 			return
 		default:
-			atomic.AddInt32(&r.numClients, 1)
-			go func() {
-				for {
-					select {
-					case <-quit:
-						return
-					case <-r.shutdownChan:
-						return
-					default:
-						if r.rateLimitEnabled {
-							blocked := r.rateLimiter.Acquire()
-							if !blocked {
-								task := r.getTask()
-								r.safeRun(task.Fn)
-							}
-						} else {
-							task := r.getTask()
-							r.safeRun(task.Fn)
-						}
-					}
+			if r.rateLimitEnabled {
+				if intendedStart.IsZero() {
+					// the task should start now, the time blocked by the rate limiter is a delay.
+					intendedStart = time.Now()
 				}
-			}()
+				blocked := r.rateLimiter.Acquire()
+				if !blocked {
+					task := r.getTaskOf(user)
+					intendedStart = r.runTaskAndWait(ctx, quit, leave, user, task, intendedStart)
+				}
+			} else {
+				task := r.getTaskOf(user)
+				intendedStart = r.runTaskAndWait(ctx, quit, leave, user, task, intendedStart)
+			}
 		}
 	}
-
-	if spawnCompleteFunc != nil {
-		spawnCompleteFunc()
-	}
 }
 
-func (r *runner) newSpawnWorkers(spawnCount int, quit chan bool, spawnCompleteFunc func()) {
+func (r *runner) newSpawnWorkers(spawnCount int, spawnRate float64, quit chan bool, spawnCompleteFunc func()) {
 	//log.Println("Spawning clients dynamically")
-	pool, _ := ants.NewPool(spawnCount)
+	initialSize := spawnCount
+	if spawnRate > 0 {
+		initialSize = 1
+	}
+	pool, _ := ants.NewPool(initialSize)
+	defer pool.Release()
+	ctx := r.newSpawnContext(quit)
 	var rlimiter ratelimit.Limiter
 	if RateLimiterNum != 0 {
 		rlimiter = ratelimit.New(int(RateLimiterNum))
 	}
-	for {
+
+	// the pool grows to spawnCount at spawnRate, while the loop below keeps it busy.
+	go func() {
+		spawned := r.spawnGradually(spawnCount, spawnRate, quit, pool.Tune)
+		if spawned && spawnCompleteFunc != nil {
+			spawnCompleteFunc()
+		}
+	}()
+
+	// the pool isn't bound to users, so tasks of every user class are submitted in proportion to its count.
+	for i := 0; ; i++ {
 		select {
 		case <-quit:
 			return
 		case <-r.shutdownChan:
 			return
 		default:
+			var intendedStart time.Time
 			if rlimiter != nil {
+				// the task should start now, the time blocked by the rate limiter and the pool is a delay.
+				intendedStart = time.Now()
 				rlimiter.Take()
 			}
+			user := r.userAt(i)
+			// goroutines of the pool aren't users, so tasks are assigned to spawnCount virtual users in turn.
+			userCtx := ctx
+			if spawnCount > 0 {
+				userCtx = contextWithUserID(ctx, int64(i%spawnCount)+1)
+			}
 			pool.Submit(func() {
-				task := r.getTask()
-				r.safeRun(task.Fn)
+				task := r.getTaskOf(user)
+				// the goroutine of pool is occupied while waiting, like a user thinking.
+				r.runTaskAndWait(userCtx, quit, nil, user, task, intendedStart)
 			})
-			r.numClients = int32(pool.Running())
+			atomic.StoreInt32(&r.numClients, int32(pool.Running()))
 		}
 	}
-
-	if spawnCompleteFunc != nil {
-		spawnCompleteFunc()
-	}
 }
 
 //func (r *runner) spawnWorkers2(spawnCount int, quit chan bool, spawnCompleteFunc func()) {
@@ -251,25 +513,55 @@ func (r *runner) setTasks(t []*Task) {
 	r.totalTaskWeight = weightSum
 }
 
+// setUserClasses registers user classes, which are spawned by the count in master's spawn message.
+// waitTimes are the wait times of user classes, which are optional.
+func (r *runner) setUserClasses(userClasses map[string][]*Task, waitTimes map[string]WaitTime) {
+	r.userClasses = make(map[string]*userClass, len(userClasses))
+	for name, tasks := range userClasses {
+		r.userClasses[name] = newUserClass(name, tasks)
+		r.userClasses[name].waitTime = waitTimes[name]
+	}
+}
+
 func (r *runner) getTask() *Task {
-	tasksCount := len(r.tasks)
+	return pickTask(r.tasks, r.totalTaskWeight)
+}
+
+// userAt returns the user class of the i-th user in r.spawnPlan, or nil to use r.tasks.
+func (r *runner) userAt(i int) *userClass {
+	if len(r.spawnPlan) == 0 {
+		return nil
+	}
+	return r.spawnPlan[i%len(r.spawnPlan)]
+}
+
+// getTaskOf returns a task of user, or a task of r.tasks if user is nil.
+func (r *runner) getTaskOf(user *userClass) *Task {
+	if user == nil {
+		return r.getTask()
+	}
+	return user.getTask()
+}
+
+// pickTask returns a random task by weight.
+func pickTask(tasks []*Task, totalWeight int) *Task {
+	tasksCount := len(tasks)
 	if tasksCount == 1 {
 		// Fast path
-		return r.tasks[0]
+		return tasks[0]
 	}
 
 	rs := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	totalWeight := r.totalTaskWeight
 	if totalWeight <= 0 {
 		// If all the tasks have not weights defined, they have the same chance to run
 		randNum := rs.Intn(tasksCount)
-		return r.tasks[randNum]
+		return tasks[randNum]
 	}
 
 	randNum := rs.Intn(totalWeight)
 	runningSum := 0
-	for _, task := range r.tasks {
+	for _, task := range tasks {
 		runningSum += task.Weight
 		if runningSum > randNum {
 			return task
@@ -282,30 +574,106 @@ func (r *runner) getTask() *Task {
 func (r *runner) startSpawning(spawnCount int, spawnRate float64, spawnCompleteFunc func()) {
 	Events.Publish(EVENT_SPAWN, spawnCount, spawnRate)
 
-	r.stopChan = make(chan bool)
-	r.numClients = 0
+	stopChan := r.newStopChan()
+	atomic.StoreInt32(&r.numClients, 0)
 
-	if r.isOldSpawnWorker {
-		go r.spawnWorkers(spawnCount, r.stopChan, spawnCompleteFunc)
+	if r.arrivalRate != nil {
+		go r.runArrivalRate(spawnCount, stopChan, spawnCompleteFunc)
+	} else if r.isOldSpawnWorker {
+		go r.spawnWorkers(spawnCount, spawnRate, stopChan, spawnCompleteFunc)
 	} else {
-		go r.newSpawnWorkers(spawnCount, r.stopChan, spawnCompleteFunc)
+		go r.newSpawnWorkers(spawnCount, spawnRate, stopChan, spawnCompleteFunc)
+	}
+}
+
+// newStopChan replaces r.stopChan and r.drainedChan for a new spawn, and returns the new r.stopChan.
+// It must be called before starting any goroutine which may stop the workers.
+func (r *runner) newStopChan() chan bool {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	r.stopChan = make(chan bool)
+	r.drainedChan = make(chan bool)
+	return r.stopChan
+}
+
+// closeStopChan closes r.stopChan unless it's closed already, in which case closed is false.
+// drainedChan is the r.drainedChan of the same spawn, it can be nil.
+func (r *runner) closeStopChan() (stopChan, drainedChan chan bool, closed bool) {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	if r.stopChan == nil {
+		return nil, nil, false
 	}
+	select {
+	case <-r.stopChan:
+		return r.stopChan, r.drainedChan, false
+	default:
+	}
+	close(r.stopChan)
+	return r.stopChan, r.drainedChan, true
 }
 
+// stop stops all the workers gracefully. Workers don't start new iterations once r.stopChan is closed,
+// and in-flight iterations have r.drainTimeout to finish. Iterations still running after that are
+// abandoned, and reported as abandoned_iterations.
+// It can be called more than once and concurrently, the workers are stopped by the first call,
+// and the others return after the first one finishes draining.
 func (r *runner) stop() {
+	stopChan, drainedChan, closed := r.closeStopChan()
+	if stopChan == nil {
+		return
+	}
+	if !closed {
+		if drainedChan != nil {
+			select {
+			case <-drainedChan:
+			case <-r.shutdownChan:
+			}
+		}
+		return
+	}
+
 	// publish the boomer stop event
 	// user's code can subscribe to this event and do thins like cleaning up
 	Events.Publish(EVENT_STOP)
 
-	// stop previous goroutines without blocking
-	// those goroutines will exit when r.safeRun returns
-	close(r.stopChan)
+	if abandoned := r.drainIterations(r.drainTimeout); abandoned > 0 {
+		log.Printf("%d iterations are still running after waiting for %v, abandoned.\n", abandoned, r.drainTimeout)
+		r.stats.logAbandonedIterations(int64(abandoned))
+	}
+	if drainedChan != nil {
+		close(drainedChan)
+	}
+	atomic.StoreInt32(&r.numClients, 0)
+}
+
+// stopImmediately stops all the workers like runner.stop, but doesn't wait for in-flight iterations,
+// their context is cancelled at once. It's used when master rebalances users, so the worker keeps handling
+// messages from master, and the old users don't overlap the new ones.
+func (r *runner) stopImmediately() {
+	stopChan, drainedChan, closed := r.closeStopChan()
+	if stopChan == nil || !closed {
+		return
+	}
+	Events.Publish(EVENT_STOP)
+	if drainedChan != nil {
+		close(drainedChan)
+	}
+	atomic.StoreInt32(&r.numClients, 0)
 }
 
 type localRunner struct {
 	runner
 
 	spawnCount int
+	loadShape  LoadShape
+	// users which can be started or stopped by runLoadShape, rates below one user per tick are accumulated.
+	spawnAllowance float64
+	// if runTime > 0, the test is stopped and boomer quits after runTime.
+	runTime time.Duration
+
+	quitOnce     sync.Once
+	shutdownOnce sync.Once
 }
 
 func newLocalRunner(tasks []*Task, rateLimiter RateLimiter, spawnCount int, spawnRate float64) (r *localRunner) {
@@ -314,6 +682,8 @@ func newLocalRunner(tasks []*Task, rateLimiter RateLimiter, spawnCount int, spaw
 	r.spawnRate = spawnRate
 	r.spawnCount = spawnCount
 	r.shutdownChan = make(chan bool)
+	r.outputsStoppedChan = make(chan bool)
+	r.drainTimeout = defaultDrainTimeout
 
 	if rateLimiter != nil {
 		r.rateLimitEnabled = true
@@ -324,8 +694,14 @@ func newLocalRunner(tasks []*Task, rateLimiter RateLimiter, spawnCount int, spaw
 	return r
 }
 
+// setIterationLimit stops the test after limit iterations, a limit <= 0 disables it.
+func (r *localRunner) setIterationLimit(limit int64) {
+	r.iterationLimit = limit
+	r.iterationLimitChan = make(chan bool)
+}
+
 func (r *localRunner) run() {
-	r.state = stateInit
+	r.setState(stateInit)
 	r.stats.start()
 	r.outputOnStart()
 
@@ -335,13 +711,19 @@ func (r *localRunner) run() {
 		for {
 			select {
 			case data := <-r.stats.messageToRunnerChan:
-				data["user_count"] = r.numClients
+				data["user_count"] = atomic.LoadInt32(&r.numClients)
+				data["state"] = r.getState()
 				r.outputOnEevent(data)
 			case <-r.shutdownChan:
 				Events.Publish(EVENT_QUIT)
-				//r.stop()
-				wg.Done()
+				// flush the stats since the last report, so outputs don't lose the end of the test.
+				data := r.stats.report()
+				data["user_count"] = atomic.LoadInt32(&r.numClients)
+				data["state"] = r.getState()
+				r.outputOnEevent(data)
 				r.outputOnStop()
+				close(r.outputsStoppedChan)
+				wg.Done()
 				return
 			}
 		}
@@ -350,19 +732,145 @@ func (r *localRunner) run() {
 	if r.rateLimitEnabled {
 		r.rateLimiter.Start()
 	}
-	r.startSpawning(r.spawnCount, r.spawnRate, nil)
+	if r.loadShape != nil {
+		go r.runLoadShape(r.newStopChan())
+	} else {
+		r.startSpawning(r.spawnCount, r.spawnRate, nil)
+	}
+	if r.runTime > 0 || r.iterationLimit > 0 {
+		go r.quitWhenFinished()
+	}
 
 	wg.Wait()
 }
 
-func (r *localRunner) shutdown() {
-	if r.stats != nil {
-		r.stats.close()
+// quitWhenFinished waits for r.runTime or r.iterationLimit, then stops the test gracefully and quits.
+func (r *localRunner) quitWhenFinished() {
+	var timeout <-chan time.Time
+	if r.runTime > 0 {
+		timer := time.NewTimer(r.runTime)
+		defer timer.Stop()
+		timeout = timer.C
 	}
-	if r.rateLimitEnabled {
-		r.rateLimiter.Stop()
+	select {
+	case <-timeout:
+		log.Printf("Run time limit %v is reached, stopping the test.\n", r.runTime)
+	case <-r.iterationLimitChan:
+		log.Printf("Iteration limit %d is reached, stopping the test.\n", r.iterationLimit)
+	case <-r.shutdownChan:
+		return
 	}
-	close(r.shutdownChan)
+	r.stopAndQuit()
+}
+
+// stopAndQuit stops the test gracefully, then shuts down the runner, so run returns.
+// It's called once, by either the run time limit, the iteration limit or a breached threshold.
+func (r *localRunner) stopAndQuit() {
+	r.quitOnce.Do(func() {
+		// runner.stop only stops the workers once, if the load shape is finished and stopping them,
+		// it waits for them to drain.
+		r.stop()
+		r.setState(stateStopped)
+		r.shutdown()
+	})
+}
+
+// runLoadShape asks r.loadShape for the target amount of users every loadShapeTickInterval,
+// and starts or stops workers to follow it. All the workers are stopped when stopChan is closed.
+func (r *localRunner) runLoadShape(stopChan chan bool) {
+	r.setState(stateSpawning)
+	ctx := r.newSpawnContext(stopChan)
+
+	// every worker also has its own leave channel, so the pool can shrink.
+	var workers []chan bool
+	startTime := time.Now()
+	ticker := time.NewTicker(loadShapeTickInterval)
+	defer ticker.Stop()
+	for {
+		userCount, spawnRate, ok := r.loadShape.Tick(time.Since(startTime))
+		if !ok {
+			log.Println("Load shape is finished, stopping all the users.")
+			r.stop()
+			r.setState(stateStopped)
+			return
+		}
+		if workers == nil {
+			Events.Publish(EVENT_SPAWN, userCount, spawnRate)
+		}
+		workers = r.resizeWorkers(ctx, stopChan, workers, userCount, spawnRate)
+
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			// stopped by runner.stop, which waits for the workers to drain
+			return
+		case <-r.shutdownChan:
+			return
+		}
+	}
+}
+
+// resizeWorkers starts or stops workers towards userCount, at most spawnRate workers per second.
+// workers are the leave channels of running workers, and stopChan stops all of them.
+func (r *localRunner) resizeWorkers(ctx context.Context, stopChan chan bool, workers []chan bool, userCount int, spawnRate float64) []chan bool {
+	if userCount < 0 {
+		userCount = 0
+	}
+	diff := userCount - len(workers)
+	if diff == 0 {
+		r.spawnAllowance = 0
+		r.setState(stateRunning)
+		return workers
+	}
+
+	step := diff
+	if step < 0 {
+		step = -step
+	}
+	if spawnRate > 0 {
+		// with a spawn rate below one user per tick, a user is started once enough ticks are passed.
+		r.spawnAllowance += spawnRate * loadShapeTickInterval.Seconds()
+		if maxStep := int(r.spawnAllowance); step > maxStep {
+			step = maxStep
+		}
+		r.spawnAllowance -= float64(step)
+	}
+
+	if diff > 0 {
+		for i := 0; i < step; i++ {
+			leave := make(chan bool)
+			workers = append(workers, leave)
+			go r.runWorker(ctx, stopChan, leave, nil)
+		}
+	} else {
+		for _, leave := range workers[len(workers)-step:] {
+			close(leave)
+		}
+		workers = workers[:len(workers)-step]
+	}
+
+	atomic.StoreInt32(&r.numClients, int32(len(workers)))
+	if len(workers) == userCount {
+		r.spawnAllowance = 0
+		r.setState(stateRunning)
+	} else {
+		r.setState(stateSpawning)
+	}
+	Events.Publish(EVENT_SPAWN_PROGRESS, len(workers), spawnRate)
+	return workers
+}
+
+// shutdown can be called more than once, for example, by Boomer.Quit after the run time limit is reached.
+func (r *localRunner) shutdown() {
+	r.shutdownOnce.Do(func() {
+		if r.stats != nil {
+			r.stats.close()
+		}
+		if r.rateLimitEnabled {
+			r.rateLimiter.Stop()
+		}
+		close(r.shutdownChan)
+	})
 }
 
 func (r *localRunner) sendCustomMessage(messageType string, data interface{}) {
@@ -378,9 +886,24 @@ type slaveRunner struct {
 	nodeID                     string
 	masterHost                 string
 	masterPort                 int
-	waitForAck                 sync.WaitGroup
+	waitForAck                 *sync.WaitGroup
 	lastReceivedSpawnTimestamp int64
 	client                     client
+
+	// client_ready is sent by the listener, and by drainAndSendClientStopped after a stop.
+	waitForAckLock sync.Mutex
+
+	// unix timestamp in nanoseconds of the last heartbeat from master, accessed atomically.
+	lastMasterHeartbeat int64
+	// if no heartbeat is received from master in this duration, runner will reconnect.
+	masterHeartbeatTimeout time.Duration
+	// 1 if runner is reconnecting to master, accessed atomically.
+	reconnecting int32
+	// reconnect is requested by sending to this channel, it's handled by the listener goroutine,
+	// so it doesn't overlap messages from master.
+	reconnectChan chan bool
+
+	shutdownOnce sync.Once
 }
 
 func newSlaveRunner(masterHost string, masterPort int, tasks []*Task, rateLimiter RateLimiter) (r *slaveRunner) {
@@ -388,9 +911,12 @@ func newSlaveRunner(masterHost string, masterPort int, tasks []*Task, rateLimite
 	r.masterHost = masterHost
 	r.masterPort = masterPort
 	r.setTasks(tasks)
-	r.waitForAck = sync.WaitGroup{}
 	r.nodeID = getNodeID()
 	r.shutdownChan = make(chan bool)
+	r.outputsStoppedChan = make(chan bool)
+	r.reconnectChan = make(chan bool, 1)
+	r.masterHeartbeatTimeout = defaultMasterHeartbeatTimeout
+	r.drainTimeout = defaultDrainTimeout
 
 	if rateLimiter != nil {
 		r.rateLimitEnabled = true
@@ -401,31 +927,44 @@ func newSlaveRunner(masterHost string, masterPort int, tasks []*Task, rateLimite
 	return r
 }
 
+// reportedUserClassesCount returns the amount of users of every class reported to master.
+func (r *slaveRunner) reportedUserClassesCount() map[string]int64 {
+	if len(r.userClasses) > 0 {
+		return r.userClassesCount
+	}
+	return r.userClassesCountFromMaster
+}
+
 func (r *slaveRunner) spawnComplete() {
 	data := make(map[string]interface{})
-	data["count"] = r.numClients
-	data["user_classes_count"] = r.userClassesCountFromMaster
+	data["count"] = atomic.LoadInt32(&r.numClients)
+	data["user_classes_count"] = r.reportedUserClassesCount()
+	data["state"] = r.getState()
+	data["node_id"] = r.nodeID
 	r.client.sendChannel() <- newGenericMessage("spawning_complete", data, r.nodeID)
-	r.state = stateRunning
+	r.setState(stateRunning)
 }
 
 func (r *slaveRunner) onQuiting() {
-	if r.state != stateQuitting {
+	if r.getState() != stateQuitting {
 		r.client.sendChannel() <- newGenericMessage("quit", nil, r.nodeID)
 	}
 }
 
+// shutdown can be called more than once, for example, by Boomer.Quit after a threshold aborts the test.
 func (r *slaveRunner) shutdown() {
-	if r.stats != nil {
-		r.stats.close()
-	}
-	if r.client != nil {
-		r.client.close()
-	}
-	if r.rateLimitEnabled {
-		r.rateLimiter.Stop()
-	}
-	close(r.shutdownChan)
+	r.shutdownOnce.Do(func() {
+		if r.stats != nil {
+			r.stats.close()
+		}
+		if r.client != nil {
+			r.client.close()
+		}
+		if r.rateLimitEnabled {
+			r.rateLimiter.Stop()
+		}
+		close(r.shutdownChan)
+	})
 }
 
 func (r *slaveRunner) sumUsersAmount(msg *genericMessage) int {
@@ -448,10 +987,11 @@ func (r *slaveRunner) sumUsersAmount(msg *genericMessage) int {
 	return amount
 }
 
-// TODO: Since locust 2.0, spawn rate and user count are both handled by master.
+// Since locust 2.0, spawn rate and user count are both handled by master.
 // But user count is divided by user classes defined in locustfile, because locust assumes that
-// master and workers use the same locustfile. Before we find a better way to deal with this,
-// boomer sums up the total amout of users in spawn message and uses task weight to spawn goroutines like before.
+// master and workers use the same locustfile. If user classes are registered by Boomer.RegisterUserClass,
+// boomer spawns the count of every class, otherwise it sums up the total amount of users in spawn message
+// and uses task weight to spawn goroutines like before.
 func (r *slaveRunner) onSpawnMessage(msg *genericMessage) {
 	if timeStamp, ok := msg.Data["timestamp"]; ok {
 		if timeStampInt64, ok := castToInt64(timeStamp); ok {
@@ -466,7 +1006,16 @@ func (r *slaveRunner) onSpawnMessage(msg *genericMessage) {
 
 	r.client.sendChannel() <- newGenericMessage("spawning", nil, r.nodeID)
 	workers := r.sumUsersAmount(msg)
-	r.startSpawning(workers, float64(workers), r.spawnComplete)
+	if len(r.userClasses) > 0 {
+		r.spawnPlan, r.userClassesCount = buildSpawnPlan(r.userClasses, r.userClassesCountFromMaster, len(r.tasks) > 0)
+		workers = len(r.spawnPlan)
+	}
+	// master ramps users up by itself, so they're spawned at once, unless master sends spawn_rate.
+	spawnRate := float64(0)
+	if rate, ok := castToFloat64(msg.Data["spawn_rate"]); ok {
+		spawnRate = rate
+	}
+	r.startSpawning(workers, spawnRate, r.spawnComplete)
 }
 
 // TODO: consider to add register_message instead of publishing any unknown type as custom_message.
@@ -478,18 +1027,86 @@ func (r *slaveRunner) onCustomMessage(msg *CustomMessage) {
 }
 
 func (r *slaveRunner) onAckMessage(msg *genericMessage) {
-	r.waitForAck.Done()
+	// a duplicated ack is ignored
+	r.waitForAckLock.Lock()
+	if r.waitForAck != nil {
+		r.waitForAck.Done()
+		r.waitForAck = nil
+	}
+	r.waitForAckLock.Unlock()
 	Events.Publish(EVENT_CONNECTED)
 }
 
+func (r *slaveRunner) onHeartbeatMessage(msg *genericMessage) {
+	atomic.StoreInt64(&r.lastMasterHeartbeat, time.Now().UnixNano())
+}
+
+// masterHeartbeatTimedOut returns true if there is no heartbeat from master in masterHeartbeatTimeout.
+func (r *slaveRunner) masterHeartbeatTimedOut() bool {
+	if r.masterHeartbeatTimeout <= 0 {
+		return false
+	}
+	last := atomic.LoadInt64(&r.lastMasterHeartbeat)
+	return time.Since(time.Unix(0, last)) > r.masterHeartbeatTimeout
+}
+
+// requestReconnect asks the listener goroutine to reconnect to master.
+// It returns false if runner is reconnecting already.
+func (r *slaveRunner) requestReconnect() bool {
+	if !atomic.CompareAndSwapInt32(&r.reconnecting, 0, 1) {
+		return false
+	}
+	r.reconnectChan <- true
+	return true
+}
+
+// reconnect stops all the workers, connects to master again with backoff and sends client_ready,
+// like a new worker. It's used when master restarts or the connection is broken.
+// It's called by the listener goroutine, see requestReconnect.
+func (r *slaveRunner) reconnect() {
+	defer atomic.StoreInt32(&r.reconnecting, 0)
+
+	if r.getState() == stateSpawning || r.getState() == stateRunning {
+		r.stop()
+	}
+	r.setState(stateInit)
+
+	backoff := minReconnectBackoff
+	for {
+		log.Printf("Reconnecting to master(%s:%d)\n", r.masterHost, r.masterPort)
+		err := r.client.reconnect()
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to reconnect to master(%s:%d) with error %v, retry in %v\n", r.masterHost, r.masterPort, err, backoff)
+		select {
+		case <-r.shutdownChan:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+
+	// a new master starts a new test, don't compare with timestamps from the old one.
+	r.lastReceivedSpawnTimestamp = 0
+	atomic.StoreInt64(&r.lastMasterHeartbeat, time.Now().UnixNano())
+	r.sendClientReadyAndWaitForAck()
+}
+
 func (r *slaveRunner) sendClientReadyAndWaitForAck() {
-	r.waitForAck = sync.WaitGroup{}
-	r.waitForAck.Add(1)
+	waitForAck := &sync.WaitGroup{}
+	waitForAck.Add(1)
+	r.waitForAckLock.Lock()
+	r.waitForAck = waitForAck
+	r.waitForAckLock.Unlock()
 	// locust allows workers to bypass version check by sending -1 as version
 	r.client.sendChannel() <- newClientReadyMessage("client_ready", -1, r.nodeID)
 
 	go func() {
-		if waitTimeout(&r.waitForAck, 5*time.Second) {
+		if waitTimeout(waitForAck, 5*time.Second) {
 			log.Println("Timeout waiting for ack message from master, you may use a locust version before 2.10.0 or have a network issue.")
 		}
 	}()
@@ -514,13 +1131,23 @@ func (r *slaveRunner) onMessage(msgInterface message) {
 		}
 	}
 
-	switch r.state {
+	switch msgType {
+	case "heartbeat":
+		r.onHeartbeatMessage(genericMsg)
+		return
+	case "reconnect":
+		// master doesn't know this worker, it may be restarted.
+		r.requestReconnect()
+		return
+	}
+
+	switch r.getState() {
 	case stateInit:
 		switch msgType {
 		case "ack":
 			r.onAckMessage(genericMsg)
 		case "spawn":
-			r.state = stateSpawning
+			r.setState(stateSpawning)
 			r.stats.clearStatsChan <- true
 			r.onSpawnMessage(genericMsg)
 		case "quit":
@@ -533,39 +1160,72 @@ func (r *slaveRunner) onMessage(msgInterface message) {
 	case stateRunning:
 		switch msgType {
 		case "spawn":
-			r.state = stateSpawning
-			r.stop()
+			// users are rebalanced by master, stop them without draining, so messages are still handled.
+			r.setState(stateSpawning)
+			r.stopImmediately()
 			r.onSpawnMessage(genericMsg)
 		case "stop":
-			r.stop()
-			r.state = stateStopped
-			log.Println("Recv stop message from master, all the goroutines are stopped")
-			r.client.sendChannel() <- newGenericMessage("client_stopped", nil, r.nodeID)
-			r.sendClientReadyAndWaitForAck()
-			r.state = stateInit
+			// iterations are drained in the background, so heartbeats and quit from master are still handled.
+			r.setState(stateStopping)
+			go r.drainAndSendClientStopped()
 		case "quit":
 			r.stop()
 			log.Println("Recv quit message from master, all the goroutines are stopped")
 			Events.Publish(EVENT_QUIT)
-			r.state = stateInit
+			r.setState(stateInit)
+		default:
+			r.onCustomMessage(customMsg)
+		}
+	case stateStopping:
+		switch msgType {
+		case "quit":
+			// the workers are stopped by shutdown, drainAndSendClientStopped doesn't send client_stopped.
+			Events.Publish(EVENT_QUIT)
+			r.setState(stateInit)
 		default:
 			r.onCustomMessage(customMsg)
 		}
 	case stateStopped:
 		switch msgType {
 		case "spawn":
-			r.state = stateSpawning
+			r.setState(stateSpawning)
 			r.stats.clearStatsChan <- true
 			r.onSpawnMessage(genericMsg)
 		case "quit":
 			Events.Publish(EVENT_QUIT)
-			r.state = stateInit
+			r.setState(stateInit)
 		default:
 			r.onCustomMessage(customMsg)
 		}
 	}
 }
 
+// drainAndSendClientStopped stops the workers and waits for in-flight iterations to drain,
+// then tells master the worker is stopped and ready again, unless it's quit while draining.
+func (r *slaveRunner) drainAndSendClientStopped() {
+	r.stop()
+	if !r.swapState(stateStopping, stateStopped) {
+		return
+	}
+	log.Println("Recv stop message from master, all the goroutines are stopped")
+	// report the stats of drained iterations before client_stopped, or they are lost.
+	r.reportStats(r.stats.report())
+	r.client.sendChannel() <- newGenericMessage("client_stopped", nil, r.nodeID)
+	// a spawn following client_ready is handled as ready
+	r.setState(stateInit)
+	r.sendClientReadyAndWaitForAck()
+}
+
+// reportStats sends data collected by r.stats to master and outputs.
+func (r *slaveRunner) reportStats(data map[string]interface{}) {
+	data["user_count"] = atomic.LoadInt32(&r.numClients)
+	data["user_classes_count"] = r.reportedUserClassesCount()
+	data["state"] = r.getState()
+	data["node_id"] = r.nodeID
+	r.client.sendChannel() <- newGenericMessage("stats", stripLocalStats(data), r.nodeID)
+	r.outputOnEevent(data)
+}
+
 func (r *slaveRunner) sendCustomMessage(messageType string, data interface{}) {
 	msg := newCustomMessage(messageType, data, r.nodeID)
 	r.client.sendChannel() <- msg
@@ -577,6 +1237,8 @@ func (r *slaveRunner) startListener() {
 			select {
 			case msg := <-r.client.recvChannel():
 				r.onMessage(msg)
+			case <-r.reconnectChan:
+				r.reconnect()
 			case <-r.shutdownChan:
 				return
 			}
@@ -585,7 +1247,7 @@ func (r *slaveRunner) startListener() {
 }
 
 func (r *slaveRunner) run() {
-	r.state = stateInit
+	r.setState(stateInit)
 	r.client = newClient(r.masterHost, r.masterPort, r.nodeID)
 
 	err := r.client.connect()
@@ -595,12 +1257,10 @@ func (r *slaveRunner) run() {
 		} else {
 			log.Printf("Failed to connect to master(%s:%d) with error %v\n", r.masterHost, r.masterPort, err)
 		}
+		close(r.outputsStoppedChan)
 		return
 	}
 
-	// listen to master
-	r.startListener()
-
 	r.stats.start()
 	r.outputOnStart()
 
@@ -608,22 +1268,24 @@ func (r *slaveRunner) run() {
 		r.rateLimiter.Start()
 	}
 
+	atomic.StoreInt64(&r.lastMasterHeartbeat, time.Now().UnixNano())
 	r.sendClientReadyAndWaitForAck()
 
+	// listen to master, after client_ready is sent, so the ack is handled by the listener goroutine.
+	r.startListener()
+
 	// report to master
 	go func() {
 		for {
 			select {
 			case data := <-r.stats.messageToRunnerChan:
-				if r.state == stateInit || r.state == stateStopped {
+				if r.getState() == stateInit || r.getState() == stateStopped {
 					continue
 				}
-				data["user_count"] = r.numClients
-				data["user_classes_count"] = r.userClassesCountFromMaster
-				r.client.sendChannel() <- newGenericMessage("stats", data, r.nodeID)
-				r.outputOnEevent(data)
+				r.reportStats(data)
 			case <-r.shutdownChan:
 				r.outputOnStop()
+				close(r.outputsStoppedChan)
 				return
 			}
 		}
@@ -638,10 +1300,15 @@ func (r *slaveRunner) run() {
 			case <-ticker.C:
 				CPUUsage := GetCurrentCPUUsage()
 				data := map[string]interface{}{
-					"state":             r.state,
-					"current_cpu_usage": CPUUsage,
+					"state":              r.getState(),
+					"current_cpu_usage":  CPUUsage,
+					"count":              atomic.LoadInt32(&r.numClients),
+					"user_classes_count": r.reportedUserClassesCount(),
 				}
 				r.client.sendChannel() <- newGenericMessage("heartbeat", data, r.nodeID)
+				if r.masterHeartbeatTimedOut() && r.requestReconnect() {
+					log.Printf("No heartbeat from master in %v, the master may be restarted or the connection is broken.\n", r.masterHeartbeatTimeout)
+				}
 			case <-r.shutdownChan:
 				return
 			}
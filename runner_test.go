@@ -1,6 +1,8 @@
 package boomer
 
 import (
+	"context"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -97,6 +99,164 @@ func TestLocalRunner(t *testing.T) {
 	assert.Equal(t, int32(2), currentClients)
 }
 
+func TestLocalRunnerWithLoadShape(t *testing.T) {
+	defaultTickInterval := loadShapeTickInterval
+	loadShapeTickInterval = 50 * time.Millisecond
+	defer func() {
+		loadShapeTickInterval = defaultTickInterval
+	}()
+
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+		},
+		Name: "TaskA",
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 0, 0)
+	runner.loadShape = NewStagesShape(Stage{Duration: 300 * time.Millisecond, Users: 3})
+
+	go runner.run()
+	defer runner.shutdown()
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&runner.numClients))
+	assert.Equal(t, stateRunning, runner.getState())
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runner.numClients))
+	assert.Equal(t, stateStopped, runner.getState())
+}
+
+func TestLocalRunnerWithRunTime(t *testing.T) {
+	runner := newLocalRunner(nil, nil, 2, 0)
+	runner.setTasks([]*Task{{
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+			runner.stats.recordSuccess("http", "foo", 10, 0, 10)
+		},
+		Name: "TaskA",
+	}})
+	runner.runTime = 300 * time.Millisecond
+	output := &captureOutput{}
+	runner.addOutput(output)
+	defer runner.shutdown()
+
+	done := make(chan bool)
+	go func() {
+		runner.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the run time limit")
+	}
+
+	// the final report is passed to outputs before run returns
+	numRequests, _ := output.numRequests()
+	assert.True(t, numRequests > 0)
+	assert.True(t, output.stopped)
+	assert.Equal(t, stateStopped, runner.getState())
+}
+
+func TestLocalRunnerWithRunTimeAndLoadShape(t *testing.T) {
+	defaultTickInterval := loadShapeTickInterval
+	loadShapeTickInterval = 20 * time.Millisecond
+	defer func() {
+		loadShapeTickInterval = defaultTickInterval
+	}()
+
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(50 * time.Millisecond)
+		},
+		Name: "TaskA",
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 0, 0)
+	// the load shape is finished and draining when the run time limit is reached
+	runner.loadShape = NewStagesShape(Stage{Duration: 100 * time.Millisecond, Users: 3})
+	runner.runTime = 110 * time.Millisecond
+	defer runner.shutdown()
+
+	done := make(chan bool)
+	go func() {
+		runner.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the run time limit")
+	}
+	assert.Equal(t, stateStopped, runner.getState())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runner.activeIterations))
+}
+
+func TestLocalRunnerWithIterationLimit(t *testing.T) {
+	calls := int64(0)
+	taskA := &Task{
+		Fn: func() {
+			atomic.AddInt64(&calls, 1)
+			time.Sleep(time.Millisecond)
+		},
+		Name: "TaskA",
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 3, 0)
+	runner.SetIsOldSpawnWorker(true)
+	runner.setIterationLimit(20)
+	defer runner.shutdown()
+
+	done := make(chan bool)
+	go func() {
+		runner.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the iteration limit")
+	}
+	assert.Equal(t, int64(20), atomic.LoadInt64(&calls))
+}
+
+func TestResizeWorkers(t *testing.T) {
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+		},
+		Name: "TaskA",
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 0, 0)
+	defer runner.shutdown()
+	ctx := context.Background()
+
+	stopChan := runner.newStopChan()
+	defer runner.stop()
+
+	workers := runner.resizeWorkers(ctx, stopChan, nil, 10, 0)
+	assert.Equal(t, 10, len(workers))
+	assert.Equal(t, stateRunning, runner.getState())
+
+	// 2.5 workers per tick, the half is started in the next tick
+	workers = runner.resizeWorkers(ctx, stopChan, workers, 20, 2.5)
+	assert.Equal(t, 12, len(workers))
+	assert.Equal(t, stateSpawning, runner.getState())
+	workers = runner.resizeWorkers(ctx, stopChan, workers, 20, 2.5)
+	assert.Equal(t, 15, len(workers))
+
+	workers = runner.resizeWorkers(ctx, stopChan, workers, 5, 0)
+	assert.Equal(t, 5, len(workers))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&runner.numClients))
+
+	// a worker every 5 ticks
+	for i := 0; i < 4; i++ {
+		workers = runner.resizeWorkers(ctx, stopChan, workers, 10, 0.2)
+		assert.Equal(t, 5, len(workers))
+	}
+	workers = runner.resizeWorkers(ctx, stopChan, workers, 10, 0.2)
+	assert.Equal(t, 6, len(workers))
+}
+
 func TestLocalRunnerSendCustomMessage(t *testing.T) {
 	Events.SubscribeOnce("TestLocalRunnerSendCustomMessage", func(customMessage *CustomMessage) {
 		assert.Equal(t, "local", customMessage.NodeID)
@@ -126,13 +286,134 @@ func TestSpawnWorkers(t *testing.T) {
 	runner.client = newClient("localhost", 5557, runner.nodeID)
 	defer runner.shutdown()
 
-	go runner.spawnWorkers(10, runner.stopChan, runner.spawnComplete)
+	go runner.spawnWorkers(10, 0, runner.stopChan, runner.spawnComplete)
 	time.Sleep(10 * time.Millisecond)
 
 	currentClients := atomic.LoadInt32(&runner.numClients)
 	assert.Equal(t, int32(10), currentClients)
 }
 
+func TestSpawnWorkersGradually(t *testing.T) {
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 8, 5)
+	runner.stopChan = make(chan bool)
+	defer runner.shutdown()
+
+	progress := make(chan int, 10)
+	handler := func(n int, spawnRate float64) {
+		progress <- n
+	}
+	Events.Subscribe(EVENT_SPAWN_PROGRESS, handler)
+	defer Events.Unsubscribe(EVENT_SPAWN_PROGRESS, handler)
+
+	completed := make(chan bool, 1)
+	go runner.spawnWorkers(8, 5, runner.stopChan, func() {
+		completed <- true
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runner.numClients))
+
+	select {
+	case n := <-progress:
+		// about 1 + 5 users are running after a second
+		assert.True(t, n >= 6 && n < 8, n)
+	case <-completed:
+		t.Fatal("spawnComplete should not be called before the target is reached")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for spawning progress")
+	}
+
+	select {
+	case <-completed:
+		assert.Equal(t, int32(8), atomic.LoadInt32(&runner.numClients))
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for spawnComplete")
+	}
+	runner.stop()
+}
+
+func TestSpawnWorkersGraduallyAndStop(t *testing.T) {
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+	runner := newLocalRunner([]*Task{taskA}, nil, 100, 5)
+	runner.stopChan = make(chan bool)
+	defer runner.shutdown()
+
+	completed := int32(0)
+	go runner.newSpawnWorkers(100, 5, runner.stopChan, func() {
+		atomic.StoreInt32(&completed, 1)
+	})
+	time.Sleep(50 * time.Millisecond)
+	runner.stop()
+	time.Sleep(300 * time.Millisecond)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&completed))
+	assert.True(t, atomic.LoadInt32(&runner.numClients) <= 1)
+}
+
+func TestRunTaskAndWait(t *testing.T) {
+	runner := newLocalRunner(nil, nil, 1, 1)
+	defer runner.shutdown()
+	quit := make(chan bool)
+
+	// pacing is measured from the start of the task
+	task := &Task{
+		Fn: func() {
+			time.Sleep(30 * time.Millisecond)
+		},
+		WaitTime: ConstantPacing(100 * time.Millisecond),
+	}
+	start := time.Now()
+	runner.runTaskAndWait(context.Background(), quit, nil, nil, task, time.Time{})
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < 150*time.Millisecond, elapsed)
+
+	// the wait time of user class is used if the task doesn't have one
+	user := newUserClass("A", []*Task{{Fn: func() {}}})
+	user.waitTime = Constant(time.Minute)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(quit)
+	}()
+	start = time.Now()
+	runner.runTaskAndWait(context.Background(), quit, nil, user, user.getTask(), time.Time{})
+	elapsed = time.Since(start)
+	assert.True(t, elapsed >= 50*time.Millisecond && elapsed < time.Second, elapsed)
+}
+
+func TestRunTaskAndWaitWithIntendedStart(t *testing.T) {
+	runner := newLocalRunner(nil, nil, 1, 1)
+	defer runner.shutdown()
+
+	task := &Task{
+		Name: "slow",
+		Fn: func() {
+			time.Sleep(30 * time.Millisecond)
+		},
+		WaitTime: ConstantPacing(20 * time.Millisecond),
+	}
+	// the task is delayed for 100ms
+	intendedStart := time.Now().Add(-100 * time.Millisecond)
+	next := runner.runTaskAndWait(context.Background(), make(chan bool), nil, nil, task, intendedStart)
+
+	runner.stats.mergeShards()
+	corrected := runner.stats.correctedEntries["slow"]
+	if assert.NotNil(t, corrected) {
+		assert.Equal(t, int64(1), corrected.NumRequests)
+		assert.True(t, corrected.MaxResponseTime >= 130 && corrected.MaxResponseTime < 200, corrected.MaxResponseTime)
+	}
+	// the task is slower than the pacing, so the next task is late already
+	assert.True(t, next.Before(time.Now()))
+}
+
 func TestSpawnWorkersWithManyTasks(t *testing.T) {
 	oneTaskCalls := int64(0)
 	tenTaskCalls := int64(0)
@@ -168,7 +449,7 @@ func TestSpawnWorkersWithManyTasks(t *testing.T) {
 
 	const numToSpawn int = 30
 
-	runner.spawnWorkers(numToSpawn, runner.stopChan, runner.spawnComplete)
+	runner.spawnWorkers(numToSpawn, 0, runner.stopChan, runner.spawnComplete)
 	time.Sleep(3 * time.Second)
 
 	currentClients := atomic.LoadInt32(&runner.numClients)
@@ -202,6 +483,33 @@ func TestSpawnWorkersWithManyTasks(t *testing.T) {
 	}
 }
 
+func TestSpawnWorkersWithContext(t *testing.T) {
+	cancelled := int64(0)
+	taskA := &Task{
+		Name: "longPoll",
+		FnCtx: func(ctx context.Context) {
+			select {
+			case <-ctx.Done():
+				atomic.AddInt64(&cancelled, 1)
+			case <-time.After(time.Minute):
+			}
+		},
+	}
+
+	runner := newSlaveRunner("localhost", 5557, []*Task{taskA}, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	defer runner.shutdown()
+
+	runner.stopChan = make(chan bool)
+	go runner.spawnWorkers(5, 0, runner.stopChan, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	runner.stop()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, int64(5), atomic.LoadInt64(&cancelled))
+}
+
 func TestSpawnAndStop(t *testing.T) {
 	taskA := &Task{
 		Fn: func() {
@@ -215,14 +523,14 @@ func TestSpawnAndStop(t *testing.T) {
 	}
 
 	runner := newSlaveRunner("localhost", 5557, []*Task{taskA, taskB}, nil)
-	runner.state = stateSpawning
+	runner.setState(stateSpawning)
 	runner.client = newClient("localhost", 5557, runner.nodeID)
 	defer runner.shutdown()
 
 	runner.startSpawning(10, float64(10), runner.spawnComplete)
 	// wait for spawning goroutines
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, int32(10), runner.numClients)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&runner.numClients))
 
 	msg := <-runner.client.sendChannel()
 	m := msg.(*genericMessage)
@@ -266,7 +574,7 @@ func TestOnSpawnMessage(t *testing.T) {
 	}
 	runner := newSlaveRunner("localhost", 5557, []*Task{taskA}, nil)
 	runner.client = newClient("localhost", 5557, runner.nodeID)
-	runner.state = stateInit
+	runner.setState(stateInit)
 	defer runner.shutdown()
 
 	workers, spawnRate := 0, float64(0)
@@ -286,15 +594,204 @@ func TestOnSpawnMessage(t *testing.T) {
 	}, runner.nodeID))
 
 	assert.Equal(t, 20, workers)
-	assert.Equal(t, float64(20), spawnRate)
+	// spawned at once, master ramps users up
+	assert.Equal(t, float64(0), spawnRate)
+	runner.stopImmediately()
+
+	runner.onSpawnMessage(newGenericMessage("spawn", map[string]interface{}{
+		"user_classes_count": map[interface{}]interface{}{
+			"Dummy": int64(10),
+		},
+		"spawn_rate": float64(5),
+		"timestamp":  2,
+	}, runner.nodeID))
+	assert.Equal(t, 10, workers)
+	assert.Equal(t, float64(5), spawnRate)
+	runner.stopImmediately()
+
+	// msgpack decodes an integral spawn_rate as an integer
+	runner.onSpawnMessage(newGenericMessage("spawn", map[string]interface{}{
+		"user_classes_count": map[interface{}]interface{}{
+			"Dummy": int64(10),
+		},
+		"spawn_rate": int64(2),
+		"timestamp":  3,
+	}, runner.nodeID))
+	assert.Equal(t, float64(2), spawnRate)
 
 	runner.onMessage(newGenericMessage("stop", nil, runner.nodeID))
 }
 
+func TestOnSpawnMessageWithUserClasses(t *testing.T) {
+	counts := map[string]*int64{"A": new(int64), "B": new(int64)}
+	newTask := func(class string) *Task {
+		return &Task{
+			FnCtx: func(ctx context.Context) {
+				atomic.AddInt64(counts[class], 1)
+				<-ctx.Done()
+			},
+		}
+	}
+
+	runner := newSlaveRunner("localhost", 5557, nil, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	runner.SetIsOldSpawnWorker(true)
+	runner.setUserClasses(map[string][]*Task{
+		"A": {newTask("A")},
+		"B": {newTask("B")},
+	}, nil)
+	// tasks only return when they are cancelled, don't wait for them.
+	runner.drainTimeout = 0
+	defer runner.shutdown()
+
+	runner.onSpawnMessage(newGenericMessage("spawn", map[string]interface{}{
+		"user_classes_count": map[interface{}]interface{}{
+			"A":       int64(2),
+			"B":       int64(3),
+			"Unknown": int64(4),
+		},
+		"timestamp": 1,
+	}, runner.nodeID))
+
+	msg := <-runner.client.sendChannel()
+	assert.Equal(t, "spawning", msg.(*genericMessage).Type)
+	msg = <-runner.client.sendChannel()
+	m := msg.(*genericMessage)
+	assert.Equal(t, "spawning_complete", m.Type)
+	assert.Equal(t, int32(5), m.Data["count"])
+	assert.Equal(t, map[string]int64{"A": 2, "B": 3}, m.Data["user_classes_count"])
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(counts["A"]))
+	assert.Equal(t, int64(3), atomic.LoadInt64(counts["B"]))
+	runner.stop()
+}
+
+func TestStopDrainsIterations(t *testing.T) {
+	finished := int64(0)
+	task := &Task{
+		Name: "slow",
+		Fn: func() {
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt64(&finished, 1)
+		},
+	}
+	runner := newLocalRunner([]*Task{task}, nil, 5, 0)
+	runner.SetIsOldSpawnWorker(true)
+	defer runner.shutdown()
+
+	runner.startSpawning(5, 0, nil)
+	time.Sleep(50 * time.Millisecond)
+	runner.stop()
+
+	// the in-flight iterations are finished, and no more iterations are started
+	assert.Equal(t, int64(5), atomic.LoadInt64(&finished))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runner.activeIterations))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&runner.numClients))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&runner.stats.abandonedIterations))
+}
+
+func TestStopConcurrently(t *testing.T) {
+	finished := int64(0)
+	task := &Task{
+		Name: "slow",
+		Fn: func() {
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt64(&finished, 1)
+		},
+	}
+	runner := newLocalRunner([]*Task{task}, nil, 3, 0)
+	runner.SetIsOldSpawnWorker(true)
+	defer runner.shutdown()
+
+	// not started yet
+	runner.stop()
+
+	runner.startSpawning(3, 0, nil)
+	time.Sleep(50 * time.Millisecond)
+	wg := sync.WaitGroup{}
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			runner.stop()
+			// every call returns after the iterations are drained
+			assert.Equal(t, int64(3), atomic.LoadInt64(&finished))
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStopAbandonsIterations(t *testing.T) {
+	cancelled := make(chan bool, 3)
+	task := &Task{
+		Name: "blocked",
+		FnCtx: func(ctx context.Context) {
+			<-ctx.Done()
+			cancelled <- true
+		},
+	}
+	runner := newLocalRunner([]*Task{task}, nil, 3, 0)
+	runner.SetIsOldSpawnWorker(true)
+	runner.drainTimeout = 50 * time.Millisecond
+	defer runner.shutdown()
+
+	runner.startSpawning(3, 0, nil)
+	time.Sleep(20 * time.Millisecond)
+	startTime := time.Now()
+	runner.stop()
+
+	assert.True(t, time.Since(startTime) >= 50*time.Millisecond)
+	assert.Equal(t, int64(3), runner.stats.report()["abandoned_iterations"])
+	// abandoned iterations are cancelled after the drain timeout
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for abandoned iterations to be cancelled")
+		}
+	}
+}
+
+func TestRespawnCancelsIterationsImmediately(t *testing.T) {
+	cancelled := make(chan bool, 3)
+	task := &Task{
+		Name: "blocked",
+		FnCtx: func(ctx context.Context) {
+			<-ctx.Done()
+			cancelled <- true
+		},
+	}
+	runner := newSlaveRunner("localhost", 5557, []*Task{task}, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	runner.SetIsOldSpawnWorker(true)
+	defer runner.shutdown()
+
+	runner.startSpawning(3, 0, nil)
+	runner.setState(stateRunning)
+	time.Sleep(20 * time.Millisecond)
+
+	// master rebalances users, the default drain timeout isn't waited
+	startTime := time.Now()
+	runner.onMessage(newGenericMessage("spawn", map[string]interface{}{
+		"user_classes_count": map[interface{}]interface{}{"Dummy": int64(1)},
+	}, runner.nodeID))
+	assert.True(t, time.Since(startTime) < time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for iterations to be cancelled")
+		}
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&runner.stats.abandonedIterations))
+	runner.stop()
+}
+
 func TestOnQuitMessage(t *testing.T) {
 	runner := newSlaveRunner("localhost", 5557, nil, nil)
 	runner.client = newClient("localhost", 5557, "test")
-	runner.state = stateInit
+	runner.setState(stateInit)
 	defer runner.shutdown()
 
 	quitMessages := make(chan bool, 10)
@@ -314,7 +811,7 @@ func TestOnQuitMessage(t *testing.T) {
 		break
 	}
 
-	runner.state = stateRunning
+	runner.setState(stateRunning)
 	runner.stopChan = make(chan bool)
 	runner.onMessage(newGenericMessage("quit", nil, runner.nodeID))
 	select {
@@ -324,11 +821,11 @@ func TestOnQuitMessage(t *testing.T) {
 		t.Error("Runner should fire boomer:quit message when it receives a quit message from the master.")
 		break
 	}
-	if runner.state != stateInit {
+	if runner.getState() != stateInit {
 		t.Error("Runner's state should be stateInit")
 	}
 
-	runner.state = stateStopped
+	runner.setState(stateStopped)
 	runner.onMessage(newGenericMessage("quit", nil, runner.nodeID))
 	select {
 	case <-quitMessages:
@@ -338,7 +835,7 @@ func TestOnQuitMessage(t *testing.T) {
 		break
 	}
 
-	assert.Equal(t, stateInit, runner.state)
+	assert.Equal(t, stateInit, runner.getState())
 }
 
 func TestOnMessage(t *testing.T) {
@@ -355,7 +852,9 @@ func TestOnMessage(t *testing.T) {
 
 	runner := newSlaveRunner("localhost", 5557, []*Task{taskA, taskB}, nil)
 	runner.client = newClient("localhost", 5557, runner.nodeID)
-	runner.state = stateInit
+	runner.setState(stateInit)
+	// don't wait for the slow tasks when stopping
+	runner.drainTimeout = 100 * time.Millisecond
 	defer runner.shutdown()
 
 	go func() {
@@ -384,8 +883,8 @@ func TestOnMessage(t *testing.T) {
 
 	// spawn complete and running
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, stateRunning, runner.state)
-	assert.Equal(t, int32(10), runner.numClients)
+	assert.Equal(t, stateRunning, runner.getState())
+	assert.Equal(t, int32(10), atomic.LoadInt32(&runner.numClients))
 
 	msg = <-runner.client.sendChannel()
 	m = msg.(*genericMessage)
@@ -404,8 +903,8 @@ func TestOnMessage(t *testing.T) {
 	assert.Equal(t, "spawning", m.Type)
 
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, stateRunning, runner.state)
-	assert.Equal(t, int32(20), runner.numClients)
+	assert.Equal(t, stateRunning, runner.getState())
+	assert.Equal(t, int32(20), atomic.LoadInt32(&runner.numClients))
 
 	msg = <-runner.client.sendChannel()
 	m = msg.(*genericMessage)
@@ -413,7 +912,12 @@ func TestOnMessage(t *testing.T) {
 
 	// stop all the workers
 	runner.onMessage(newGenericMessage("stop", nil, runner.nodeID))
-	assert.Equal(t, stateInit, runner.state)
+
+	// stats of the drained iterations are reported before client_stopped
+	msg = <-runner.client.sendChannel()
+	m = msg.(*genericMessage)
+	assert.Equal(t, "stats", m.Type)
+	assert.Equal(t, int32(0), m.Data["user_count"])
 
 	msg = <-runner.client.sendChannel()
 	m = msg.(*genericMessage)
@@ -422,6 +926,7 @@ func TestOnMessage(t *testing.T) {
 	msg = <-runner.client.sendChannel()
 	crm := msg.(*clientReadyMessage)
 	assert.Equal(t, "client_ready", crm.Type)
+	assert.Equal(t, stateInit, runner.getState())
 
 	// spawn again
 	runner.onMessage(newGenericMessage("spawn", map[string]interface{}{
@@ -437,8 +942,8 @@ func TestOnMessage(t *testing.T) {
 
 	// spawn complete and running
 	time.Sleep(2 * time.Second)
-	assert.Equal(t, stateRunning, runner.state)
-	assert.Equal(t, int32(10), runner.numClients)
+	assert.Equal(t, stateRunning, runner.getState())
+	assert.Equal(t, int32(10), atomic.LoadInt32(&runner.numClients))
 
 	msg = <-runner.client.sendChannel()
 	m = msg.(*genericMessage)
@@ -446,7 +951,12 @@ func TestOnMessage(t *testing.T) {
 
 	// stop all the workers
 	runner.onMessage(newGenericMessage("stop", nil, runner.nodeID))
-	assert.Equal(t, stateInit, runner.state)
+
+	// stats of the drained iterations are reported before client_stopped
+	msg = <-runner.client.sendChannel()
+	m = msg.(*genericMessage)
+	assert.Equal(t, "stats", m.Type)
+	assert.Equal(t, int32(0), m.Data["user_count"])
 
 	msg = <-runner.client.sendChannel()
 	m = msg.(*genericMessage)
@@ -455,6 +965,127 @@ func TestOnMessage(t *testing.T) {
 	msg = <-runner.client.sendChannel()
 	crm = msg.(*clientReadyMessage)
 	assert.Equal(t, "client_ready", crm.Type)
+	assert.Equal(t, stateInit, runner.getState())
+}
+
+func TestStopMessageDrainsInBackground(t *testing.T) {
+	release := make(chan bool)
+	task := &Task{
+		Name: "blocked",
+		Fn: func() {
+			<-release
+		},
+	}
+	runner := newSlaveRunner("localhost", 5557, []*Task{task}, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	runner.SetIsOldSpawnWorker(true)
+	runner.setState(stateRunning)
+	runner.drainTimeout = 10 * time.Second
+	defer runner.shutdown()
+
+	runner.startSpawning(1, 0, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	// the listener isn't blocked by draining, so heartbeats from master are still handled
+	startTime := time.Now()
+	runner.onMessage(newGenericMessage("stop", nil, runner.nodeID))
+	assert.True(t, time.Since(startTime) < time.Second)
+	assert.Equal(t, stateStopping, runner.getState())
+	atomic.StoreInt64(&runner.lastMasterHeartbeat, 0)
+	runner.onMessage(newGenericMessage("heartbeat", nil, runner.nodeID))
+	assert.NotEqual(t, int64(0), atomic.LoadInt64(&runner.lastMasterHeartbeat))
+
+	close(release)
+	msg := <-runner.client.sendChannel()
+	assert.Equal(t, "stats", msg.(*genericMessage).Type)
+	msg = <-runner.client.sendChannel()
+	assert.Equal(t, "client_stopped", msg.(*genericMessage).Type)
+	msg = <-runner.client.sendChannel()
+	assert.Equal(t, "client_ready", msg.(*clientReadyMessage).Type)
+	assert.Equal(t, stateInit, runner.getState())
+}
+
+type reconnectCountingClient struct {
+	client
+	reconnects int32
+}
+
+func (c *reconnectCountingClient) reconnect() error {
+	atomic.AddInt32(&c.reconnects, 1)
+	return nil
+}
+
+func TestMasterHeartbeatTimeout(t *testing.T) {
+	runner := newSlaveRunner("localhost", 5557, nil, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	runner.setState(stateInit)
+	runner.masterHeartbeatTimeout = 100 * time.Millisecond
+	defer runner.shutdown()
+
+	runner.onMessage(newGenericMessage("heartbeat", nil, runner.nodeID))
+	assert.False(t, runner.masterHeartbeatTimedOut())
+
+	time.Sleep(150 * time.Millisecond)
+	assert.True(t, runner.masterHeartbeatTimedOut())
+
+	runner.masterHeartbeatTimeout = -1
+	assert.False(t, runner.masterHeartbeatTimedOut())
+}
+
+func TestReconnect(t *testing.T) {
+	taskA := &Task{
+		Fn: func() {
+			time.Sleep(time.Second)
+		},
+	}
+	runner := newSlaveRunner("localhost", 5557, []*Task{taskA}, nil)
+	fakeClient := &reconnectCountingClient{client: newClient("localhost", 5557, runner.nodeID)}
+	runner.client = fakeClient
+	runner.setState(stateRunning)
+	runner.stopChan = make(chan bool)
+	runner.lastReceivedSpawnTimestamp = 100
+	defer runner.shutdown()
+
+	runner.reconnect()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fakeClient.reconnects))
+	assert.Equal(t, stateInit, runner.getState())
+	assert.Equal(t, int64(0), runner.lastReceivedSpawnTimestamp)
+	assert.False(t, runner.masterHeartbeatTimedOut())
+
+	msg := <-runner.client.sendChannel()
+	crm := msg.(*clientReadyMessage)
+	assert.Equal(t, "client_ready", crm.Type)
+}
+
+func TestReconnectRequestedTwice(t *testing.T) {
+	runner := newSlaveRunner("localhost", 5557, nil, nil)
+	fakeClient := &reconnectCountingClient{client: newClient("localhost", 5557, runner.nodeID)}
+	runner.client = fakeClient
+	runner.setState(stateInit)
+	defer runner.shutdown()
+
+	// master asks to reconnect, and the heartbeat times out at the same time
+	runner.onMessage(newGenericMessage("reconnect", nil, "master"))
+	assert.False(t, runner.requestReconnect())
+	runner.startListener()
+
+	msg := <-runner.client.sendChannel()
+	assert.Equal(t, "client_ready", msg.(*clientReadyMessage).Type)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fakeClient.reconnects))
+	assert.True(t, runner.requestReconnect())
+	<-runner.client.sendChannel()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fakeClient.reconnects))
+}
+
+func TestSlaveRunnerShutdownTwice(t *testing.T) {
+	runner := newSlaveRunner("localhost", 5557, nil, nil)
+	runner.client = newClient("localhost", 5557, runner.nodeID)
+	runner.stats.start()
+
+	// a threshold aborts the test by Boomer.Quit, and user code quits again
+	runner.shutdown()
+	assert.NotPanics(t, runner.shutdown)
 }
 
 func TestGetReady(t *testing.T) {
@@ -480,7 +1111,7 @@ func TestGetReady(t *testing.T) {
 
 	r.numClients = 10
 	// it's not really running
-	r.state = stateRunning
+	r.setState(stateRunning)
 	data := make(map[string]interface{})
 	r.stats.messageToRunnerChan <- data
 
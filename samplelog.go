@@ -0,0 +1,59 @@
+package boomer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/myzhan/boomer/samples"
+)
+
+type userIDKey struct{}
+
+// UserIDFromContext returns the ID of the user running the task, ctx is passed to Task.FnCtx.
+// IDs start from 1 in a node, and it's 0 if there isn't a user, like iterations of ArrivalRate.
+// Unless SetIsOldSpawnWorker is true, users aren't goroutines, and tasks are assigned to users in turn.
+func UserIDFromContext(ctx context.Context) int64 {
+	id, _ := ctx.Value(userIDKey{}).(int64)
+	return id
+}
+
+func contextWithUserID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, userIDKey{}, id)
+}
+
+// sampleLogOutput closes the writer of samples when the test is stopped.
+type sampleLogOutput struct {
+	writer *samples.Writer
+}
+
+func (o *sampleLogOutput) OnStart() {
+
+}
+
+func (o *sampleLogOutput) OnEvent(data map[string]interface{}) {
+
+}
+
+func (o *sampleLogOutput) OnStop() {
+	if err := o.writer.Close(); err != nil {
+		log.Printf("Failed to close the sample log, %v\n", err)
+	}
+}
+
+// newSample returns a sample of a request ended now.
+func newSample(ctx context.Context, requestType, name string, responseTimeMicros, contentLength int64, err, nodeID string) samples.Sample {
+	s := samples.Sample{
+		Timestamp:          time.Now().UnixNano() / int64(time.Microsecond),
+		Type:               requestType,
+		Name:               name,
+		ResponseTimeMicros: responseTimeMicros,
+		ContentLength:      contentLength,
+		Error:              err,
+		NodeID:             nodeID,
+	}
+	if ctx != nil {
+		s.UserID = UserIDFromContext(ctx)
+	}
+	return s
+}
@@ -0,0 +1,213 @@
+package samples
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Entry is the stats of requests of a type and name, it has the same fields as the stats entry of boomer,
+// and Serialize returns the same map, so the numbers match the outputs of boomer.
+type Entry struct {
+	Name                 string          `json:"name"`
+	Method               string          `json:"method"`
+	NumRequests          int64           `json:"num_requests"`
+	NumFailures          int64           `json:"num_failures"`
+	TotalResponseTime    int64           `json:"total_response_time"`
+	MinResponseTime      int64           `json:"min_response_time"`
+	MaxResponseTime      int64           `json:"max_response_time"`
+	NumReqsPerSec        map[int64]int64 `json:"num_reqs_per_sec"`
+	NumFailPerSec        map[int64]int64 `json:"num_fail_per_sec"`
+	ResponseTimes        map[int64]int64 `json:"response_times"`
+	TotalContentLength   int64           `json:"total_content_length"`
+	StartTime            int64           `json:"start_time"`
+	LastRequestTimestamp int64           `json:"last_request_timestamp"`
+	ResponseTimesMicros  map[int64]int64 `json:"response_times_us"`
+}
+
+func newEntry(name, method string) *Entry {
+	return &Entry{
+		Name:                name,
+		Method:              method,
+		NumReqsPerSec:       make(map[int64]int64),
+		NumFailPerSec:       make(map[int64]int64),
+		ResponseTimes:       make(map[int64]int64),
+		ResponseTimesMicros: make(map[int64]int64),
+	}
+}
+
+// Add logs s like boomer does when it's recorded, the response time is in milliseconds.
+func (e *Entry) Add(s Sample) {
+	second := s.Timestamp / 1e6
+	// boomer truncates durations to milliseconds
+	responseTime := s.ResponseTimeMicros / 1000
+	if e.NumRequests == 0 || second < e.StartTime {
+		e.StartTime = second
+	}
+	if second > e.LastRequestTimestamp {
+		e.LastRequestTimestamp = second
+	}
+	if e.NumRequests == 0 || responseTime < e.MinResponseTime {
+		e.MinResponseTime = responseTime
+	}
+	if responseTime > e.MaxResponseTime {
+		e.MaxResponseTime = responseTime
+	}
+	e.NumRequests++
+	e.NumReqsPerSec[second]++
+	e.TotalResponseTime += responseTime
+	e.ResponseTimes[roundResponseTime(responseTime)]++
+	e.ResponseTimesMicros[roundResponseTimeMicros(s.ResponseTimeMicros)]++
+	if s.Error != "" {
+		e.NumFailures++
+		e.NumFailPerSec[second]++
+	} else {
+		e.TotalContentLength += s.ContentLength
+	}
+}
+
+// Serialize returns the entry like the stats reported by boomer.
+func (e *Entry) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"name":                   e.Name,
+		"method":                 e.Method,
+		"last_request_timestamp": e.LastRequestTimestamp,
+		"start_time":             e.StartTime,
+		"num_requests":           e.NumRequests,
+		"num_none_requests":      0,
+		"num_failures":           e.NumFailures,
+		"total_response_time":    e.TotalResponseTime,
+		"max_response_time":      e.MaxResponseTime,
+		"min_response_time":      e.MinResponseTime,
+		"total_content_length":   e.TotalContentLength,
+		"response_times":         e.ResponseTimes,
+		"num_reqs_per_sec":       e.NumReqsPerSec,
+		"num_fail_per_sec":       e.NumFailPerSec,
+		"response_times_us":      e.ResponseTimesMicros,
+	}
+}
+
+// roundResponseTime rounds like boomer, so 147 becomes 150, 3432 becomes 3400 and 58760 becomes 59000.
+func roundResponseTime(responseTime int64) int64 {
+	switch {
+	case responseTime < 100:
+		return responseTime
+	case responseTime < 1000:
+		return int64(math.Floor(float64(responseTime)/10+0.5)) * 10
+	case responseTime < 10000:
+		return int64(math.Floor(float64(responseTime)/100+0.5)) * 100
+	}
+	return int64(math.Floor(float64(responseTime)/1000+0.5)) * 1000
+}
+
+// roundResponseTimeMicros keeps 3 significant digits like boomer.
+func roundResponseTimeMicros(responseTimeMicros int64) int64 {
+	factor := int64(1)
+	for v := responseTimeMicros; v >= 1000; v /= 10 {
+		factor *= 10
+	}
+	return (responseTimeMicros + factor/2) / factor * factor
+}
+
+// Error is the occurrences of an error of requests of a type and name.
+type Error struct {
+	Method      string
+	Name        string
+	Error       string
+	Occurrences int64
+}
+
+// Aggregator rebuilds the stats of requests from samples.
+type Aggregator struct {
+	// Entries are keyed by name + method, like boomer.
+	Entries map[string]*Entry
+	Total   *Entry
+	// Errors are keyed like boomer, by the md5 of method, name and error.
+	Errors map[string]*Error
+}
+
+// NewAggregator returns an empty Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		Entries: make(map[string]*Entry),
+		Total:   newEntry("Total", ""),
+		Errors:  make(map[string]*Error),
+	}
+}
+
+// Add adds s to the stats.
+func (a *Aggregator) Add(s Sample) {
+	entry, ok := a.Entries[s.Name+s.Type]
+	if !ok {
+		entry = newEntry(s.Name, s.Type)
+		a.Entries[s.Name+s.Type] = entry
+	}
+	entry.Add(s)
+	a.Total.Add(s)
+	if s.Error == "" {
+		return
+	}
+	key := errorKey(s.Type, s.Name, s.Error)
+	e, ok := a.Errors[key]
+	if !ok {
+		e = &Error{Method: s.Type, Name: s.Name, Error: s.Error}
+		a.Errors[key] = e
+	}
+	e.Occurrences++
+}
+
+func errorKey(method, name, err string) string {
+	h := md5.New()
+	io.WriteString(h, method)
+	io.WriteString(h, name)
+	io.WriteString(h, err)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// ReportData returns the stats like the data boomer passes to Output.OnEvent, so the outputs of boomer
+// can be used with the rebuilt stats.
+func (a *Aggregator) ReportData(userCount int32) map[string]interface{} {
+	stats := make([]interface{}, 0, len(a.Entries))
+	for _, entry := range a.Entries {
+		stats = append(stats, entry.Serialize())
+	}
+	errors := make(map[string]map[string]interface{}, len(a.Errors))
+	for key, e := range a.Errors {
+		errors[key] = map[string]interface{}{
+			"method":      e.Method,
+			"name":        e.Name,
+			"error":       e.Error,
+			"occurrences": e.Occurrences,
+		}
+	}
+	return map[string]interface{}{
+		"user_count":  userCount,
+		"stats":       stats,
+		"stats_total": a.Total.Serialize(),
+		"errors":      errors,
+	}
+}
+
+// Aggregate reads all the samples in the file of path, and rebuilds the stats of samples accepted by filter.
+// All the samples are accepted if filter is nil.
+func Aggregate(path string, filter func(s *Sample) bool) (*Aggregator, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	a := NewAggregator()
+	for {
+		s, err := r.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return a, err
+		}
+		if filter == nil || filter(&s) {
+			a.Add(s)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package samples writes and reads raw samples of requests recorded by boomer, for offline analysis
+// like "which requests in minute 14 were slow", which can't be answered by the aggregated stats.
+//
+// Samples are written to gzip compressed JSON lines, or a compact binary format, by Writer.
+// Reader reads both formats, and Aggregator rebuilds stats compatible with boomer's from samples.
+package samples
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Sample is a request recorded by boomer.
+type Sample struct {
+	// Unix time of the end of the request in microseconds
+	Timestamp int64 `json:"timestamp_us"`
+	// Type is the request type, like the method in boomer's stats.
+	Type               string `json:"type"`
+	Name               string `json:"name"`
+	ResponseTimeMicros int64  `json:"response_time_us"`
+	ContentLength      int64  `json:"content_length"`
+	// Error is empty if the request succeeded.
+	Error  string `json:"error,omitempty"`
+	NodeID string `json:"node_id"`
+	// UserID is the ID of the user which made the request in the node, 0 if it's unknown.
+	UserID int64 `json:"user_id"`
+}
+
+// Format is the format of sample files.
+type Format int
+
+const (
+	// FormatJSONL is gzip compressed JSON lines, one Sample per line.
+	FormatJSONL Format = iota
+	// FormatBinary is a compact binary format, strings are only written once.
+	FormatBinary
+)
+
+// binaryMagic is the header of files in FormatBinary, followed by the version.
+var binaryMagic = []byte("BMRS")
+
+const binaryVersion = 1
+
+// encoder writes samples in a format.
+type encoder interface {
+	encode(s *Sample) error
+	close() error
+}
+
+func newEncoder(w io.Writer, format Format) (encoder, error) {
+	switch format {
+	case FormatJSONL:
+		gz := gzip.NewWriter(w)
+		return &jsonlEncoder{gz: gz, enc: json.NewEncoder(gz)}, nil
+	case FormatBinary:
+		bw := bufio.NewWriterSize(w, 64*1024)
+		if _, err := bw.Write(append(binaryMagic, binaryVersion)); err != nil {
+			return nil, err
+		}
+		return &binaryEncoder{w: bw, strings: make(map[string]uint64)}, nil
+	}
+	return nil, fmt.Errorf("unknown format of samples: %d", format)
+}
+
+type jsonlEncoder struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) encode(s *Sample) error {
+	return e.enc.Encode(s)
+}
+
+func (e *jsonlEncoder) close() error {
+	return e.gz.Close()
+}
+
+// binaryEncoder writes a sample as varints of the timestamp delta, response time, content length and user ID,
+// and references of type, name, error and node ID. A reference is the index of the string plus one,
+// or 0 followed by the length and bytes of a new string, which gets the next index.
+type binaryEncoder struct {
+	w             *bufio.Writer
+	buf           [binary.MaxVarintLen64]byte
+	lastTimestamp int64
+	strings       map[string]uint64
+}
+
+func (e *binaryEncoder) encode(s *Sample) error {
+	e.writeVarint(s.Timestamp - e.lastTimestamp)
+	e.lastTimestamp = s.Timestamp
+	e.writeVarint(s.ResponseTimeMicros)
+	e.writeVarint(s.ContentLength)
+	e.writeVarint(s.UserID)
+	e.writeString(s.Type)
+	e.writeString(s.Name)
+	e.writeString(s.Error)
+	return e.writeString(s.NodeID)
+}
+
+func (e *binaryEncoder) writeVarint(v int64) error {
+	n := binary.PutVarint(e.buf[:], v)
+	_, err := e.w.Write(e.buf[:n])
+	return err
+}
+
+func (e *binaryEncoder) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(e.buf[:], v)
+	_, err := e.w.Write(e.buf[:n])
+	return err
+}
+
+func (e *binaryEncoder) writeString(s string) error {
+	if index, ok := e.strings[s]; ok {
+		return e.writeUvarint(index + 1)
+	}
+	e.strings[s] = uint64(len(e.strings))
+	e.writeUvarint(0)
+	e.writeUvarint(uint64(len(s)))
+	_, err := e.w.WriteString(s)
+	return err
+}
+
+func (e *binaryEncoder) close() error {
+	return e.w.Flush()
+}
+
+// Reader reads samples from a file written by Writer, the format is detected by the header.
+type Reader struct {
+	file *os.File
+	next func() (Sample, error)
+}
+
+// Open opens a file of samples.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.file = file
+	return r, nil
+}
+
+func newReader(rd io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(rd, 64*1024)
+	header, err := br.Peek(len(binaryMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) == len(binaryMagic)+1 && string(header[:len(binaryMagic)]) == string(binaryMagic) {
+		if header[len(binaryMagic)] != binaryVersion {
+			return nil, fmt.Errorf("unsupported version of binary samples: %d", header[len(binaryMagic)])
+		}
+		br.Discard(len(header))
+		d := &binaryDecoder{r: br}
+		return &Reader{next: d.decode}, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("unknown format of samples, %v", err)
+	}
+	dec := json.NewDecoder(gz)
+	return &Reader{next: func() (s Sample, err error) {
+		err = dec.Decode(&s)
+		return
+	}}, nil
+}
+
+// Next returns the next sample, or io.EOF if there are no more samples.
+func (r *Reader) Next() (Sample, error) {
+	return r.next()
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+type binaryDecoder struct {
+	r             *bufio.Reader
+	lastTimestamp int64
+	strings       []string
+}
+
+func (d *binaryDecoder) decode() (s Sample, err error) {
+	delta, err := binary.ReadVarint(d.r)
+	if err != nil {
+		// EOF at the start of a sample is the end of the file
+		return s, err
+	}
+	d.lastTimestamp += delta
+	s.Timestamp = d.lastTimestamp
+	for _, v := range []*int64{&s.ResponseTimeMicros, &s.ContentLength, &s.UserID} {
+		if *v, err = binary.ReadVarint(d.r); err != nil {
+			return s, truncated(err)
+		}
+	}
+	for _, v := range []*string{&s.Type, &s.Name, &s.Error, &s.NodeID} {
+		if *v, err = d.readString(); err != nil {
+			return s, truncated(err)
+		}
+	}
+	return s, nil
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	ref, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return "", err
+	}
+	if ref > 0 {
+		if ref > uint64(len(d.strings)) {
+			return "", fmt.Errorf("invalid reference of string: %d", ref)
+		}
+		return d.strings[ref-1], nil
+	}
+	length, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return "", err
+	}
+	d.strings = append(d.strings, string(buf))
+	return string(buf), nil
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
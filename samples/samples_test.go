@@ -0,0 +1,170 @@
+package samples
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSamples() []Sample {
+	return []Sample{
+		{Timestamp: 1600000000000000, Type: "http", Name: "login", ResponseTimeMicros: 10400, ContentLength: 100, NodeID: "node-1", UserID: 1},
+		{Timestamp: 1600000000500000, Type: "http", Name: "login", ResponseTimeMicros: 200900, ContentLength: 100, NodeID: "node-1", UserID: 2},
+		{Timestamp: 1600000001000000, Type: "http", Name: "home", ResponseTimeMicros: 30000, Error: "timeout", NodeID: "node-1", UserID: 1},
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeTestSamples(t *testing.T, dir string, format Format) string {
+	path := filepath.Join(dir, "samples")
+	w, err := NewWriter(path, format, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range testSamples() {
+		w.Write(s)
+	}
+	assert.NoError(t, w.Close())
+	// closing twice is harmless
+	assert.NoError(t, w.Close())
+	return path
+}
+
+func readAll(t *testing.T, path string) []Sample {
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var all []Sample
+	for {
+		s, err := r.Next()
+		if err == io.EOF {
+			return all
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, s)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, format := range []Format{FormatJSONL, FormatBinary} {
+		path := writeTestSamples(t, dir, format)
+		assert.Equal(t, testSamples(), readAll(t, path), "format %d", format)
+	}
+}
+
+func TestWriterRate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples")
+	w, err := NewWriter(path, FormatBinary, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range testSamples() {
+		w.Write(s)
+	}
+	w.Close()
+	// writing after closing is dropped silently
+	w.Write(testSamples()[0])
+	assert.Empty(t, readAll(t, path))
+	assert.Equal(t, int64(0), w.Dropped())
+}
+
+func TestUnknownFormat(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, err := NewWriter(filepath.Join(dir, "samples"), Format(9), 1)
+	assert.Error(t, err)
+
+	path := filepath.Join(dir, "garbage")
+	ioutil.WriteFile(path, []byte("not samples"), 0644)
+	_, err = Open(path)
+	assert.Error(t, err)
+}
+
+func TestTruncatedBinary(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeTestSamples(t, dir, FormatBinary)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, content[:len(content)-3], 0644)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 2; i++ {
+		_, err := r.Next()
+		assert.NoError(t, err)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestAggregate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeTestSamples(t, dir, FormatBinary)
+	a, err := Aggregate(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, a.Entries, 2)
+	login := a.Entries["loginhttp"]
+	assert.Equal(t, int64(2), login.NumRequests)
+	assert.Equal(t, int64(10), login.MinResponseTime)
+	assert.Equal(t, int64(200), login.MaxResponseTime)
+	assert.Equal(t, int64(210), login.TotalResponseTime)
+	assert.Equal(t, int64(200), login.TotalContentLength)
+	assert.Equal(t, map[int64]int64{10: 1, 200: 1}, login.ResponseTimes)
+	assert.Equal(t, map[int64]int64{1600000000: 2}, login.NumReqsPerSec)
+	assert.Equal(t, int64(3), a.Total.NumRequests)
+	assert.Equal(t, int64(1), a.Total.NumFailures)
+	assert.Equal(t, int64(1600000000), a.Total.StartTime)
+	assert.Equal(t, int64(1600000001), a.Total.LastRequestTimestamp)
+
+	data := a.ReportData(5)
+	assert.Equal(t, int32(5), data["user_count"])
+	assert.Len(t, data["stats"], 2)
+	errors := data["errors"].(map[string]map[string]interface{})
+	assert.Len(t, errors, 1)
+	for _, e := range errors {
+		assert.Equal(t, "home", e["name"])
+		assert.Equal(t, "timeout", e["error"])
+		assert.Equal(t, int64(1), e["occurrences"])
+	}
+
+	a, err = Aggregate(path, func(s *Sample) bool { return s.Timestamp >= 1600000001000000 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, a.Entries, 1)
+	assert.Equal(t, int64(1), a.Total.NumRequests)
+}
+
+func TestRoundResponseTimeMicros(t *testing.T) {
+	assert.Equal(t, int64(999), roundResponseTimeMicros(999))
+	assert.Equal(t, int64(1240), roundResponseTimeMicros(1235))
+	assert.Equal(t, int64(201000), roundResponseTimeMicros(200900))
+}
@@ -0,0 +1,111 @@
+package samples
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// size of the queue of samples waiting to be written, samples are dropped if it's full.
+const writerQueueSize = 64 * 1024
+
+// Writer writes samples to a file asynchronously, so the requests aren't slowed down by I/O.
+// It's safe for concurrent use.
+type Writer struct {
+	// it's updated atomically, keep it first to be 64-bit aligned
+	dropped int64
+	rate    float64
+	queue   chan Sample
+
+	lock      sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+	file      *os.File
+	enc       encoder
+}
+
+// NewWriter creates a file of samples in format. Only a random rate of samples are written, like 0.1 for 10%,
+// all the samples are written if rate >= 1.
+func NewWriter(path string, format Format, rate float64) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncoder(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &Writer{
+		rate:  rate,
+		queue: make(chan Sample, writerQueueSize),
+		done:  make(chan struct{}),
+		file:  file,
+		enc:   enc,
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	for s := range w.queue {
+		if w.err != nil {
+			continue
+		}
+		if err := w.enc.encode(&s); err != nil {
+			log.Printf("Failed to write samples to %s, %v\n", w.file.Name(), err)
+			w.err = err
+		}
+	}
+}
+
+// Write queues s to be written, it never blocks. s is dropped if it's not sampled, the queue is full
+// or the writer is closed.
+func (w *Writer) Write(s Sample) {
+	if w.rate < 1 && rand.Float64() >= w.rate {
+		return
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- s:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+}
+
+// Dropped returns the number of samples dropped because the queue is full.
+func (w *Writer) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// Close writes the queued samples and closes the file.
+func (w *Writer) Close() error {
+	w.closeOnce.Do(func() {
+		w.lock.Lock()
+		w.closed = true
+		close(w.queue)
+		w.lock.Unlock()
+
+		<-w.done
+		if dropped := w.Dropped(); dropped > 0 {
+			log.Printf("%d samples are dropped, because they're recorded faster than written to %s.\n", dropped, w.file.Name())
+		}
+		err := w.enc.close()
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+		if w.err == nil {
+			w.err = err
+		}
+	})
+	return w.err
+}
@@ -1,22 +1,17 @@
 package boomer
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type requestSuccess struct {
-	requestType    string
-	name           string
-	responseTime   int64
-	responseLength int64
-}
+// correctedLatencyMethod is the method of entries in stats_corrected, which are named after tasks.
+const correctedLatencyMethod = "corrected"
 
-type requestFailure struct {
-	requestType  string
-	name         string
-	responseTime int64
-	error        string
-}
+// localStatsKeys are the keys of a serialized statsEntry that are only used by outputs.
+// They are removed before reporting to master to keep the payload compatible with locust.
+var localStatsKeys = []string{"response_times_us"}
 
 type requestStats struct {
 	entries   map[string]*statsEntry
@@ -24,8 +19,42 @@ type requestStats struct {
 	total     *statsEntry
 	startTime int64
 
-	requestSuccessChan  chan *requestSuccess
-	requestFailureChan  chan *requestFailure
+	// keep a high resolution latency histogram in every entry, see statsEntry.ResponseTimesMicros
+	histogramEnabled bool
+
+	// failures are counted by messages rewritten by errorNormalizers, see Boomer.AddErrorNormalizer.
+	errorNormalizers []ErrorNormalizer
+	// failures of new errors are counted as otherErrors after there are maxErrorKeys errors, if it's positive.
+	maxErrorKeys int
+	// keys of the errors since the start of the test, which are counted against maxErrorKeys.
+	errorKeys map[string]bool
+	// the number of distinct messages kept as examples of every error.
+	errorExamples int
+
+	// iterations dropped by the arrival rate executor since the last report, it's updated atomically.
+	droppedIterations int64
+	// iterations still running after the drain timeout of runner.stop since the last report, it's updated atomically.
+	abandonedIterations int64
+
+	// collectReportData and clearAll are called by the stats goroutine, and by report when a runner is stopped.
+	mu sync.Mutex
+
+	// corrected latencies of tasks, which are only used by outputs, see runner.runTaskAndWait.
+	correctedEntries map[string]*statsEntry
+
+	// stats since the start of the test, the entries above are reset on every report.
+	// They're sent to outputs as stats_cumulative, but never to master.
+	cumulativeEntries map[string]*statsEntry
+	cumulativeErrors  map[string]*statsError
+	cumulativeTotal   *statsEntry
+
+	// requests are recorded in shards by task goroutines, and merged on every report tick.
+	shards     []*statsShard
+	shardHints *sync.Pool
+	shardIndex uint32
+	// incremented atomically for every error new to a shard, so errors are merged in the order they're seen
+	errorSeq uint64
+
 	clearStatsChan      chan bool
 	messageToRunnerChan chan map[string]interface{}
 	shutdownChan        chan bool
@@ -36,11 +65,16 @@ func newRequestStats() (stats *requestStats) {
 	errors := make(map[string]*statsError)
 
 	stats = &requestStats{
-		entries: entries,
-		errors:  errors,
+		entries:           entries,
+		errors:            errors,
+		correctedEntries:  make(map[string]*statsEntry),
+		cumulativeEntries: make(map[string]*statsEntry),
+		cumulativeErrors:  make(map[string]*statsError),
+		cumulativeTotal:   newAggregatedEntry("Total", ""),
+		errorKeys:         make(map[string]bool),
+		shards:            newStatsShards(),
 	}
-	stats.requestSuccessChan = make(chan *requestSuccess, 100)
-	stats.requestFailureChan = make(chan *requestFailure, 100)
+	stats.shardHints = stats.newShardHints()
 	stats.clearStatsChan = make(chan bool)
 	stats.messageToRunnerChan = make(chan map[string]interface{}, 10)
 	stats.shutdownChan = make(chan bool)
@@ -54,17 +88,18 @@ func newRequestStats() (stats *requestStats) {
 	return stats
 }
 
-func (s *requestStats) logRequest(method, name string, responseTime int64, contentLength int64) {
-	s.total.log(responseTime, contentLength)
-	s.get(name, method).log(responseTime, contentLength)
-}
-
-func (s *requestStats) logError(method, name, err string) {
-	s.total.logError(err)
-	s.get(name, method).logError(err)
-
-	// store error in errors map
+// getError returns the error of method, name and err. If there are maxErrorKeys errors, failures of
+// a new error are counted as the error of otherErrors of method and name.
+func (s *requestStats) getError(method, name, err string) *statsError {
 	key := MD5(method, name, err)
+	if !s.errorKeys[key] {
+		if s.maxErrorKeys > 0 && len(s.errorKeys) >= s.maxErrorKeys {
+			err = otherErrors
+			key = MD5(method, name, err)
+		} else {
+			s.errorKeys[key] = true
+		}
+	}
 	entry, ok := s.errors[key]
 	if !ok {
 		entry = &statsError{
@@ -74,7 +109,7 @@ func (s *requestStats) logError(method, name, err string) {
 		}
 		s.errors[key] = entry
 	}
-	entry.occured()
+	return entry
 }
 
 func (s *requestStats) get(name string, method string) (entry *statsEntry) {
@@ -102,6 +137,12 @@ func (s *requestStats) clearAll() {
 
 	s.entries = make(map[string]*statsEntry)
 	s.errors = make(map[string]*statsError)
+	s.correctedEntries = make(map[string]*statsEntry)
+	s.cumulativeEntries = make(map[string]*statsEntry)
+	s.cumulativeErrors = make(map[string]*statsError)
+	s.cumulativeTotal = newAggregatedEntry("Total", "")
+	s.errorKeys = make(map[string]bool)
+	s.discardShards()
 	s.startTime = time.Now().Unix()
 }
 
@@ -123,29 +164,101 @@ func (s *requestStats) serializeErrors() map[string]map[string]interface{} {
 	return errors
 }
 
+// accumulate merges the stats since the last report into the cumulative stats.
+func (s *requestStats) accumulate() {
+	for key, entry := range s.entries {
+		if entry.NumRequests == 0 && entry.NumFailures == 0 {
+			continue
+		}
+		cumulative, ok := s.cumulativeEntries[key]
+		if !ok {
+			cumulative = newAggregatedEntry(entry.Name, entry.Method)
+			s.cumulativeEntries[key] = cumulative
+		}
+		cumulative.accumulate(entry)
+	}
+	s.cumulativeTotal.accumulate(s.total)
+	for key, e := range s.errors {
+		cumulative, ok := s.cumulativeErrors[key]
+		if !ok {
+			cumulative = &statsError{name: e.name, method: e.method, error: e.error}
+			s.cumulativeErrors[key] = cumulative
+		}
+		cumulative.occurrences += e.occurrences
+		cumulative.addExamples(e.examples, s.errorExamples)
+	}
+}
+
+// serializeCumulative returns the cumulative stats like report data, with stats, stats_total and errors.
+// Entries are copied, because outputs read them in other goroutines while they're extended,
+// which is cheap because they only keep the per-second counts of the last report.
+func (s *requestStats) serializeCumulative() map[string]interface{} {
+	stats := make([]interface{}, 0, len(s.cumulativeEntries))
+	for _, entry := range s.cumulativeEntries {
+		stats = append(stats, entry.clone().serialize())
+	}
+	errors := make(map[string]map[string]interface{}, len(s.cumulativeErrors))
+	for k, v := range s.cumulativeErrors {
+		errors[k] = v.toMap()
+	}
+	return map[string]interface{}{
+		"stats":       stats,
+		"stats_total": s.cumulativeTotal.clone().serialize(),
+		"errors":      errors,
+	}
+}
+
 func (s *requestStats) collectReportData() map[string]interface{} {
+	s.mergeShards()
+	s.accumulate()
 	data := make(map[string]interface{})
 	data["stats"] = s.serializeStats()
 	data["stats_total"] = s.total.getStrippedReport()
 	data["errors"] = s.serializeErrors()
 	s.errors = make(map[string]*statsError)
+	data["stats_cumulative"] = s.serializeCumulative()
+	data["dropped_iterations"] = atomic.SwapInt64(&s.droppedIterations, 0)
+	data["abandoned_iterations"] = atomic.SwapInt64(&s.abandonedIterations, 0)
+	if len(s.correctedEntries) > 0 {
+		corrected := make([]interface{}, 0, len(s.correctedEntries))
+		for _, v := range s.correctedEntries {
+			if v.NumRequests > 0 {
+				corrected = append(corrected, v.getStrippedReport())
+			}
+		}
+		data["stats_corrected"] = corrected
+	}
 	return data
 }
 
+// logDroppedIteration is called by the arrival rate executor when all the users are busy.
+func (s *requestStats) logDroppedIteration() {
+	atomic.AddInt64(&s.droppedIterations, 1)
+}
+
+// logAbandonedIterations is called by runner.stop when iterations are still running after the drain timeout.
+func (s *requestStats) logAbandonedIterations(n int64) {
+	atomic.AddInt64(&s.abandonedIterations, n)
+}
+
+// report collects the report data since the last report immediately, instead of waiting for the next tick.
+func (s *requestStats) report() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.collectReportData()
+}
+
 func (s *requestStats) start() {
 	go func() {
 		var ticker = time.NewTicker(slaveReportInterval)
 		for {
 			select {
-			case m := <-s.requestSuccessChan:
-				s.logRequest(m.requestType, m.name, m.responseTime, m.responseLength)
-			case n := <-s.requestFailureChan:
-				s.logRequest(n.requestType, n.name, n.responseTime, 0)
-				s.logError(n.requestType, n.name, n.error)
 			case <-s.clearStatsChan:
+				s.mu.Lock()
 				s.clearAll()
+				s.mu.Unlock()
 			case <-ticker.C:
-				data := s.collectReportData()
+				data := s.report()
 				// send data to channel, no network IO in this goroutine
 				s.messageToRunnerChan <- data
 			case <-s.shutdownChan:
@@ -155,6 +268,53 @@ func (s *requestStats) start() {
 	}()
 }
 
+// microsOrDefault returns responseTimeMicros, or converts responseTime from milliseconds if it's not set.
+func microsOrDefault(responseTimeMicros int64, responseTime int64) int64 {
+	if responseTimeMicros == 0 {
+		return responseTime * 1000
+	}
+	return responseTimeMicros
+}
+
+// stripLocalStats returns a shallow copy of data, in which the stats entries don't have localStatsKeys.
+func stripLocalStats(data map[string]interface{}) map[string]interface{} {
+	stripEntry := func(entry interface{}) interface{} {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			return entry
+		}
+		stripped := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			stripped[k] = v
+		}
+		for _, k := range localStatsKeys {
+			delete(stripped, k)
+		}
+		return stripped
+	}
+
+	result := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		result[k] = v
+	}
+	if stats, ok := data["stats"].([]interface{}); ok {
+		strippedStats := make([]interface{}, 0, len(stats))
+		for _, entry := range stats {
+			strippedStats = append(strippedStats, stripEntry(entry))
+		}
+		result["stats"] = strippedStats
+	}
+	if total, ok := data["stats_total"]; ok {
+		result["stats_total"] = stripEntry(total)
+	}
+	// locust doesn't know corrected latencies, and gets the state and ID of workers from messages
+	delete(result, "stats_corrected")
+	delete(result, "stats_cumulative")
+	delete(result, "state")
+	delete(result, "node_id")
+	return result
+}
+
 // close is used by unit tests to avoid leakage of goroutines
 func (s *requestStats) close() {
 	close(s.shutdownChan)
@@ -194,6 +354,18 @@ type statsEntry struct {
 	// Boomer doesn't allow None response time for requests like locust.
 	// num_none_requests is added to keep compatible with locust.
 	NumNoneRequests int64 `json:"num_none_requests"`
+	// Like ResponseTimes, but the keys are in microseconds and rounded to 3 significant digits,
+	// so 1234 becomes 1230 and 58760 becomes 58800. It's only kept if the histogram is enabled
+	// and it's never sent to master.
+	ResponseTimesMicros map[int64]int64 `json:"response_times_us,omitempty"`
+	// The number of seconds with requests and failures since the start of the test. They're only kept
+	// by the cumulative stats, whose NumReqsPerSec and NumFailPerSec only have the seconds of the last report.
+	NumSeconds     int64 `json:"num_seconds,omitempty"`
+	NumFailSeconds int64 `json:"num_fail_seconds,omitempty"`
+
+	// the last seconds counted in NumSeconds and NumFailSeconds
+	lastSecond     int64
+	lastFailSecond int64
 }
 
 func (s *statsEntry) reset() {
@@ -208,6 +380,15 @@ func (s *statsEntry) reset() {
 	s.NumReqsPerSec = make(map[int64]int64)
 	s.NumFailPerSec = make(map[int64]int64)
 	s.TotalContentLength = 0
+	s.ResponseTimesMicros = nil
+}
+
+// newAggregatedEntry returns an empty entry to extend, the start time is taken from the extended entries.
+func newAggregatedEntry(name, method string) *statsEntry {
+	entry := &statsEntry{Name: name, Method: method}
+	entry.reset()
+	entry.StartTime = 0
+	return entry
 }
 
 var a int64
@@ -271,6 +452,23 @@ func (s *statsEntry) logResponseTime(responseTime int64) {
 	}
 }
 
+func (s *statsEntry) logResponseTimeMicros(responseTimeMicros int64) {
+	if s.ResponseTimesMicros == nil {
+		s.ResponseTimesMicros = make(map[int64]int64)
+	}
+	s.ResponseTimesMicros[roundResponseTimeMicros(responseTimeMicros)]++
+}
+
+// roundResponseTimeMicros keeps 3 significant digits of responseTimeMicros,
+// the relative error is less than 0.5% while the number of keys stays small.
+func roundResponseTimeMicros(responseTimeMicros int64) int64 {
+	factor := int64(1)
+	for v := responseTimeMicros; v >= 1000; v /= 10 {
+		factor *= 10
+	}
+	return (responseTimeMicros + factor/2) / factor * factor
+}
+
 func (s *statsEntry) logError(err string) {
 	s.NumFailures++
 	key := time.Now().Unix()
@@ -282,6 +480,98 @@ func (s *statsEntry) logError(err string) {
 	}
 }
 
+// extend merges other into s, it's used by master to aggregate stats from workers, see also locust's stats.py
+func (s *statsEntry) extend(other *statsEntry) {
+	if s.NumRequests == 0 || (other.NumRequests > 0 && other.MinResponseTime < s.MinResponseTime) {
+		s.MinResponseTime = other.MinResponseTime
+	}
+	if other.MaxResponseTime > s.MaxResponseTime {
+		s.MaxResponseTime = other.MaxResponseTime
+	}
+	if other.LastRequestTimestamp > s.LastRequestTimestamp {
+		s.LastRequestTimestamp = other.LastRequestTimestamp
+	}
+	if other.StartTime != 0 && (s.StartTime == 0 || other.StartTime < s.StartTime) {
+		s.StartTime = other.StartTime
+	}
+	s.NumRequests += other.NumRequests
+	s.NumNoneRequests += other.NumNoneRequests
+	s.NumFailures += other.NumFailures
+	s.TotalResponseTime += other.TotalResponseTime
+	s.TotalContentLength += other.TotalContentLength
+
+	// the seconds of cumulative entries mostly overlap, like entries of a name with different methods
+	if other.NumSeconds > s.NumSeconds {
+		s.NumSeconds = other.NumSeconds
+	}
+	if other.NumFailSeconds > s.NumFailSeconds {
+		s.NumFailSeconds = other.NumFailSeconds
+	}
+
+	for k, v := range other.ResponseTimes {
+		s.ResponseTimes[k] += v
+	}
+	for k, v := range other.NumReqsPerSec {
+		s.NumReqsPerSec[k] += v
+	}
+	for k, v := range other.NumFailPerSec {
+		s.NumFailPerSec[k] += v
+	}
+	for k, v := range other.ResponseTimesMicros {
+		if s.ResponseTimesMicros == nil {
+			s.ResponseTimesMicros = make(map[int64]int64)
+		}
+		s.ResponseTimesMicros[k] += v
+	}
+}
+
+// accumulate merges other, the stats of a report, into the cumulative entry s.
+// The per-second counts are replaced by the ones of other instead of growing with the test,
+// the seconds are counted in NumSeconds and NumFailSeconds.
+func (s *statsEntry) accumulate(other *statsEntry) {
+	s.NumReqsPerSec = make(map[int64]int64, len(other.NumReqsPerSec))
+	s.NumFailPerSec = make(map[int64]int64, len(other.NumFailPerSec))
+	s.extend(other)
+	s.NumSeconds += countNewSeconds(other.NumReqsPerSec, &s.lastSecond)
+	s.NumFailSeconds += countNewSeconds(other.NumFailPerSec, &s.lastFailSecond)
+}
+
+// countNewSeconds returns the number of seconds in counts after last, and moves last to the latest one.
+// A second can be in two reports, but reports never go back in time.
+func countNewSeconds(counts map[int64]int64, last *int64) int64 {
+	n, latest := int64(0), *last
+	for second := range counts {
+		if second > *last {
+			n++
+		}
+		if second > latest {
+			latest = second
+		}
+	}
+	*last = latest
+	return n
+}
+
+// clone returns a deep copy of s.
+func (s *statsEntry) clone() *statsEntry {
+	c := *s
+	c.ResponseTimes = copyCounts(s.ResponseTimes)
+	c.NumReqsPerSec = copyCounts(s.NumReqsPerSec)
+	c.NumFailPerSec = copyCounts(s.NumFailPerSec)
+	if s.ResponseTimesMicros != nil {
+		c.ResponseTimesMicros = copyCounts(s.ResponseTimesMicros)
+	}
+	return &c
+}
+
+func copyCounts(counts map[int64]int64) map[int64]int64 {
+	c := make(map[int64]int64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
 func (s *statsEntry) serialize() map[string]interface{} {
 	result := make(map[string]interface{})
 	result["name"] = s.Name
@@ -300,6 +590,13 @@ func (s *statsEntry) serialize() map[string]interface{} {
 	result["response_times"] = s.ResponseTimes
 	result["num_reqs_per_sec"] = s.NumReqsPerSec
 	result["num_fail_per_sec"] = s.NumFailPerSec
+	if s.ResponseTimesMicros != nil {
+		result["response_times_us"] = s.ResponseTimesMicros
+	}
+	if s.NumSeconds > 0 || s.NumFailSeconds > 0 {
+		result["num_seconds"] = s.NumSeconds
+		result["num_fail_seconds"] = s.NumFailSeconds
+	}
 	return result
 }
 
@@ -314,17 +611,34 @@ type statsError struct {
 	method      string
 	error       string
 	occurrences int64
+	// the first distinct messages of failures before they're normalized
+	examples []string
 }
 
 func (err *statsError) occured() {
 	err.occurrences++
 }
 
+// addExamples keeps examples which aren't kept yet, until there are max examples.
+func (err *statsError) addExamples(examples []string, max int) {
+	for _, example := range examples {
+		if len(err.examples) >= max {
+			return
+		}
+		if !containsString(err.examples, example) {
+			err.examples = append(err.examples, example)
+		}
+	}
+}
+
 func (err *statsError) toMap() map[string]interface{} {
 	m := make(map[string]interface{})
 	m["method"] = err.method
 	m["name"] = err.name
 	m["error"] = err.error
 	m["occurrences"] = err.occurrences
+	if len(err.examples) > 0 {
+		m["examples"] = append([]string(nil), err.examples...)
+	}
 	return m
 }
@@ -1,16 +1,25 @@
 package boomer
 
 import (
+	"sync"
 	"testing"
 	"time"
 )
 
-func TestLogRequest(t *testing.T) {
+// logError counts a failure of err in the merged stats, without a request, like merging a shard does.
+func (s *requestStats) logError(method, name, err string) {
+	s.total.logError(err)
+	s.get(name, method).logError(err)
+	s.getError(method, name, err).occured()
+}
+
+func TestStatsRecordSuccess(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.logRequest("http", "success", 2, 30)
-	newStats.logRequest("http", "success", 3, 40)
-	newStats.logRequest("http", "success", 2, 40)
-	newStats.logRequest("http", "success", 1, 20)
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	newStats.recordSuccess("http", "success", 3, 0, 40)
+	newStats.recordSuccess("http", "success", 2, 0, 40)
+	newStats.recordSuccess("http", "success", 1, 0, 20)
+	newStats.mergeShards()
 	entry := newStats.get("success", "http")
 
 	if entry.NumRequests != 4 {
@@ -47,18 +56,19 @@ func TestLogRequest(t *testing.T) {
 	}
 }
 
-func BenchmarkLogRequest(b *testing.B) {
+func BenchmarkRecordSuccess(b *testing.B) {
 	newStats := newRequestStats()
 	for i := 0; i < b.N; i++ {
-		newStats.logRequest("http", "success", 2, 30)
+		newStats.recordSuccess("http", "success", 2, 0, 30)
 	}
 }
 
 func TestRoundedResponseTime(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.logRequest("http", "success", 147, 1)
-	newStats.logRequest("http", "success", 3432, 1)
-	newStats.logRequest("http", "success", 58760, 1)
+	newStats.recordSuccess("http", "success", 147, 0, 1)
+	newStats.recordSuccess("http", "success", 3432, 0, 1)
+	newStats.recordSuccess("http", "success", 58760, 0, 1)
+	newStats.mergeShards()
 	entry := newStats.get("success", "http")
 	responseTimes := entry.ResponseTimes
 
@@ -79,6 +89,93 @@ func TestRoundedResponseTime(t *testing.T) {
 	}
 }
 
+func TestStatsRecordSuccessWithMicros(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.histogramEnabled = true
+	newStats.recordSuccess("grpc", "success", 0, 250, 10)
+	newStats.recordSuccess("grpc", "success", 1, 1234, 10)
+	newStats.recordSuccess("grpc", "success", 58, 58760, 10)
+	newStats.mergeShards()
+	entry := newStats.get("success", "grpc")
+
+	if entry.ResponseTimes[0] != 1 {
+		t.Error("Locust style response times should be kept, got:", entry.ResponseTimes)
+	}
+	for _, us := range []int64{250, 1230, 58800} {
+		if entry.ResponseTimesMicros[us] != 1 {
+			t.Error("Rounded response time in microseconds should be", us, "got:", entry.ResponseTimesMicros)
+		}
+	}
+	if len(newStats.total.ResponseTimesMicros) != 3 {
+		t.Error("len(total.ResponseTimesMicros) is wrong, expected: 3, got:", len(newStats.total.ResponseTimesMicros))
+	}
+
+	newStats.histogramEnabled = false
+	newStats.recordSuccess("grpc", "disabled", 1, 0, 10)
+	newStats.mergeShards()
+	if newStats.get("disabled", "grpc").ResponseTimesMicros != nil {
+		t.Error("ResponseTimesMicros should be nil if the histogram is disabled")
+	}
+}
+
+func TestStripLocalStats(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.histogramEnabled = true
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	data := newStats.collectReportData()
+	data["state"] = stateRunning
+	data["node_id"] = "node"
+
+	stripped := stripLocalStats(data)
+	if _, ok := stripped["state"]; ok {
+		t.Error("state should not be reported to master")
+	}
+	if _, ok := stripped["node_id"]; ok {
+		t.Error("node_id should not be reported to master")
+	}
+	if _, ok := stripped["stats_cumulative"]; ok {
+		t.Error("stats_cumulative should not be reported to master")
+	}
+	entry := stripped["stats"].([]interface{})[0].(map[string]interface{})
+	if _, ok := entry["response_times_us"]; ok {
+		t.Error("response_times_us should be removed from stats")
+	}
+	if _, ok := stripped["stats_total"].(map[string]interface{})["response_times_us"]; ok {
+		t.Error("response_times_us should be removed from stats_total")
+	}
+	if _, ok := data["stats"].([]interface{})[0].(map[string]interface{})["response_times_us"]; !ok {
+		t.Error("The original data should not be modified")
+	}
+}
+
+func TestRecordCorrectedLatency(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	newStats.recordCorrectedLatency("task", 1600)
+	newStats.recordCorrectedLatency("task", 250400)
+	newStats.mergeShards()
+	entry := newStats.correctedEntries["task"]
+
+	if entry.NumRequests != 2 {
+		t.Error("numRequests is wrong, expected: 2, got:", entry.NumRequests)
+	}
+	if entry.MinResponseTime != 2 || entry.MaxResponseTime != 250 {
+		t.Error("Corrected latencies should be rounded to milliseconds, got:", entry.MinResponseTime, entry.MaxResponseTime)
+	}
+	if newStats.total.NumRequests != 1 {
+		t.Error("Corrected latencies should not be counted in total, got:", newStats.total.NumRequests)
+	}
+
+	data := newStats.collectReportData()
+	corrected, ok := data["stats_corrected"].([]interface{})
+	if !ok || len(corrected) != 1 {
+		t.Error("stats_corrected is wrong, got:", data["stats_corrected"])
+	}
+	if _, ok := stripLocalStats(data)["stats_corrected"]; ok {
+		t.Error("stats_corrected should not be reported to master")
+	}
+}
+
 func TestLogError(t *testing.T) {
 	newStats := newRequestStats()
 	newStats.logError("http", "failure", "500 error")
@@ -117,15 +214,15 @@ func TestLogError(t *testing.T) {
 func BenchmarkLogError(b *testing.B) {
 	newStats := newRequestStats()
 	for i := 0; i < b.N; i++ {
-		// LogError use md5 to calculate hash keys, it may slow down the only goroutine,
-		// which consumes both requestSuccessChannel and requestFailureChannel.
+		// LogError use md5 to calculate hash keys, it's only called when merging shards.
 		newStats.logError("http", "failure", "500 error")
 	}
 }
 
 func TestClearAll(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.logRequest("http", "success", 1, 20)
+	newStats.recordSuccess("http", "success", 1, 0, 20)
+	newStats.mergeShards()
 	newStats.clearAll()
 
 	if newStats.total.NumRequests != 0 {
@@ -137,17 +234,28 @@ func TestClearAllByChannel(t *testing.T) {
 	newStats := newRequestStats()
 	newStats.start()
 	defer newStats.close()
-	newStats.logRequest("http", "success", 1, 20)
+	newStats.recordSuccess("http", "success", 1, 0, 20)
+	newStats.report()
+	newStats.recordSuccess("http", "success", 1, 0, 20)
+	newStats.clearStatsChan <- true
+	// the stats goroutine only receives again after the first clearAll returns
 	newStats.clearStatsChan <- true
 
-	if newStats.total.NumRequests != 0 {
-		t.Error("After clearAll(), newStats.total.numRequests is wrong, expected: 0, got:", newStats.total.NumRequests)
+	// read the stats through the lock of the stats goroutine, instead of touching them concurrently
+	data := newStats.report()
+	total := data["stats_total"].(map[string]interface{})
+	if total["num_requests"].(int64) != 0 {
+		t.Error("After clearAll(), num_requests of stats_total is wrong, expected: 0, got:", total["num_requests"])
+	}
+	if cumulative := data["stats_cumulative"].(map[string]interface{}); len(cumulative["stats"].([]interface{})) != 0 {
+		t.Error("After clearAll(), stats_cumulative should be empty, got:", cumulative["stats"])
 	}
 }
 
 func TestSerializeStats(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.logRequest("http", "success", 1, 20)
+	newStats.recordSuccess("http", "success", 1, 0, 20)
+	newStats.mergeShards()
 
 	serialized := newStats.serializeStats()
 	if len(serialized) != 1 {
@@ -156,7 +264,7 @@ func TestSerializeStats(t *testing.T) {
 	}
 
 	first := serialized[0]
-	entry, err := deserializeStatsEntry(first)
+	entry, err := deserializeStatsEntry(first, defaultPercentTime)
 	if err != nil {
 		t.Fail()
 	}
@@ -203,7 +311,7 @@ func TestSerializeErrors(t *testing.T) {
 
 func TestCollectReportData(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.logRequest("http", "success", 2, 30)
+	newStats.recordSuccess("http", "success", 2, 0, 30)
 	newStats.logError("http", "failure", "500 error")
 	result := newStats.collectReportData()
 
@@ -218,24 +326,82 @@ func TestCollectReportData(t *testing.T) {
 	}
 }
 
-func TestStatsStart(t *testing.T) {
+func TestCollectReportDataCumulative(t *testing.T) {
 	newStats := newRequestStats()
-	newStats.start()
-	defer newStats.close()
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	newStats.logError("http", "failure", "500 error")
+	first := newStats.collectReportData()
+	newStats.recordSuccess("http", "success", 300, 0, 30)
+	second := newStats.collectReportData()
+
+	cumulative := second["stats_cumulative"].(map[string]interface{})
+	total := cumulative["stats_total"].(map[string]interface{})
+	if total["num_requests"] != int64(2) || total["num_failures"] != int64(1) {
+		t.Error("Cumulative total is wrong, got:", total["num_requests"], total["num_failures"])
+	}
+	if total["max_response_time"] != int64(300) {
+		t.Error("Cumulative max response time is wrong, expected: 300, got:", total["max_response_time"])
+	}
+	if len(cumulative["stats"].([]interface{})) != 2 {
+		t.Error("Cumulative stats are wrong, expected 2 entries, got:", cumulative["stats"])
+	}
+	errors := cumulative["errors"].(map[string]map[string]interface{})
+	if len(errors) != 1 {
+		t.Error("Cumulative errors are wrong, got:", errors)
+	}
+	if len(second["errors"].(map[string]map[string]interface{})) != 0 {
+		t.Error("Errors of the interval should be reset")
+	}
+
+	// the cumulative stats of a report aren't changed by the later reports
+	firstTotal := first["stats_cumulative"].(map[string]interface{})["stats_total"].(map[string]interface{})
+	if firstTotal["num_requests"] != int64(1) || len(firstTotal["response_times"].(map[int64]int64)) != 1 {
+		t.Error("Cumulative stats of the first report are changed, got:", firstTotal)
+	}
 
-	newStats.requestSuccessChan <- &requestSuccess{
-		requestType:    "http",
-		name:           "success",
-		responseTime:   2,
-		responseLength: 30,
+	newStats.clearAll()
+	cumulative = newStats.collectReportData()["stats_cumulative"].(map[string]interface{})
+	if cumulative["stats_total"].(map[string]interface{})["num_requests"] != int64(0) {
+		t.Error("Cumulative stats should be cleared")
 	}
+}
 
-	newStats.requestFailureChan <- &requestFailure{
-		requestType:  "http",
-		name:         "failure",
-		responseTime: 1,
-		error:        "500 error",
+func TestAccumulatePerSecond(t *testing.T) {
+	cumulative := newAggregatedEntry("Total", "")
+	report := newAggregatedEntry("Total", "")
+	report.NumRequests = 30
+	report.NumReqsPerSec = map[int64]int64{100: 10, 101: 10, 102: 10}
+	report.NumFailures = 1
+	report.NumFailPerSec = map[int64]int64{101: 1}
+	cumulative.accumulate(report)
+
+	// the second 102 is in both reports
+	report = newAggregatedEntry("Total", "")
+	report.NumRequests = 20
+	report.NumReqsPerSec = map[int64]int64{102: 5, 103: 15}
+	cumulative.accumulate(report)
+
+	if cumulative.NumRequests != 50 || cumulative.NumSeconds != 4 || cumulative.NumFailSeconds != 1 {
+		t.Error("Cumulative seconds are wrong, got:", cumulative.NumRequests, cumulative.NumSeconds, cumulative.NumFailSeconds)
+	}
+	if len(cumulative.NumReqsPerSec) != 2 || len(cumulative.NumFailPerSec) != 0 {
+		t.Error("Cumulative entries should only keep the per-second counts of the last report, got:", cumulative.NumReqsPerSec, cumulative.NumFailPerSec)
 	}
+	if rps := getEntryRps(cumulative); rps != 16 {
+		t.Error("Cumulative rps is wrong, expected: 16, got:", rps)
+	}
+	if failPerSec := getEntryFailPerSec(cumulative); failPerSec != 1 {
+		t.Error("Cumulative fail/s is wrong, expected: 1, got:", failPerSec)
+	}
+}
+
+func TestStatsStart(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.start()
+	defer newStats.close()
+
+	newStats.recordSuccess("http", "success", 2, 0, 30)
+	newStats.recordFailure("http", "failure", 1, 0, "500 error")
 
 	var ticker = time.NewTicker(slaveReportInterval + 500*time.Millisecond)
 	for {
@@ -248,3 +414,96 @@ func TestStatsStart(t *testing.T) {
 	}
 end:
 }
+
+func TestMergeShards(t *testing.T) {
+	newStats := newRequestStats()
+	newStats.histogramEnabled = true
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				newStats.recordSuccess("http", "success", int64(i+1), 0, 10)
+			}
+			newStats.recordFailure("http", "failure", 5, 0, "500 error")
+			newStats.recordCorrectedLatency("task", 2000)
+		}(i)
+	}
+	wg.Wait()
+	newStats.mergeShards()
+
+	entry := newStats.get("success", "http")
+	if entry.NumRequests != 1000 {
+		t.Error("numRequests is wrong, expected: 1000, got:", entry.NumRequests)
+	}
+	if entry.MinResponseTime != 1 || entry.MaxResponseTime != 10 {
+		t.Error("Response times are wrong, got:", entry.MinResponseTime, entry.MaxResponseTime)
+	}
+	if entry.TotalContentLength != 10000 {
+		t.Error("totalContentLength is wrong, expected: 10000, got:", entry.TotalContentLength)
+	}
+	if entry.ResponseTimesMicros[1000] != 100 {
+		t.Error("ResponseTimesMicros is wrong, got:", entry.ResponseTimesMicros)
+	}
+	if newStats.total.NumRequests != 1010 || newStats.total.NumFailures != 10 {
+		t.Error("Total is wrong, got:", newStats.total.NumRequests, newStats.total.NumFailures)
+	}
+	if err := newStats.getError("http", "failure", "500 error"); err.occurrences != 10 {
+		t.Error("occurrences is wrong, expected: 10, got:", err.occurrences)
+	}
+	if newStats.correctedEntries["task"].NumRequests != 10 {
+		t.Error("Corrected latencies are wrong, got:", newStats.correctedEntries["task"].NumRequests)
+	}
+
+	newStats.recordSuccess("http", "success", 1, 0, 10)
+	newStats.clearAll()
+	newStats.mergeShards()
+	if newStats.total.NumRequests != 0 {
+		t.Error("Requests in shards should be discarded by clearAll, got:", newStats.total.NumRequests)
+	}
+}
+
+// BenchmarkRecordSuccessParallel records requests from many goroutines, like task goroutines do.
+func BenchmarkRecordSuccessParallel(b *testing.B) {
+	newStats := newRequestStats()
+	newStats.start()
+	defer newStats.close()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			newStats.recordSuccess("http", "success", 2, 0, 30)
+		}
+	})
+}
+
+// BenchmarkRecordSuccessChannel is the replaced implementation, in which one goroutine consumes a channel.
+func BenchmarkRecordSuccessChannel(b *testing.B) {
+	newStats := newRequestStats()
+	type requestSuccess struct {
+		requestType    string
+		name           string
+		responseTime   int64
+		responseLength int64
+	}
+	requestSuccessChan := make(chan *requestSuccess, 100)
+	done := make(chan bool)
+	go func() {
+		for m := range requestSuccessChan {
+			newStats.total.log(m.responseTime, m.responseLength)
+			newStats.get(m.name, m.requestType).log(m.responseTime, m.responseLength)
+		}
+		close(done)
+	}()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			requestSuccessChan <- &requestSuccess{
+				requestType:    "http",
+				name:           "success",
+				responseTime:   2,
+				responseLength: 30,
+			}
+		}
+	})
+	close(requestSuccessChan)
+	<-done
+}
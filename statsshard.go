@@ -0,0 +1,229 @@
+package boomer
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// maxStatsShards caps the number of shards, more shards only make the merge slower.
+const maxStatsShards = 64
+
+// statsShard accumulates the requests recorded by task goroutines between two report ticks.
+// Every shard has its own lock, and goroutines running on the same P record to the same shard,
+// see requestStats.pickShard, so the lock is rarely contended. It's merged into requestStats
+// by requestStats.mergeShards.
+type statsShard struct {
+	mu sync.Mutex
+	// keyed by name + method, like requestStats.entries
+	entries map[string]*statsEntry
+	// keyed by method, name and normalized error, the md5 key is only calculated when merging
+	errors    map[statsErrorKey]*shardError
+	corrected map[string]*statsEntry
+
+	// avoid false sharing between shards
+	_ [64]byte
+}
+
+type statsErrorKey struct {
+	method string
+	name   string
+	error  string
+}
+
+// shardHint is the index of the shard picked by a P, it's cached per P by requestStats.shardHints.
+type shardHint struct {
+	index uint32
+}
+
+type shardError struct {
+	key statsErrorKey
+	// the order of the first occurrence, errors are counted against maxErrorKeys in this order
+	seq         uint64
+	occurrences int64
+	examples    []string
+}
+
+func newStatsShards() []*statsShard {
+	n := runtime.GOMAXPROCS(0) * 4
+	if n > maxStatsShards {
+		n = maxStatsShards
+	}
+	shards := make([]*statsShard, n)
+	for i := range shards {
+		shards[i] = &statsShard{}
+		shards[i].reset()
+	}
+	return shards
+}
+
+func (shard *statsShard) reset() {
+	shard.entries = make(map[string]*statsEntry)
+	shard.errors = make(map[statsErrorKey]*shardError)
+	shard.corrected = make(map[string]*statsEntry)
+}
+
+func (shard *statsShard) get(name, method string) *statsEntry {
+	entry, ok := shard.entries[name+method]
+	if !ok {
+		entry = &statsEntry{
+			Name:   name,
+			Method: method,
+		}
+		entry.reset()
+		shard.entries[name+method] = entry
+	}
+	return entry
+}
+
+// newShardHints returns a pool of shard hints, which gives every P its own shard index.
+// sync.Pool keeps a private object per P, so recording a request doesn't touch any memory shared
+// between Ps except the shard picked by the P. A new index is only taken from s.shardIndex when the
+// pool is empty, like after a GC.
+func (s *requestStats) newShardHints() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return &shardHint{index: atomic.AddUint32(&s.shardIndex, 1)}
+		},
+	}
+}
+
+// pickShard returns the shard of the current P, and the hint which must be returned by putShardHint
+// after recording.
+func (s *requestStats) pickShard() (*statsShard, *shardHint) {
+	hint := s.shardHints.Get().(*shardHint)
+	return s.shards[hint.index%uint32(len(s.shards))], hint
+}
+
+func (s *requestStats) putShardHint(hint *shardHint) {
+	s.shardHints.Put(hint)
+}
+
+// recordSuccess is called by task goroutines, it's safe for concurrent use.
+func (s *requestStats) recordSuccess(method, name string, responseTime int64, responseTimeMicros int64, contentLength int64) {
+	shard, hint := s.pickShard()
+	shard.mu.Lock()
+	entry := shard.get(name, method)
+	entry.log(responseTime, contentLength)
+	if s.histogramEnabled {
+		entry.logResponseTimeMicros(microsOrDefault(responseTimeMicros, responseTime))
+	}
+	shard.mu.Unlock()
+	s.putShardHint(hint)
+}
+
+// recordFailure is called by task goroutines, it's safe for concurrent use.
+func (s *requestStats) recordFailure(method, name string, responseTime int64, responseTimeMicros int64, err string) {
+	s.recordError(method, name, responseTime, responseTimeMicros, recordedError(err))
+}
+
+// recordError is like recordFailure, the failure is counted by the message of err rewritten by errorNormalizers.
+func (s *requestStats) recordError(method, name string, responseTime int64, responseTimeMicros int64, err error) {
+	message := normalizeError(s.errorNormalizers, err)
+	shard, hint := s.pickShard()
+	shard.mu.Lock()
+	entry := shard.get(name, method)
+	entry.log(responseTime, 0)
+	if s.histogramEnabled {
+		entry.logResponseTimeMicros(microsOrDefault(responseTimeMicros, responseTime))
+	}
+	entry.logError(message)
+	key := statsErrorKey{method: method, name: name, error: message}
+	e, ok := shard.errors[key]
+	if !ok {
+		e = &shardError{key: key, seq: atomic.AddUint64(&s.errorSeq, 1)}
+		shard.errors[key] = e
+	}
+	e.occurrences++
+	if len(e.examples) < s.errorExamples {
+		if example := err.Error(); !containsString(e.examples, example) {
+			e.examples = append(e.examples, example)
+		}
+	}
+	shard.mu.Unlock()
+	s.putShardHint(hint)
+}
+
+// recordCorrectedLatency records the latency of a task from its intended start to its completion,
+// it's safe for concurrent use. The latencies are reported as stats_corrected, not counted as requests.
+func (s *requestStats) recordCorrectedLatency(name string, responseTimeMicros int64) {
+	shard, hint := s.pickShard()
+	shard.mu.Lock()
+	entry, ok := shard.corrected[name]
+	if !ok {
+		entry = &statsEntry{
+			Name:   name,
+			Method: correctedLatencyMethod,
+		}
+		entry.reset()
+		shard.corrected[name] = entry
+	}
+	entry.log((responseTimeMicros+500)/1000, 0)
+	if s.histogramEnabled {
+		entry.logResponseTimeMicros(responseTimeMicros)
+	}
+	shard.mu.Unlock()
+	s.putShardHint(hint)
+}
+
+// mergeShards moves the requests recorded in shards into s, it's called before collecting report data.
+func (s *requestStats) mergeShards() {
+	var errors []*shardError
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		entries, shardErrors, corrected := shard.entries, shard.errors, shard.corrected
+		empty := len(entries) == 0 && len(shardErrors) == 0 && len(corrected) == 0
+		if !empty {
+			shard.reset()
+		}
+		shard.mu.Unlock()
+		// the maps of an empty shard are still used by task goroutines
+		if empty {
+			continue
+		}
+
+		for _, entry := range entries {
+			mergeStatsEntry(s.get(entry.Name, entry.Method), entry)
+			mergeStatsEntry(s.total, entry)
+		}
+		for _, e := range shardErrors {
+			errors = append(errors, e)
+		}
+		for name, entry := range corrected {
+			merged, ok := s.correctedEntries[name]
+			if !ok {
+				s.correctedEntries[name] = entry
+				continue
+			}
+			mergeStatsEntry(merged, entry)
+		}
+	}
+
+	sort.Slice(errors, func(i, j int) bool {
+		return errors[i].seq < errors[j].seq
+	})
+	for _, e := range errors {
+		merged := s.getError(e.key.method, e.key.name, e.key.error)
+		merged.occurrences += e.occurrences
+		merged.addExamples(e.examples, s.errorExamples)
+	}
+}
+
+// discardShards drops the requests recorded in shards, it's called when the stats are cleared.
+func (s *requestStats) discardShards() {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.reset()
+		shard.mu.Unlock()
+	}
+}
+
+// mergeStatsEntry is like statsEntry.extend, but dst is considered to have no requests
+// if it's empty, so the time of the last request isn't the time of merging.
+func mergeStatsEntry(dst *statsEntry, src *statsEntry) {
+	if dst.NumRequests == 0 && dst.NumFailures == 0 {
+		dst.LastRequestTimestamp = src.LastRequestTimestamp
+	}
+	dst.extend(src)
+}
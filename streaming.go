@@ -0,0 +1,509 @@
+package boomer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many times InfluxOutput, StatsDOutput and GraphiteOutput retry a failed batch
+const streamRetries = 3
+
+// how long to wait before the first retry, it's doubled for every retry
+var streamRetryInterval = 200 * time.Millisecond
+
+// max batches queued by InfluxOutput, StatsDOutput and GraphiteOutput, new batches are dropped if the queue is full
+const streamQueueSize = 100
+
+// how long OnStop waits for the queued batches to be sent, the rest are dropped
+var streamFlushTimeout = 5 * time.Second
+
+// max size of a UDP packet of StatsDOutput, which fits in the MTU of most networks
+const maxStatsDPacketSize = 1432
+
+// max lines in a request of InfluxOutput
+const maxInfluxBatchLines = 5000
+
+// streamPoint has the metrics of a request in a report interval.
+type streamPoint struct {
+	method string
+	name   string
+	fields []streamField
+}
+
+type streamField struct {
+	name    string
+	value   float64
+	integer bool
+}
+
+// newStreamPoints returns the metrics of every request sorted by name and the total in output, the total is named Aggregated.
+// Values are the same as JsonFileOutput.
+func newStreamPoints(output *dataOutput) []streamPoint {
+	stats := sortOutput(output.Stats)
+	if output.TotalStats != nil {
+		total := *output.TotalStats
+		total.Method, total.Name = "", "Aggregated"
+		stats = append(stats[:len(stats):len(stats)], &total)
+	}
+	points := make([]streamPoint, 0, len(stats))
+	for _, stat := range stats {
+		points = append(points, streamPoint{
+			method: stat.Method,
+			name:   stat.Name,
+			fields: []streamField{
+				{"count", float64(stat.NumRequests), true},
+				{"fail", float64(stat.NumFailures), true},
+				{"avg", stat.AvgResponseTime, false},
+				{"median", float64(stat.MedianResponseTime), true},
+				{"p90", float64(getPercentResponseTime(stat.NumRequests, stat.ResponseTimes, 90)), true},
+				{"p95", float64(stat.Percent95ResponseTime), true},
+				{"p99", float64(getPercentResponseTime(stat.NumRequests, stat.ResponseTimes, 99)), true},
+				{"rps", float64(stat.CurrentRps), true},
+			},
+		})
+	}
+	return points
+}
+
+// permanentError isn't retried, like a bad request.
+type permanentError struct {
+	error
+}
+
+// checkResponse returns an error with the status and the message of a response which isn't successful.
+// Bad requests are permanent errors, but rate limits and server errors are retried.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("status: %s, %s", resp.Status, bytes.TrimSpace(message))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// retrySend calls send until it succeeds or fails for streamRetries+1 times.
+func retrySend(send func() error) error {
+	interval := streamRetryInterval
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = send()
+		if err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt == streamRetries {
+			return err
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// streamSender sends batches of metrics with retries in a goroutine, so a slow or down backend
+// doesn't block the outputs of the runner. The goroutine is started by the first batch.
+type streamSender struct {
+	// name of the backend for logs
+	name string
+	send func(batch string) error
+
+	lock  sync.Mutex
+	queue chan string
+	// closed when all the batches in queue are handled
+	done chan bool
+	// closed if the batches aren't flushed in streamFlushTimeout
+	drop chan bool
+}
+
+func newStreamSender(name string, send func(batch string) error) *streamSender {
+	return &streamSender{
+		name: name,
+		send: send,
+	}
+}
+
+// enqueue queues batch to send, it's dropped if the queue is full.
+func (s *streamSender) enqueue(batch string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queue == nil {
+		s.queue = make(chan string, streamQueueSize)
+		s.done = make(chan bool)
+		s.drop = make(chan bool)
+		go s.loop(s.queue, s.done, s.drop)
+	}
+	select {
+	case s.queue <- batch:
+	default:
+		log.Printf("Too many metrics are waiting to be sent to %s, dropped a batch.\n", s.name)
+	}
+}
+
+func (s *streamSender) loop(queue chan string, done chan bool, drop chan bool) {
+	defer close(done)
+	for batch := range queue {
+		select {
+		case <-drop:
+			return
+		default:
+		}
+		if err := retrySend(func() error { return s.send(batch) }); err != nil {
+			log.Printf("Failed to send metrics to %s, %v\n", s.name, err)
+		}
+	}
+}
+
+// stop waits streamFlushTimeout for the queued batches to be sent, and drops the rest.
+// Batches queued after stop are sent by a new goroutine.
+func (s *streamSender) stop() {
+	s.lock.Lock()
+	queue, done, drop := s.queue, s.done, s.drop
+	s.queue, s.done, s.drop = nil, nil, nil
+	s.lock.Unlock()
+	if queue == nil {
+		return
+	}
+	close(queue)
+	select {
+	case <-done:
+	case <-time.After(streamFlushTimeout):
+		close(drop)
+		log.Printf("Timeout waiting for metrics to be sent to %s, the rest are dropped.\n", s.name)
+	}
+}
+
+// streamNodeID returns the ID of the worker in data, or defaultID in standalone mode.
+func streamNodeID(data map[string]interface{}, defaultID string) string {
+	if nodeID, ok := data["node_id"].(string); ok {
+		return nodeID
+	}
+	return defaultID
+}
+
+func formatStreamValue(field streamField) string {
+	if field.integer {
+		return strconv.FormatInt(int64(field.value), 10)
+	}
+	return strconv.FormatFloat(field.value, 'f', -1, 64)
+}
+
+// InfluxOutput writes the metrics of every report to InfluxDB by the line protocol over HTTP,
+// like "boomer,node_id=...,request_type=GET,request_name=/foo count=10i,fail=0i,avg=12.5,... <timestamp>".
+// Metrics are sent in the background, and OnStop waits for them to be sent.
+type InfluxOutput struct {
+	writeURL string
+	nodeID   string
+	client   *http.Client
+	sender   *streamSender
+	// Measurement defaults to boomer.
+	Measurement string
+	// Token is sent as "Authorization: Token <token>" if it's set, for InfluxDB 2.x.
+	Token string
+}
+
+// NewInfluxOutput returns an InfluxOutput, writeURL is the write endpoint with the precision of nanoseconds,
+// like "http://localhost:8086/write?db=boomer" for InfluxDB 1.x
+// or "http://localhost:8086/api/v2/write?org=my-org&bucket=boomer" for InfluxDB 2.x.
+func NewInfluxOutput(writeURL string) *InfluxOutput {
+	o := &InfluxOutput{
+		writeURL:    writeURL,
+		nodeID:      getNodeID(),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		Measurement: "boomer",
+	}
+	o.sender = newStreamSender("InfluxDB", o.write)
+	return o
+}
+
+// OnStart of InfluxOutput has nothing to do.
+func (o *InfluxOutput) OnStart() {
+
+}
+
+// OnStop waits for the metrics to be written.
+func (o *InfluxOutput) OnStop() {
+	o.sender.stop()
+}
+
+// OnEvent queues the metrics to write to InfluxDB in batches of maxInfluxBatchLines lines.
+func (o *InfluxOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
+	nodeID := escapeInfluxTag(streamNodeID(data, o.nodeID))
+
+	var lines []string
+	for _, point := range newStreamPoints(output) {
+		var b strings.Builder
+		b.WriteString(escapeInfluxMeasurement(o.Measurement))
+		b.WriteString(",node_id=" + nodeID)
+		if point.method != "" {
+			b.WriteString(",request_type=" + escapeInfluxTag(point.method))
+		}
+		b.WriteString(",request_name=" + escapeInfluxTag(point.name))
+		for i, field := range point.fields {
+			if i == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte(',')
+			}
+			b.WriteString(field.name + "=" + formatStreamValue(field))
+			if field.integer {
+				b.WriteByte('i')
+			}
+		}
+		b.WriteString(" " + timestamp)
+		lines = append(lines, b.String())
+	}
+
+	for start := 0; start < len(lines); start += maxInfluxBatchLines {
+		end := start + maxInfluxBatchLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		o.sender.enqueue(strings.Join(lines[start:end], "\n") + "\n")
+	}
+}
+
+func (o *InfluxOutput) write(body string) error {
+	req, err := http.NewRequest("POST", o.writeURL, strings.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.Token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// newlines can't be escaped in the line protocol, they're replaced by escaped spaces.
+// strings.Replacer doesn't replace its output again, so the spaces must be escaped here.
+var influxTagReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `)
+
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\ `)
+
+func escapeInfluxTag(s string) string {
+	// empty tag values aren't allowed
+	if s == "" {
+		return "none"
+	}
+	return influxTagReplacer.Replace(s)
+}
+
+func escapeInfluxMeasurement(s string) string {
+	return influxMeasurementReplacer.Replace(s)
+}
+
+// StatsDOutput sends the metrics of every report to StatsD over UDP, with tags in the DogStatsD format,
+// like "boomer.count:10|c|#node_id:...,request_type:GET,request_name:/foo".
+// count and fail are counters, and others are gauges. Lines are batched into packets of maxStatsDPacketSize bytes,
+// which are sent in the background.
+type StatsDOutput struct {
+	addr   string
+	nodeID string
+	sender *streamSender
+	// Prefix of metric names, it defaults to boomer.
+	Prefix string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewStatsDOutput returns a StatsDOutput, which sends to addr, like "localhost:8125".
+func NewStatsDOutput(addr string) *StatsDOutput {
+	o := &StatsDOutput{
+		addr:   addr,
+		nodeID: getNodeID(),
+		Prefix: "boomer",
+	}
+	o.sender = newStreamSender("StatsD", o.send)
+	return o
+}
+
+// OnStart of StatsDOutput has nothing to do, the connection is made by the first report.
+func (o *StatsDOutput) OnStart() {
+
+}
+
+// OnStop waits for the metrics to be sent, and closes the connection.
+func (o *StatsDOutput) OnStop() {
+	o.sender.stop()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+// OnEvent queues the metrics to send to StatsD.
+func (o *StatsDOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+	nodeID := escapeStatsDTag(streamNodeID(data, o.nodeID))
+
+	var packets []string
+	var packet strings.Builder
+	for _, point := range newStreamPoints(output) {
+		tags := "|#node_id:" + nodeID
+		if point.method != "" {
+			tags += ",request_type:" + escapeStatsDTag(point.method)
+		}
+		tags += ",request_name:" + escapeStatsDTag(point.name)
+		for _, field := range point.fields {
+			metricType := "g"
+			if field.name == "count" || field.name == "fail" {
+				metricType = "c"
+			}
+			line := fmt.Sprintf("%s.%s:%s|%s%s", o.Prefix, field.name, formatStreamValue(field), metricType, tags)
+			if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacketSize {
+				packets = append(packets, packet.String())
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.String())
+	}
+
+	for _, p := range packets {
+		o.sender.enqueue(p)
+	}
+}
+
+func (o *StatsDOutput) send(packet string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.conn == nil {
+		conn, err := net.Dial("udp", o.addr)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+	if _, err := o.conn.Write([]byte(packet)); err != nil {
+		// redial for the next attempt
+		o.conn.Close()
+		o.conn = nil
+		return err
+	}
+	return nil
+}
+
+var statsDTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+func escapeStatsDTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return statsDTagReplacer.Replace(s)
+}
+
+// GraphiteOutput sends the metrics of every report to Graphite by the plaintext protocol over TCP,
+// with tags of Graphite 1.1, like "boomer.count;node_id=...;request_type=GET;request_name=/foo 10 <timestamp>".
+// Metrics are sent in the background, and OnStop waits for them to be sent.
+type GraphiteOutput struct {
+	addr   string
+	nodeID string
+	sender *streamSender
+	// Prefix of metric names, it defaults to boomer.
+	Prefix string
+}
+
+// NewGraphiteOutput returns a GraphiteOutput, which sends to addr, like "localhost:2003".
+func NewGraphiteOutput(addr string) *GraphiteOutput {
+	o := &GraphiteOutput{
+		addr:   addr,
+		nodeID: getNodeID(),
+		Prefix: "boomer",
+	}
+	o.sender = newStreamSender("Graphite", o.send)
+	return o
+}
+
+// OnStart of GraphiteOutput has nothing to do.
+func (o *GraphiteOutput) OnStart() {
+
+}
+
+// OnStop waits for the metrics to be sent.
+func (o *GraphiteOutput) OnStop() {
+	o.sender.stop()
+}
+
+// OnEvent queues the metrics to send to Graphite in a connection.
+func (o *GraphiteOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nodeID := escapeGraphiteTag(streamNodeID(data, o.nodeID))
+
+	var b strings.Builder
+	for _, point := range newStreamPoints(output) {
+		tags := ";node_id=" + nodeID
+		if point.method != "" {
+			tags += ";request_type=" + escapeGraphiteTag(point.method)
+		}
+		tags += ";request_name=" + escapeGraphiteTag(point.name)
+		for _, field := range point.fields {
+			b.WriteString(fmt.Sprintf("%s.%s%s %s %s\n", o.Prefix, field.name, tags, formatStreamValue(field), timestamp))
+		}
+	}
+	if b.Len() == 0 {
+		return
+	}
+	o.sender.enqueue(b.String())
+}
+
+func (o *GraphiteOutput) send(lines string) error {
+	conn, err := net.DialTimeout("tcp", o.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, lines)
+	return err
+}
+
+var graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\n", "_")
+
+// escapeGraphiteTag replaces characters not allowed in tag values of Graphite.
+func escapeGraphiteTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return graphiteTagReplacer.Replace(s)
+}
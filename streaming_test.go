@@ -0,0 +1,225 @@
+package boomer
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStreamPoints(t *testing.T) {
+	output, err := convertData(newTestReportData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := newStreamPoints(output)
+	assert.Len(t, points, 3)
+	assert.Len(t, output.Stats, 2)
+
+	total := points[2]
+	assert.Equal(t, "", total.method)
+	assert.Equal(t, "Aggregated", total.name)
+	values := map[string]float64{}
+	for _, field := range total.fields {
+		values[field.name] = field.value
+	}
+	assert.Equal(t, float64(3), values["count"])
+	assert.Equal(t, float64(1), values["fail"])
+	assert.Equal(t, output.TotalStats.AvgResponseTime, values["avg"])
+	assert.Equal(t, float64(output.TotalStats.MedianResponseTime), values["median"])
+	assert.Equal(t, float64(30), values["p99"])
+}
+
+func TestRetrySend(t *testing.T) {
+	defer func(interval time.Duration) { streamRetryInterval = interval }(streamRetryInterval)
+	streamRetryInterval = time.Millisecond
+
+	attempts := 0
+	err := retrySend(func() error {
+		attempts++
+		if attempts < 3 {
+			return net.UnknownNetworkError("test")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = retrySend(func() error {
+		attempts++
+		return net.UnknownNetworkError("test")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, streamRetries+1, attempts)
+
+	attempts = 0
+	err = retrySend(func() error {
+		attempts++
+		return permanentError{net.UnknownNetworkError("test")}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestInfluxOutput(t *testing.T) {
+	defer func(interval time.Duration) { streamRetryInterval = interval }(streamRetryInterval)
+	streamRetryInterval = time.Millisecond
+
+	var lock sync.Mutex
+	var bodies []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		// the first request fails, and it should be retried
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	o := NewInfluxOutput(server.URL + "/write?db=boomer")
+	o.Token = "secret"
+	data := newTestReportData()
+	data["node_id"] = "worker 1"
+	o.OnStart()
+	o.OnEvent(data)
+	o.OnStop()
+
+	assert.Equal(t, 2, requests)
+	assert.Len(t, bodies, 1)
+	lines := strings.Split(strings.TrimSpace(bodies[0]), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], `boomer,node_id=worker\ 1,request_type=http,request_name=home count=1i,fail=1i,avg=30,median=30i,p90=30i,p95=30i,p99=30i,rps=1i `), lines[0])
+	assert.True(t, strings.HasPrefix(lines[2], `boomer,node_id=worker\ 1,request_name=Aggregated count=3i,fail=1i,`), lines[2])
+}
+
+func TestEscapeInflux(t *testing.T) {
+	assert.Equal(t, `a\,b\=c\ d\ e`, escapeInfluxTag("a,b=c d\ne"))
+	assert.Equal(t, "none", escapeInfluxTag(""))
+	assert.Equal(t, `a\,b=c\ d\ e`, escapeInfluxMeasurement("a,b=c d\ne"))
+}
+
+func TestInfluxOutputBadRequest(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	o := NewInfluxOutput(server.URL)
+	o.OnEvent(newTestReportData())
+	o.OnStop()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestStreamSenderDoesNotBlock(t *testing.T) {
+	defer func(timeout time.Duration) { streamFlushTimeout = timeout }(streamFlushTimeout)
+	streamFlushTimeout = 50 * time.Millisecond
+
+	release := make(chan bool)
+	var sent int32
+	sender := newStreamSender("test", func(batch string) error {
+		<-release
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+
+	// the first batch is being sent, the queue is full, and the last batch is dropped
+	start := time.Now()
+	for i := 0; i < streamQueueSize+2; i++ {
+		sender.enqueue("batch")
+	}
+	assert.True(t, time.Since(start) < time.Second, "enqueue should not wait for sending")
+
+	// batches not sent in streamFlushTimeout are dropped
+	sender.stop()
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sent))
+
+	// batches queued after stop are sent by a new goroutine
+	sender.enqueue("batch")
+	sender.stop()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&sent))
+}
+
+func TestStatsDOutput(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o := NewStatsDOutput(conn.LocalAddr().String())
+	o.nodeID = "worker-1"
+	o.OnStart()
+	o.OnEvent(newTestReportData())
+	o.OnStop()
+
+	var lines []string
+	buf := make([]byte, maxStatsDPacketSize)
+	for len(lines) < 24 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, n <= maxStatsDPacketSize)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Len(t, lines, 24)
+	assert.Equal(t, "boomer.count:1|c|#node_id:worker-1,request_type:http,request_name:home", lines[0])
+	assert.Equal(t, "boomer.avg:30|g|#node_id:worker-1,request_type:http,request_name:home", lines[2])
+	assert.Equal(t, "boomer.rps:3|g|#node_id:worker-1,request_name:Aggregated", lines[23])
+}
+
+func TestGraphiteOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	o := NewGraphiteOutput(listener.Addr().String())
+	o.nodeID = "worker;1"
+	o.OnStart()
+	o.OnEvent(newTestReportData())
+	o.OnStop()
+
+	lines := <-received
+	assert.Len(t, lines, 24)
+	fields := strings.Fields(lines[8])
+	assert.Equal(t, "boomer.count;node_id=worker_1;request_type=http;request_name=login", fields[0])
+	assert.Equal(t, "2", fields[1])
+}
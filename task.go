@@ -1,5 +1,7 @@
 package boomer
 
+import "context"
+
 // Task is like the "Locust object" in locust, the python version.
 // When boomer receives a start message from master, it will spawn several goroutines to run Task.Fn.
 // But users can keep some information in the python version, they can't do the same things in boomer.
@@ -8,6 +10,23 @@ type Task struct {
 	// The weight is used to distribute goroutines over multiple tasks.
 	Weight int
 	// Fn is called by the goroutines allocated to this task, in a loop.
-	Fn   func()
-	Name string
+	Fn func()
+	// FnCtx is like Fn, but it receives a context which is cancelled when boomer stops or quits.
+	// If both Fn and FnCtx are set, FnCtx is preferred.
+	FnCtx func(ctx context.Context)
+	Name  string
+	// WaitTime is how long the goroutine waits after running this task, before picking the next one.
+	// If it's nil, the wait time of the user class is used, and no wait if neither is set.
+	WaitTime WaitTime
+}
+
+// run calls FnCtx with a context scoped to this iteration, or Fn if FnCtx is not set.
+func (t *Task) run(ctx context.Context) {
+	if t.FnCtx == nil {
+		t.Fn()
+		return
+	}
+	iterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.FnCtx(iterCtx)
 }
@@ -1,6 +1,7 @@
 package boomer
 
 import (
+	"context"
 	"sync"
 )
 
@@ -28,8 +29,10 @@ type roundRobinTask struct {
 func newRoundRobinTask(task *Task) *roundRobinTask {
 	rrTask := &roundRobinTask{}
 	rrTask.Fn = task.Fn
+	rrTask.FnCtx = task.FnCtx
 	rrTask.Weight = task.Weight
 	rrTask.Name = task.Name
+	rrTask.WaitTime = task.WaitTime
 	rrTask.currentWeight = 0
 	rrTask.effectiveWeight = task.Weight
 	return rrTask
@@ -110,8 +113,14 @@ func (ts *SmoothRoundRobinTaskSet) GetWeight() (weight int) {
 // Run will pick up a task in the task set smoothly and run.
 // It can is used as a Task.Fn.
 func (ts *SmoothRoundRobinTaskSet) Run() {
+	ts.RunCtx(context.Background())
+}
+
+// RunCtx is like Run, but passes ctx to the picked task if it has a FnCtx.
+// It can is used as a Task.FnCtx.
+func (ts *SmoothRoundRobinTaskSet) RunCtx(ctx context.Context) {
 	task := ts.GetTask()
 	if task != nil {
-		task.Fn()
+		task.run(ctx)
 	}
 }
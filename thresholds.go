@@ -0,0 +1,343 @@
+package boomer
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var thresholdRegexp = regexp.MustCompile(`^\s*([a-z_]+|p[0-9]+(?:\.[0-9]+)?)\s*(<=|>=|<|>)\s*([0-9.]+)\s*(ms|s|%)?\s*$`)
+
+// Threshold is a pass/fail rule against the stats aggregated since the start of the test,
+// like "p95 < 300ms", "fail_ratio < 1%" or "rps > 500".
+//
+// Supported metrics are percentiles like p50, p95 and p99.9, avg, min, max and median in milliseconds,
+// fail_ratio, rps, requests and failures. Latencies accept ms and s units, and fail_ratio accepts %.
+type Threshold struct {
+	// Name of requests to check, all the requests are checked if it's empty.
+	// Requests of the name with different methods are aggregated, unless Method is set.
+	Name string
+	// Method of requests to check, requests of all the methods are checked if it's empty.
+	Method   string
+	Metric   string
+	Operator string
+	Value    float64
+	// If AbortOnFail is true, the test is stopped as soon as the rule is breached.
+	AbortOnFail bool
+	// Breaches in DelayAbortEval since the start of the test don't abort it, like a warm up.
+	DelayAbortEval time.Duration
+
+	expr string
+}
+
+// ParseThreshold parses expr like "p95 < 300ms" into a Threshold for requests of name,
+// an empty name means all the requests.
+func ParseThreshold(name, expr string) (*Threshold, error) {
+	matches := thresholdRegexp.FindStringSubmatch(expr)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid threshold %q, expected like p95<300ms, fail_ratio<1%% or rps>500", expr)
+	}
+	metric, operator, unit := matches[1], matches[2], matches[4]
+	value, err := strconv.ParseFloat(matches[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of threshold %q, %v", expr, err)
+	}
+
+	switch {
+	case isLatencyMetric(metric):
+		switch unit {
+		case "", "ms":
+		case "s":
+			value *= 1000
+		default:
+			return nil, fmt.Errorf("invalid unit of threshold %q, expected ms or s", expr)
+		}
+		if strings.HasPrefix(metric, "p") {
+			if p, _ := strconv.ParseFloat(metric[1:], 64); p <= 0 || p > 100 {
+				return nil, fmt.Errorf("invalid percentile of threshold %q", expr)
+			}
+		}
+	case metric == "fail_ratio":
+		switch unit {
+		case "":
+		case "%":
+			value /= 100
+		default:
+			return nil, fmt.Errorf("invalid unit of threshold %q, expected %%", expr)
+		}
+	case metric == "rps" || metric == "requests" || metric == "failures":
+		if unit != "" {
+			return nil, fmt.Errorf("invalid unit of threshold %q, %s has no unit", expr, metric)
+		}
+	default:
+		return nil, fmt.Errorf("unknown metric %s of threshold %q", metric, expr)
+	}
+
+	return &Threshold{
+		Name:     name,
+		Metric:   metric,
+		Operator: operator,
+		Value:    value,
+		expr:     strings.Join(strings.Fields(expr), ""),
+	}, nil
+}
+
+func isLatencyMetric(metric string) bool {
+	switch metric {
+	case "avg", "min", "max", "median":
+		return true
+	}
+	return strings.HasPrefix(metric, "p")
+}
+
+// String returns the rule like "p95<300ms of login", or "p95<300ms of GET login" if Method is set.
+func (t *Threshold) String() string {
+	expr := t.expr
+	if expr == "" {
+		expr = fmt.Sprintf("%s%s%g", t.Metric, t.Operator, t.Value)
+	}
+	target := strings.TrimSpace(t.Method + " " + t.Name)
+	if target == "" {
+		return expr
+	}
+	return fmt.Sprintf("%s of %s", expr, target)
+}
+
+// matches returns true if requests of method and name are checked by t.
+func (t *Threshold) matches(method, name string) bool {
+	return (t.Name == "" || t.Name == name) && (t.Method == "" || t.Method == method)
+}
+
+// valueOf returns the value of t.Metric in entry.
+func (t *Threshold) valueOf(entry *statsEntry) float64 {
+	switch t.Metric {
+	case "avg":
+		return getAvgResponseTime(entry.NumRequests, entry.TotalResponseTime)
+	case "min":
+		return float64(entry.MinResponseTime)
+	case "max":
+		return float64(entry.MaxResponseTime)
+	case "median":
+		return percentileOf(entry, 50)
+	case "fail_ratio":
+		return getTotalFailRatio(entry.NumRequests, entry.NumFailures)
+	case "rps":
+		return float64(getEntryRps(entry))
+	case "requests":
+		return float64(entry.NumRequests)
+	case "failures":
+		return float64(entry.NumFailures)
+	}
+	p, _ := strconv.ParseFloat(t.Metric[1:], 64)
+	return percentileOf(entry, p)
+}
+
+// percentileOf prefers the latency histogram, which is more precise, see EnableLatencyHistogram.
+func percentileOf(entry *statsEntry, percentile float64) float64 {
+	if len(entry.ResponseTimesMicros) > 0 {
+		return getPercentileFromMicros(entry.ResponseTimesMicros, percentile)
+	}
+	return float64(getPercentileFromHistogram(entry.ResponseTimes, percentile))
+}
+
+func (t *Threshold) passes(value float64) bool {
+	switch t.Operator {
+	case "<":
+		return value < t.Value
+	case "<=":
+		return value <= t.Value
+	case ">":
+		return value > t.Value
+	case ">=":
+		return value >= t.Value
+	}
+	return false
+}
+
+func (t *Threshold) formatValue(value float64) string {
+	switch {
+	case t.Metric == "fail_ratio":
+		return fmt.Sprintf("%.2f%%", value*100)
+	case isLatencyMetric(t.Metric):
+		return fmt.Sprintf("%.2fms", value)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// thresholdResult is the result of a Threshold in the last check.
+type thresholdResult struct {
+	threshold *Threshold
+	passed    bool
+	// the reason of failure, or the value if it's passed
+	detail string
+}
+
+// ThresholdOutput checks thresholds against the stats aggregated since the start of the test,
+// on every report and when the test is stopped. If a threshold with AbortOnFail is breached,
+// the test is aborted. Thresholds added by Boomer.AddThreshold are checked by the ThresholdOutput of Boomer,
+// see Boomer.Failed for the verdict.
+type ThresholdOutput struct {
+	thresholds []*Threshold
+	// called once when a threshold with AbortOnFail is breached
+	abort func()
+
+	lock sync.Mutex
+	// stats since the start, from stats_cumulative of the data
+	stats     *statsAggregator
+	startTime time.Time
+	results   []thresholdResult
+	aborted   bool
+	finished  bool
+}
+
+// NewThresholdOutput returns a ThresholdOutput.
+func NewThresholdOutput(thresholds ...*Threshold) *ThresholdOutput {
+	return &ThresholdOutput{
+		thresholds: thresholds,
+		stats:      newStatsAggregator(),
+	}
+}
+
+// AddThreshold adds a threshold, it must be called before the test is started.
+func (o *ThresholdOutput) AddThreshold(threshold *Threshold) {
+	o.thresholds = append(o.thresholds, threshold)
+}
+
+// OnStart records the start of the test for Threshold.DelayAbortEval.
+func (o *ThresholdOutput) OnStart() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.startTime = time.Now()
+}
+
+// OnEvent checks the thresholds against the stats since the start of the test.
+func (o *ThresholdOutput) OnEvent(data map[string]interface{}) {
+	output, err := convertData(data)
+	if err != nil {
+		log.Println(fmt.Sprintf("convert data error: %v", err))
+		return
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.stats.cumulative(output, defaultPercentTime)
+	o.check(false)
+
+	if o.abort == nil || o.aborted {
+		return
+	}
+	for _, result := range o.results {
+		threshold := result.threshold
+		if !result.passed && threshold.AbortOnFail && time.Since(o.startTime) >= threshold.DelayAbortEval {
+			log.Printf("Threshold %s is breached, %s, aborting the test.\n", threshold, result.detail)
+			o.aborted = true
+			go o.abort()
+			return
+		}
+	}
+}
+
+// OnStop checks the thresholds for the last time, and prints the summary.
+func (o *ThresholdOutput) OnStop() {
+	o.finish()
+}
+
+// entryOf returns the stats since the start of requests checked by threshold, it returns nil if there are none.
+// Stats of different requests are only aggregated if the threshold doesn't set the name or the method.
+func (o *ThresholdOutput) entryOf(threshold *Threshold) *statsEntry {
+	allStats := o.stats.last
+	if allStats == nil {
+		return nil
+	}
+	if threshold.Name == "" && threshold.Method == "" {
+		if allStats.TotalStats == nil {
+			return nil
+		}
+		return &allStats.TotalStats.statsEntry
+	}
+	var entry *statsEntry
+	for _, stat := range allStats.Stats {
+		if !threshold.matches(stat.Method, stat.Name) {
+			continue
+		}
+		if entry == nil {
+			entry = newAggregatedEntry(threshold.Name, threshold.Method)
+		}
+		entry.extend(&stat.statsEntry)
+	}
+	return entry
+}
+
+// check updates o.results, rules of names without requests are only failed at the end.
+func (o *ThresholdOutput) check(final bool) {
+	o.results = o.results[:0]
+	for _, threshold := range o.thresholds {
+		entry := o.entryOf(threshold)
+		if entry == nil || entry.NumRequests == 0 {
+			o.results = append(o.results, thresholdResult{
+				threshold: threshold,
+				passed:    !final,
+				detail:    "no requests",
+			})
+			continue
+		}
+		value := threshold.valueOf(entry)
+		o.results = append(o.results, thresholdResult{
+			threshold: threshold,
+			passed:    threshold.passes(value),
+			detail:    threshold.formatValue(value),
+		})
+	}
+}
+
+// finish does the final check once, and prints the summary.
+func (o *ThresholdOutput) finish() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.finished {
+		return
+	}
+	o.finished = true
+	o.check(true)
+	println(o.summary())
+}
+
+// Passed returns true if all the thresholds are passed in the last check.
+func (o *ThresholdOutput) Passed() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, result := range o.results {
+		if !result.passed {
+			return false
+		}
+	}
+	return !o.aborted
+}
+
+func (o *ThresholdOutput) summary() string {
+	results := make([]thresholdResult, len(o.results))
+	copy(results, o.results)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].passed && !results[j].passed
+	})
+
+	var b strings.Builder
+	failed := 0
+	for _, result := range results {
+		status := "PASS"
+		if !result.passed {
+			status = "FAIL"
+			failed++
+		}
+		b.WriteString(fmt.Sprintf("  %s %s: %s\n", status, result.threshold, result.detail))
+	}
+	if o.aborted {
+		b.WriteString("  The test was aborted by a breached threshold.\n")
+	}
+	return fmt.Sprintf("Thresholds: %d passed, %d failed\n%s", len(results)-failed, failed, b.String())
+}
@@ -0,0 +1,215 @@
+package boomer
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreshold(t *testing.T) {
+	cases := []struct {
+		expr     string
+		metric   string
+		operator string
+		value    float64
+	}{
+		{"p95<300ms", "p95", "<", 300},
+		{" p99.9 <= 1.5s ", "p99.9", "<=", 1500},
+		{"avg < 20", "avg", "<", 20},
+		{"fail_ratio<1%", "fail_ratio", "<", 0.01},
+		{"fail_ratio < 0.05", "fail_ratio", "<", 0.05},
+		{"rps>500", "rps", ">", 500},
+		{"requests >= 1000", "requests", ">=", 1000},
+	}
+	for _, c := range cases {
+		threshold, err := ParseThreshold("login", c.expr)
+		if assert.NoError(t, err, c.expr) {
+			assert.Equal(t, "login", threshold.Name)
+			assert.Equal(t, c.metric, threshold.Metric)
+			assert.Equal(t, c.operator, threshold.Operator)
+			assert.InDelta(t, c.value, threshold.Value, 1e-9, c.expr)
+		}
+	}
+
+	for _, expr := range []string{"", "p95", "p95 = 300ms", "p0<10ms", "p101<10ms", "rps>5ms", "fail_ratio<1s", "latency<10ms"} {
+		_, err := ParseThreshold("", expr)
+		assert.Error(t, err, expr)
+	}
+
+	threshold, _ := ParseThreshold("login", "p95 < 300ms")
+	assert.Equal(t, "p95<300ms of login", threshold.String())
+}
+
+func newThresholdTestData(stats *requestStats) map[string]interface{} {
+	data := stats.collectReportData()
+	data["user_count"] = int32(1)
+	return data
+}
+
+func TestThresholdOutput(t *testing.T) {
+	p95, _ := ParseThreshold("login", "p95 < 300ms")
+	failRatio, _ := ParseThreshold("", "fail_ratio < 10%")
+	missing, _ := ParseThreshold("logout", "max < 1s")
+	output := NewThresholdOutput(p95, failRatio, missing)
+	output.OnStart()
+
+	stats := newRequestStats()
+	for i := 0; i < 200; i++ {
+		stats.recordSuccess("http", "login", 100, 0, 10)
+	}
+	output.OnEvent(newThresholdTestData(stats))
+	// logout has no requests yet, it's only failed at the end
+	assert.True(t, output.Passed())
+
+	// the stats are aggregated since the start, 10 of 210 requests are slow
+	for i := 0; i < 10; i++ {
+		stats.recordSuccess("http", "login", 500, 0, 10)
+	}
+	stats.logError("http", "login", "500 error")
+	output.OnEvent(newThresholdTestData(stats))
+	assert.True(t, output.Passed())
+
+	for i := 0; i < 10; i++ {
+		stats.recordSuccess("http", "login", 500, 0, 10)
+	}
+	output.OnEvent(newThresholdTestData(stats))
+	assert.False(t, output.Passed())
+
+	output.OnStop()
+	assert.False(t, output.Passed())
+	summary := output.summary()
+	assert.Contains(t, summary, "1 passed, 2 failed")
+	assert.Contains(t, summary, "PASS fail_ratio<10%: 0.45%")
+	assert.Contains(t, summary, "FAIL p95<300ms of login: 500.00ms")
+	assert.Contains(t, summary, "FAIL max<1s of logout: no requests")
+}
+
+func TestThresholdOutputMethods(t *testing.T) {
+	byName, _ := ParseThreshold("login", "max < 300ms")
+	byMethod, _ := ParseThreshold("login", "max < 300ms")
+	byMethod.Method = "GET"
+	output := NewThresholdOutput(byName, byMethod)
+
+	stats := newRequestStats()
+	stats.recordSuccess("GET", "login", 100, 0, 10)
+	stats.recordSuccess("POST", "login", 500, 0, 10)
+	stats.recordSuccess("GET", "home", 800, 0, 10)
+	output.OnEvent(newThresholdTestData(stats))
+	output.OnStop()
+
+	summary := output.summary()
+	assert.Contains(t, summary, "FAIL max<300ms of login: 500.00ms")
+	assert.Contains(t, summary, "PASS max<300ms of GET login: 100.00ms")
+}
+
+func TestThresholdOutputAbort(t *testing.T) {
+	threshold, _ := ParseThreshold("", "max < 100ms")
+	threshold.AbortOnFail = true
+	threshold.DelayAbortEval = 50 * time.Millisecond
+	output := NewThresholdOutput(threshold)
+	aborted := make(chan bool, 1)
+	output.abort = func() {
+		aborted <- true
+	}
+	output.OnStart()
+
+	stats := newRequestStats()
+	stats.recordSuccess("http", "slow", 200, 0, 10)
+	output.OnEvent(newThresholdTestData(stats))
+	select {
+	case <-aborted:
+		t.Fatal("The test should not be aborted in DelayAbortEval")
+	case <-time.After(60 * time.Millisecond):
+	}
+
+	stats.recordSuccess("http", "slow", 200, 0, 10)
+	output.OnEvent(newThresholdTestData(stats))
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the test to be aborted")
+	}
+	assert.False(t, output.Passed())
+}
+
+func TestBoomerExitOnThresholdsFailure(t *testing.T) {
+	exitCode := -1
+	exitFunc = func(code int) {
+		exitCode = code
+	}
+	defer func() {
+		exitFunc = os.Exit
+	}()
+
+	b := NewStandaloneBoomer(1, 1)
+	assert.Error(t, b.AddThreshold("", "p95 ~ 300ms", false))
+	assert.NoError(t, b.AddThreshold("", "requests > 0", false))
+
+	stats := newRequestStats()
+	b.thresholds.OnEvent(newThresholdTestData(stats))
+	assert.True(t, b.Failed())
+	// the process doesn't exit if it's disabled
+	b.SetExitOnThresholdsFailure(false)
+	b.exitOnThresholdsFailure()
+	assert.Equal(t, -1, exitCode)
+
+	b.SetExitOnThresholdsFailure(true)
+	b.exitOnThresholdsFailure()
+	assert.Equal(t, 1, exitCode)
+
+	// it's enabled by default
+	exitCode = -1
+	b = NewBoomer("127.0.0.1", 5557)
+	assert.NoError(t, b.AddThreshold("", "requests > 0", false))
+	b.thresholds.OnEvent(newThresholdTestData(stats))
+	b.exitOnThresholdsFailure()
+	assert.Equal(t, 1, exitCode)
+}
+
+// slowStopOutput takes a while to flush, like writing files.
+type slowStopOutput struct {
+	HitOutput
+	stopped int32
+}
+
+func (o *slowStopOutput) OnStop() {
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&o.stopped, 1)
+}
+
+func TestBoomerQuitWaitsForOutputs(t *testing.T) {
+	exited := make(chan int, 1)
+	exitFunc = func(code int) {
+		exited <- code
+	}
+	defer func() {
+		exitFunc = os.Exit
+	}()
+
+	b := NewStandaloneBoomer(1, 1)
+	assert.NoError(t, b.AddThreshold("", "requests < 0", false))
+	output := &slowStopOutput{}
+	b.AddOutput(output)
+	task := &Task{
+		Name: "foo",
+		Fn: func() {
+			b.RecordSuccess("http", "foo", 1, 10)
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+	go b.Run(task)
+	time.Sleep(100 * time.Millisecond)
+
+	// Quit returns after the outputs are stopped, then Run exits the process
+	b.Quit()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&output.stopped))
+	select {
+	case code := <-exited:
+		assert.Equal(t, 1, code)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for Run to exit")
+	}
+}
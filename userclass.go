@@ -0,0 +1,69 @@
+package boomer
+
+import (
+	"log"
+	"sort"
+)
+
+// userClass is a named set of tasks, like a User class in locustfile.
+// It's registered by Boomer.RegisterUserClass, and spawned by the count in master's spawn message.
+type userClass struct {
+	name            string
+	tasks           []*Task
+	totalTaskWeight int
+	// used by tasks without Task.WaitTime
+	waitTime WaitTime
+}
+
+func newUserClass(name string, tasks []*Task) *userClass {
+	weightSum := 0
+	for _, task := range tasks {
+		weightSum += task.Weight
+	}
+	return &userClass{
+		name:            name,
+		tasks:           tasks,
+		totalTaskWeight: weightSum,
+	}
+}
+
+func (u *userClass) getTask() *Task {
+	return pickTask(u.tasks, u.totalTaskWeight)
+}
+
+// buildSpawnPlan returns the user class of every user to spawn, classes are interleaved,
+// so users of every class are spawned at the same pace. A nil user class means the tasks passed to
+// Boomer.Run, which are used for classes that aren't registered. The second result is the amount of
+// users of every class in the plan, which is reported to master.
+func buildSpawnPlan(userClasses map[string]*userClass, userClassesCount map[string]int64, hasDefaultTasks bool) ([]*userClass, map[string]int64) {
+	names := make([]string, 0, len(userClassesCount))
+	for name := range userClassesCount {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	remaining := make(map[string]int64, len(names))
+	spawned := make(map[string]int64, len(names))
+	total := int64(0)
+	for _, name := range names {
+		if _, ok := userClasses[name]; !ok && !hasDefaultTasks {
+			log.Printf("User class %s is not registered, %d users are ignored.\n", name, userClassesCount[name])
+			continue
+		}
+		remaining[name] = userClassesCount[name]
+		spawned[name] = userClassesCount[name]
+		total += userClassesCount[name]
+	}
+
+	plan := make([]*userClass, 0, total)
+	for int64(len(plan)) < total {
+		for _, name := range names {
+			if remaining[name] <= 0 {
+				continue
+			}
+			remaining[name]--
+			plan = append(plan, userClasses[name])
+		}
+	}
+	return plan, spawned
+}
@@ -0,0 +1,44 @@
+package boomer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildSpawnPlan(t *testing.T) {
+	userClasses := map[string]*userClass{
+		"A": newUserClass("A", []*Task{{Name: "a"}}),
+		"B": newUserClass("B", []*Task{{Name: "b"}}),
+	}
+	userClassesCount := map[string]int64{"A": 1, "B": 3, "C": 2}
+
+	plan, spawned := buildSpawnPlan(userClasses, userClassesCount, false)
+	assert.Equal(t, map[string]int64{"A": 1, "B": 3}, spawned)
+	if assert.Equal(t, 4, len(plan)) {
+		// classes are interleaved
+		assert.Equal(t, "A", plan[0].name)
+		assert.Equal(t, "B", plan[1].name)
+		assert.Equal(t, "B", plan[2].name)
+		assert.Equal(t, "B", plan[3].name)
+	}
+
+	plan, spawned = buildSpawnPlan(userClasses, userClassesCount, true)
+	assert.Equal(t, userClassesCount, spawned)
+	assert.Equal(t, 6, len(plan))
+	defaults := 0
+	for _, user := range plan {
+		if user == nil {
+			defaults++
+		}
+	}
+	assert.Equal(t, 2, defaults)
+}
+
+func TestUserClassGetTask(t *testing.T) {
+	user := newUserClass("A", []*Task{{Name: "a", Weight: 1}, {Name: "b", Weight: 0}})
+	assert.Equal(t, 1, user.totalTaskWeight)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "a", user.getTask().Name)
+	}
+}
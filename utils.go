@@ -29,6 +29,37 @@ func castToInt64(num interface{}) (ret int64, ok bool) {
 	return int64(0), false
 }
 
+// castToFloat64 converts any numeric type to float64, msgpack decodes integral numbers as integers.
+func castToFloat64(num interface{}) (float64, bool) {
+	switch n := num.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
 func round(val float64, roundOn float64, places int) (newVal float64) {
 	var round float64
 	pow := math.Pow(10, float64(places))
@@ -76,6 +107,15 @@ func getNodeID() (nodeID string) {
 	return
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Now returns the current timestamp in milliseconds.
 func Now() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
@@ -20,6 +20,17 @@ func TestCastToInt64(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestCastToFloat64(t *testing.T) {
+	for _, num := range []interface{}{int8(5), int64(5), uint8(5), uint64(5), float32(5), float64(5)} {
+		n, ok := castToFloat64(num)
+		assert.True(t, ok)
+		assert.Equal(t, float64(5), n)
+	}
+
+	_, ok := castToFloat64("5")
+	assert.False(t, ok)
+}
+
 func TestRound(t *testing.T) {
 	if int(round(float64(147.5002), .5, -1)) != 150 {
 		t.Error("147.5002 should be rounded to 150")
@@ -0,0 +1,44 @@
+package boomer
+
+import (
+	"math/rand"
+	"time"
+)
+
+// WaitTime returns how long a user waits after running a task, like wait_time in locust.
+// elapsed is the time taken by the task, measured from the start of the task.
+type WaitTime func(elapsed time.Duration) time.Duration
+
+// Constant waits for d after every task.
+func Constant(d time.Duration) WaitTime {
+	return func(elapsed time.Duration) time.Duration {
+		return d
+	}
+}
+
+// Between waits for a random duration between min and max after every task.
+func Between(min, max time.Duration) WaitTime {
+	return func(elapsed time.Duration) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rand.Int63n(int64(max-min)))
+	}
+}
+
+// ConstantPacing makes every task take at least d, measured from the start of the task.
+// If a task takes longer than d, the next task is started immediately.
+func ConstantPacing(d time.Duration) WaitTime {
+	return func(elapsed time.Duration) time.Duration {
+		return d - elapsed
+	}
+}
+
+// ConstantThroughput makes every user run at most taskRunsPerSecond tasks per second,
+// it's the inverse of ConstantPacing.
+func ConstantThroughput(taskRunsPerSecond float64) WaitTime {
+	if taskRunsPerSecond <= 0 {
+		return Constant(0)
+	}
+	return ConstantPacing(time.Duration(float64(time.Second) / taskRunsPerSecond))
+}
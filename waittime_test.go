@@ -0,0 +1,34 @@
+package boomer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstant(t *testing.T) {
+	waitTime := Constant(time.Second)
+	assert.Equal(t, time.Second, waitTime(0))
+	assert.Equal(t, time.Second, waitTime(time.Minute))
+}
+
+func TestBetween(t *testing.T) {
+	waitTime := Between(time.Second, 2*time.Second)
+	for i := 0; i < 100; i++ {
+		d := waitTime(0)
+		assert.True(t, d >= time.Second && d < 2*time.Second, d)
+	}
+	assert.Equal(t, time.Second, Between(time.Second, time.Second)(0))
+}
+
+func TestConstantPacing(t *testing.T) {
+	waitTime := ConstantPacing(time.Second)
+	assert.Equal(t, 700*time.Millisecond, waitTime(300*time.Millisecond))
+	assert.True(t, waitTime(2*time.Second) <= 0)
+}
+
+func TestConstantThroughput(t *testing.T) {
+	assert.Equal(t, 150*time.Millisecond, ConstantThroughput(4)(100*time.Millisecond))
+	assert.Equal(t, time.Duration(0), ConstantThroughput(0)(time.Second))
+}